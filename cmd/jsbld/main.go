@@ -0,0 +1,190 @@
+// Command jsbld compiles and links javascript projects into bundles.
+//
+// Usage:
+//
+//	jsbld build [flags]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jsbuild "github.com/coldog/jsbld/pkg/build"
+	"github.com/coldog/jsbld/pkg/config"
+)
+
+const usage = `usage: jsbld <command> [flags]
+
+Commands:
+  build    compile sources and write bundles for each entrypoint
+  watch    build, then rebuild whenever a source file changes
+  serve    watch and serve the output with live reload
+
+Run "jsbld <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "build":
+		err = build(os.Args[2:])
+	case "watch":
+		err = watchCmd(os.Args[2:])
+	case "serve":
+		err = serveCmd(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "jsbld: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "jsbld: %s failed\n  %s\n", os.Args[1], strings.Replace(err.Error(), "\n", "\n  ", -1))
+		os.Exit(1)
+	}
+}
+
+// list is a flag.Value collecting comma separated or repeated values.
+type list []string
+
+func (l *list) String() string { return strings.Join(*l, ",") }
+
+func (l *list) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+type buildOptions struct {
+	root        string
+	config      string
+	out         string
+	mode        string
+	compile     string
+	chunks      string
+	srcs        list
+	entrypoints list
+
+	cfg *config.Config
+}
+
+func (o *buildOptions) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&o.root, "root", ".", "project root directory")
+	fs.StringVar(&o.config, "config", "", "configuration file (default <root>/"+config.Filename+")")
+	fs.StringVar(&o.out, "out", "dst", "output directory, relative to the root")
+	fs.StringVar(&o.mode, "mode", config.Development, "build mode, development or production")
+	fs.StringVar(&o.compile, "compile", config.CompileSources, "files to compile, sources or only those reachable from the entrypoints")
+	fs.StringVar(&o.chunks, "chunks", "entry", "chunking strategy, entry, shared or package")
+	fs.Var(&o.srcs, "src", "source directories, relative to the root (default src,node_modules)")
+	fs.Var(&o.entrypoints, "entry", "entrypoint files, relative to the root")
+	return fs
+}
+
+// validate loads the configuration file, applying it to any option which was
+// not set on the command line.
+func (o *buildOptions) validate(fs *flag.FlagSet) error {
+	path := o.config
+	if path == "" {
+		path = filepath.Join(o.root, config.Filename)
+	}
+	c, err := config.LoadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Errors of values set on the command line point at their flag.
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["out"] {
+		c.Output = o.out
+		c.SetFlag("output", "out")
+	}
+	if set["mode"] {
+		c.Mode = o.mode
+		c.SetFlag("mode", "mode")
+	}
+	if set["compile"] {
+		c.Compile = o.compile
+		c.SetFlag("compile", "compile")
+	}
+	if set["chunks"] {
+		c.Chunks = o.chunks
+		c.SetFlag("chunks", "chunks")
+	}
+	if len(o.srcs) > 0 {
+		c.Sources = o.srcs
+		c.SetFlag("sources", "src")
+	}
+	if len(o.entrypoints) > 0 {
+		c.Entrypoints = o.entrypoints
+		c.SetFlag("entrypoints", "entry")
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if len(c.Entrypoints) == 0 {
+		return fmt.Errorf("at least one -entry is required, or entrypoints in %s", config.Filename)
+	}
+	o.cfg = c
+	return nil
+}
+
+func build(args []string) error {
+	opts := &buildOptions{}
+	fs := opts.flags("build")
+	fs.Parse(args)
+	if err := opts.validate(fs); err != nil {
+		return err
+	}
+	return run(opts)
+}
+
+// run executes the full compile, find, bundle and write pipeline.
+func run(opts *buildOptions) error {
+	r, err := jsbuild.Build(context.Background(), jsbuild.Options{Root: opts.root, Config: opts.cfg})
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range r.Chunks {
+		name := chunk.Entrypoint
+		if chunk.Dynamic != "" {
+			name = "import(" + chunk.Dynamic + ")"
+		}
+		size := fmt.Sprintf("%d bytes", chunk.Size)
+		if chunk.Gzip > 0 {
+			size += fmt.Sprintf(", %d gzip", chunk.Gzip)
+		}
+		if chunk.Brotli > 0 {
+			size += fmt.Sprintf(", %d brotli", chunk.Brotli)
+		}
+		fmt.Printf("%s -> %s (%d files, %s)\n", name, filepath.Join(opts.cfg.Output, chunk.Output), len(chunk.Files), size)
+	}
+	printWarnings(r.Warnings)
+	if r.Eliminated > 0 {
+		fmt.Printf("tree shaking eliminated %d bytes\n", r.Eliminated)
+	}
+	fmt.Printf("built %d chunks in %v\n", len(r.Chunks), r.Duration())
+	return nil
+}
+
+func printWarnings(warnings []string) {
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	jsbuild "github.com/coldog/jsbld/pkg/build"
+	"github.com/coldog/jsbld/pkg/devserver"
+)
+
+func serveCmd(args []string) error {
+	opts := &buildOptions{}
+	fs := opts.flags("serve")
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	interval := fs.Duration("interval", 500*time.Millisecond, "polling interval for file changes")
+	hot := fs.Bool("hot", true, "push changed modules to the browser instead of reloading")
+	fs.Parse(args)
+	if err := opts.validate(fs); err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	b, err := jsbuild.New(jsbuild.Options{Root: opts.root, Config: opts.cfg, DevServer: devserver.EventsPath})
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	// Bundles are served first, then any static files in the project root
+	// such as index.html.
+	srv := &devserver.Server{
+		Dirs: []string{filepath.Join(opts.root, opts.cfg.Output), opts.root},
+	}
+	httpSrv := &http.Server{Addr: *addr, Handler: srv}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- httpSrv.ListenAndServe()
+	}()
+	fmt.Printf("serving on http://%s\n", *addr)
+
+	go func() {
+		err := watchBuild(ctx, b, opts, *interval, func(changed []string, err error) {
+			if err != nil {
+				srv.Send("failed", err.Error())
+				return
+			}
+			if *hot {
+				if sent := sendUpdate(srv, b, changed); sent {
+					return
+				}
+			}
+			srv.Reload()
+		})
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		cancel()
+		httpSrv.Shutdown(context.Background())
+		return err
+	case <-ctx.Done():
+		return httpSrv.Shutdown(context.Background())
+	}
+}
+
+// sendUpdate pushes the changed modules to the browser. It returns false if
+// the change cannot be applied as a hot update.
+func sendUpdate(srv *devserver.Server, b *jsbuild.Builder, changed []string) bool {
+	updates, ok, err := b.Bundle().HotUpdate(changed)
+	if err != nil || !ok {
+		return false
+	}
+	data, err := json.Marshal(updates)
+	if err != nil {
+		return false
+	}
+	srv.Send("update", string(data))
+	return true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	jsbuild "github.com/coldog/jsbld/pkg/build"
+	"github.com/coldog/jsbld/pkg/watch"
+)
+
+func watchCmd(args []string) error {
+	opts := &buildOptions{}
+	fs := opts.flags("watch")
+	interval := fs.Duration("interval", 500*time.Millisecond, "polling interval for file changes")
+	fs.Parse(args)
+	if err := opts.validate(fs); err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	b, err := jsbuild.New(jsbuild.Options{Root: opts.root, Config: opts.cfg})
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	return watchBuild(ctx, b, opts, *interval, nil)
+}
+
+// interruptContext returns a context cancelled on the first interrupt signal.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// watchBuild runs an initial build and then rebuilds whenever a source file
+// changes. Errors during a rebuild are reported without stopping the watch.
+// If rebuilt is set, it is called with the outcome of every rebuild.
+func watchBuild(ctx context.Context, b *jsbuild.Builder, opts *buildOptions, interval time.Duration, rebuilt func(changed []string, err error)) error {
+	if r, err := b.Build(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "jsbld: build failed: %v\n", err)
+	} else {
+		printWarnings(r.Warnings)
+		fmt.Printf("built %d chunks in %v\n", len(r.Chunks), r.Duration())
+	}
+
+	w := &watch.Watcher{
+		Root:     opts.root,
+		Dirs:     opts.cfg.Sources,
+		Interval: interval,
+	}
+	fmt.Printf("watching %v for changes\n", opts.cfg.Sources)
+	err := w.Watch(ctx, func(changed []string) {
+		r, err := b.Rebuild(ctx, changed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "jsbld: rebuild failed: %v\n", err)
+		} else {
+			printWarnings(r.Warnings)
+			fmt.Printf(
+				"rebuilt %d files, %d entrypoints, %d chunks in %v (compile %v, find %v, write %v)\n",
+				len(r.Changed), len(r.Affected), len(r.Written()), r.Duration(), r.Compile, r.Find, r.Write,
+			)
+		}
+		if rebuilt != nil {
+			rebuilt(changed, err)
+		}
+	})
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+// Package brotli implements a brotli (RFC 7932) encoder.
+//
+// The encoder finds matches with hash chains and writes one prefix code per
+// alphabet for every meta-block, without block splitting, context modeling
+// or the static dictionary. Output is larger than the reference encoder's at
+// its highest quality but much smaller than gzip's for typical javascript.
+package brotli
+
+const (
+	windowBits = 22
+	// maxDistance is the largest backward distance of the window.
+	maxDistance = 1<<windowBits - 16
+	// blockSize is the maximum length of a meta-block.
+	blockSize = 1 << 20
+
+	minMatch  = 4
+	maxMatch  = 1 << 16
+	hashBits  = 17
+	maxChain  = 64
+	niceMatch = 258
+)
+
+// Encode compresses data.
+func Encode(data []byte) []byte {
+	w := &bitWriter{}
+	// WBITS 22 is a 1 followed by 22 - 17.
+	w.write(1, 1)
+	w.write(3, windowBits-17)
+	if len(data) == 0 {
+		w.write(1, 1) // ISLAST
+		w.write(1, 1) // ISLASTEMPTY
+		return w.bytes()
+	}
+
+	m := newMatcher(data)
+	for start := 0; start < len(data); start += blockSize {
+		end := start + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		writeMetaBlock(w, data, start, end, m.commands(start, end), end == len(data))
+	}
+	return w.bytes()
+}
+
+// command inserts literals and copies length bytes from distance back.
+// The last command of a meta-block may only insert.
+type command struct {
+	insert   int
+	length   int
+	distance int
+}
+
+// matcher finds backward matches with hash chains over the whole input.
+type matcher struct {
+	data []byte
+	head []int32
+	prev []int32
+	// next is the first position not inserted in the chains yet.
+	next int
+}
+
+func newMatcher(data []byte) *matcher {
+	m := &matcher{data: data, head: make([]int32, 1<<hashBits), prev: make([]int32, len(data))}
+	for i := range m.head {
+		m.head[i] = -1
+	}
+	return m
+}
+
+func (m *matcher) hash(i int) uint32 {
+	d := m.data
+	v := uint32(d[i]) | uint32(d[i+1])<<8 | uint32(d[i+2])<<16 | uint32(d[i+3])<<24
+	return (v * 0x1e35a7bd) >> (32 - hashBits)
+}
+
+// insertTo inserts the positions before n in the chains.
+func (m *matcher) insertTo(n int) {
+	for ; m.next < n; m.next++ {
+		if m.next+minMatch > len(m.data) {
+			continue
+		}
+		h := m.hash(m.next)
+		m.prev[m.next] = m.head[h]
+		m.head[h] = int32(m.next)
+	}
+}
+
+// find returns the longest match at i not extending past end.
+func (m *matcher) find(i, end int) (length, distance int) {
+	if i+minMatch > end {
+		return 0, 0
+	}
+	m.insertTo(i)
+	limit := end - i
+	if limit > maxMatch {
+		limit = maxMatch
+	}
+	d := m.data
+	for j, chain := int(m.head[m.hash(i)]), 0; j >= 0 && chain < maxChain && i-j <= maxDistance; j, chain = int(m.prev[j]), chain+1 {
+		if length > 0 && d[j+length] != d[i+length] {
+			continue
+		}
+		n := 0
+		for n < limit && d[j+n] == d[i+n] {
+			n++
+		}
+		if n > length {
+			length, distance = n, i-j
+			if n >= niceMatch || n == limit {
+				break
+			}
+		}
+	}
+	if length < minMatch {
+		return 0, 0
+	}
+	return length, distance
+}
+
+// commands parses the data between start and end with lazy matching.
+func (m *matcher) commands(start, end int) []command {
+	cmds := []command{}
+	literals := 0
+	for i := start; i < end; {
+		length, distance := m.find(i, end)
+		if length > 0 && length < niceMatch {
+			// Prefer a longer match starting at the next byte.
+			if next, nextDistance := m.find(i+1, end); next > length {
+				literals++
+				i++
+				length, distance = next, nextDistance
+			}
+		}
+		if length == 0 {
+			literals++
+			i++
+			continue
+		}
+		cmds = append(cmds, command{insert: literals, length: length, distance: distance})
+		literals = 0
+		i += length
+	}
+	if literals > 0 {
+		cmds = append(cmds, command{insert: literals})
+	}
+	return cmds
+}
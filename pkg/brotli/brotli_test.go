@@ -0,0 +1,81 @@
+package brotli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	dir, err := ioutil.TempDir("", "brotli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 10000)
+	r.Read(random)
+	text := bytes.Repeat([]byte("function add(a, b) { return a + b; }\n"), 100)
+	large := make([]byte, 3*blockSize)
+	for i := range large {
+		large[i] = "abcdefgh"[r.Intn(8)]
+	}
+	inputs := [][]byte{{}, []byte("a"), text, random, large}
+
+	for i, in := range inputs {
+		out := Encode(in)
+		if len(in) == len(text) && len(out) > len(in)/10 {
+			t.Errorf("text compressed to %d bytes", len(out))
+		}
+		path := filepath.Join(dir, strconv.Itoa(i))
+		ioutil.WriteFile(path, in, 0666)
+		ioutil.WriteFile(path+".br", out, 0666)
+	}
+	script := `const fs = require('fs'), zlib = require('zlib');
+for (const path of process.argv.slice(1)) {
+  if (!zlib.brotliDecompressSync(fs.readFileSync(path + '.br')).equals(fs.readFileSync(path))) {
+    console.log('mismatch: ' + path);
+  }
+}`
+	args := []string{"-e", script}
+	for i := range inputs {
+		args = append(args, filepath.Join(dir, strconv.Itoa(i)))
+	}
+	if out, err := exec.Command(node, args...).CombinedOutput(); err != nil || len(out) > 0 {
+		t.Fatalf("decompression failed: %v\n%s", err, out)
+	}
+}
+
+func TestRepeatZeros(t *testing.T) {
+	for run := 1; run < 200; run++ {
+		tokens, extras := repeatZeros(nil, nil, run)
+		// Decode the way the reader does.
+		n, repeat := 0, 0
+		for i, token := range tokens {
+			if token == 0 {
+				n++
+				repeat = 0
+				continue
+			}
+			prev := repeat
+			if repeat > 0 {
+				repeat = (repeat - 2) << 3
+			}
+			repeat += extras[i] + 3
+			n += repeat - prev
+		}
+		if n != run {
+			t.Fatalf("run of %d decoded as %d: %v %v", run, n, tokens, extras)
+		}
+	}
+}
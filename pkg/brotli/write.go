@@ -0,0 +1,383 @@
+package brotli
+
+import "sort"
+
+// bitWriter packs bits starting with the least significant.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) write(n uint, v uint64) {
+	w.acc |= v << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// bytes pads the last byte with zeros and returns the output.
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.out
+}
+
+// Insert and copy length codes: the base length and number of extra bits.
+var (
+	insertBase  = []int{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578, 1090, 2114, 6210, 22594}
+	insertExtra = []uint{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+	copyBase    = []int{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198, 326, 582, 1094, 2118}
+	copyExtra   = []uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+)
+
+// commandCells are the first insert and copy symbols with an explicit
+// distance for every combination of insert and copy code ranges of 8.
+var commandCells = [3][3]int{
+	{128, 192, 384},
+	{256, 320, 512},
+	{448, 576, 640},
+}
+
+func lengthCode(base []int, n int) int {
+	code := len(base) - 1
+	for base[code] > n {
+		code--
+	}
+	return code
+}
+
+// symbol is a prefix coded symbol followed by extra bits.
+type symbol struct {
+	alphabet int
+	value    int
+	extra    uint64
+	nextra   uint
+}
+
+const (
+	literalAlphabet = iota
+	commandAlphabet
+	distanceAlphabet
+)
+
+var alphabetSizes = [3]int{256, 704, 64}
+
+// writeMetaBlock writes a compressed meta-block of the data between start
+// and end.
+func writeMetaBlock(w *bitWriter, data []byte, start, end int, cmds []command, last bool) {
+	symbols := []symbol{}
+	pos := start
+	for _, cmd := range cmds {
+		ic := lengthCode(insertBase, cmd.insert)
+		length := cmd.length
+		if length == 0 {
+			length = 2 // ignored at the end of the meta-block
+		}
+		cc := lengthCode(copyBase, length)
+		code := commandCells[ic>>3][cc>>3] + (ic&7)<<3 + cc&7
+		symbols = append(symbols,
+			symbol{alphabet: commandAlphabet, value: code},
+			symbol{alphabet: -1, extra: uint64(cmd.insert - insertBase[ic]), nextra: insertExtra[ic]},
+			symbol{alphabet: -1, extra: uint64(length - copyBase[cc]), nextra: copyExtra[cc]},
+		)
+		for _, c := range data[pos : pos+cmd.insert] {
+			symbols = append(symbols, symbol{alphabet: literalAlphabet, value: int(c)})
+		}
+		pos += cmd.insert + cmd.length
+		if cmd.length == 0 {
+			continue
+		}
+		// Distances above 16 - 4 are coded with NPOSTFIX and NDIRECT of 0.
+		d := cmd.distance + 3
+		nbits := uint(bitLength(d) - 2)
+		hi := (d >> nbits) & 1
+		symbols = append(symbols,
+			symbol{alphabet: distanceAlphabet, value: 16 + 2*int(nbits-1) + hi},
+			symbol{alphabet: -1, extra: uint64(d - (2+hi)<<nbits), nextra: nbits},
+		)
+	}
+
+	counts := [3][]int{}
+	for i, size := range alphabetSizes {
+		counts[i] = make([]int, size)
+	}
+	for _, s := range symbols {
+		if s.alphabet >= 0 {
+			counts[s.alphabet][s.value]++
+		}
+	}
+
+	// ISLAST, MNIBBLES, MLEN - 1 and ISUNCOMPRESSED.
+	w.write(1, boolBit(last))
+	if last {
+		w.write(1, 0)
+	}
+	n := uint64(end - start - 1)
+	nibbles := uint(4)
+	for n>>(4*nibbles) != 0 {
+		nibbles++
+	}
+	w.write(2, uint64(nibbles-4))
+	w.write(4*nibbles, n)
+	if !last {
+		w.write(1, 0)
+	}
+	// One block type for each category, NPOSTFIX and NDIRECT of 0, the
+	// literal context mode and one prefix code for each category.
+	w.write(3, 0)
+	w.write(6, 0)
+	w.write(2, 0)
+	w.write(2, 0)
+
+	codes := [3]*prefixCode{}
+	for i, size := range alphabetSizes {
+		codes[i] = newPrefixCode(counts[i], 15)
+		codes[i].store(w, size)
+	}
+	for _, s := range symbols {
+		if s.alphabet < 0 {
+			w.write(s.nextra, s.extra)
+			continue
+		}
+		codes[s.alphabet].writeSymbol(w, s.value)
+	}
+}
+
+func boolBit(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func bitLength(n int) int {
+	l := 0
+	for n > 0 {
+		l++
+		n >>= 1
+	}
+	return l
+}
+
+// prefixCode is a canonical prefix code. Codes are stored bit reversed, to
+// be written starting with the most significant bit.
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16
+	// used are the symbols with a code, in order.
+	used []int
+}
+
+// newPrefixCode builds a prefix code of the counts, limited to maxLength
+// bits.
+func newPrefixCode(counts []int, maxLength int) *prefixCode {
+	c := &prefixCode{lengths: make([]uint8, len(counts)), codes: make([]uint16, len(counts))}
+	for s, count := range counts {
+		if count > 0 {
+			c.used = append(c.used, s)
+		}
+	}
+	if len(c.used) < 2 {
+		return c
+	}
+	// Flatten the distribution until the code fits in maxLength bits.
+	for min := 1; ; min *= 2 {
+		weights := make([]int, len(c.used))
+		for i, s := range c.used {
+			weights[i] = counts[s]
+			if weights[i] < min {
+				weights[i] = min
+			}
+		}
+		lengths := huffmanLengths(weights)
+		fits := true
+		for _, l := range lengths {
+			if l > maxLength {
+				fits = false
+			}
+		}
+		if fits {
+			for i, s := range c.used {
+				c.lengths[s] = uint8(lengths[i])
+			}
+			break
+		}
+	}
+	c.assign()
+	return c
+}
+
+// huffmanLengths returns the code lengths of a Huffman code of the weights.
+func huffmanLengths(weights []int) []int {
+	type node struct {
+		weight      int
+		left, right int
+	}
+	nodes := []node{}
+	for _, w := range weights {
+		nodes = append(nodes, node{weight: w, left: -1, right: -1})
+	}
+	queue := make([]int, len(nodes))
+	for i := range queue {
+		queue[i] = i
+	}
+	for len(queue) > 1 {
+		sort.SliceStable(queue, func(i, j int) bool { return nodes[queue[i]].weight < nodes[queue[j]].weight })
+		a, b := queue[0], queue[1]
+		nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, left: a, right: b})
+		queue = append(queue[2:], len(nodes)-1)
+	}
+	lengths := make([]int, len(weights))
+	var walk func(n, depth int)
+	walk = func(n, depth int) {
+		if nodes[n].left < 0 {
+			lengths[n] = depth
+			return
+		}
+		walk(nodes[n].left, depth+1)
+		walk(nodes[n].right, depth+1)
+	}
+	walk(queue[0], 0)
+	return lengths
+}
+
+// assign sets the canonical codes of the lengths.
+func (c *prefixCode) assign() {
+	count := [16]int{}
+	for _, l := range c.lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	next := [16]int{}
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range c.lengths {
+		if l == 0 {
+			continue
+		}
+		code := next[l]
+		next[l]++
+		rev := 0
+		for i := 0; i < int(l); i++ {
+			rev = rev<<1 | (code>>uint(i))&1
+		}
+		c.codes[s] = uint16(rev)
+	}
+}
+
+func (c *prefixCode) writeSymbol(w *bitWriter, s int) {
+	w.write(uint(c.lengths[s]), uint64(c.codes[s]))
+}
+
+// Code length codes are written in this order, each with a fixed code.
+var (
+	codeLengthOrder = []int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	codeLengthBits  = []uint64{0, 7, 3, 2, 1, 15}
+	codeLengthSizes = []uint{2, 4, 3, 2, 2, 4}
+)
+
+const repeatZero = 17
+
+// store writes the code for an alphabet of size symbols.
+func (c *prefixCode) store(w *bitWriter, size int) {
+	if len(c.used) < 2 {
+		// A simple prefix code of one symbol takes no bits to write.
+		s := 0
+		if len(c.used) == 1 {
+			s = c.used[0]
+		}
+		w.write(2, 1) // HSKIP
+		w.write(2, 0) // NSYM - 1
+		w.write(uint(bitLength(size-1)), uint64(s))
+		return
+	}
+
+	// The lengths up to the last used symbol, zero runs as repeat codes.
+	lengths := c.lengths[:c.used[len(c.used)-1]+1]
+	tokens, extras := []int{}, []int{}
+	for i := 0; i < len(lengths); {
+		if lengths[i] != 0 {
+			tokens, extras = append(tokens, int(lengths[i])), append(extras, 0)
+			i++
+			continue
+		}
+		run := 0
+		for i+run < len(lengths) && lengths[i+run] == 0 {
+			run++
+		}
+		i += run
+		tokens, extras = repeatZeros(tokens, extras, run)
+	}
+
+	counts := make([]int, 18)
+	for _, t := range tokens {
+		counts[t]++
+	}
+	clc := newPrefixCode(counts, 5)
+	if len(clc.used) == 1 {
+		// A single code length code is read with no bits.
+		clc.lengths[clc.used[0]] = 1
+	}
+
+	// Trailing unused code length codes may be omitted once the code is
+	// complete, except for a single code.
+	last := len(codeLengthOrder) - 1
+	if len(clc.used) > 1 {
+		for clc.lengths[codeLengthOrder[last]] == 0 {
+			last--
+		}
+	}
+	w.write(2, 0) // HSKIP
+	for _, s := range codeLengthOrder[:last+1] {
+		l := clc.lengths[s]
+		w.write(codeLengthSizes[l], codeLengthBits[l])
+	}
+	for i, t := range tokens {
+		if len(clc.used) > 1 {
+			clc.writeSymbol(w, t)
+		}
+		if t == repeatZero {
+			w.write(3, uint64(extras[i]))
+		}
+	}
+}
+
+// repeatZeros appends the tokens for a run of zero lengths. Consecutive
+// repeat codes multiply, each one adding three bits to the count.
+func repeatZeros(tokens, extras []int, run int) ([]int, []int) {
+	if run == 11 {
+		tokens, extras = append(tokens, 0), append(extras, 0)
+		run--
+	}
+	if run < 3 {
+		for ; run > 0; run-- {
+			tokens, extras = append(tokens, 0), append(extras, 0)
+		}
+		return tokens, extras
+	}
+	start := len(tokens)
+	run -= 3
+	for {
+		tokens, extras = append(tokens, repeatZero), append(extras, run&7)
+		run >>= 3
+		if run == 0 {
+			break
+		}
+		run--
+	}
+	for i, j := start, len(tokens)-1; i < j; i, j = i+1, j-1 {
+		tokens[i], tokens[j] = tokens[j], tokens[i]
+		extras[i], extras[j] = extras[j], extras[i]
+	}
+	return tokens, extras
+}
@@ -0,0 +1,377 @@
+// Package build runs the complete jsbld pipeline: compiling sources, finding
+// the files reachable from each entrypoint, bundling them into chunks and
+// writing the chunks to the output directory.
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coldog/jsbld/pkg/compiler"
+	"github.com/coldog/jsbld/pkg/config"
+	"github.com/coldog/jsbld/pkg/linker"
+)
+
+type Options struct {
+	// Root is the project root directory.
+	Root string
+
+	// Config is the project configuration. It is loaded from the root if nil.
+	Config *config.Config
+
+	// DevServer is the event stream URL of a development server, see
+	// linker.Bundle.DevServer.
+	DevServer string
+}
+
+// Result describes the output of a build.
+type Result struct {
+	Chunks   []Chunk
+	Warnings []string
+	// Eliminated is the number of bytes removed by tree shaking in production
+	// builds.
+	Eliminated int64
+
+	// Changed and Affected list the changed files and the entrypoints which
+	// reach them for a rebuild.
+	Changed  []string
+	Affected []string
+
+	Compile time.Duration
+	Find    time.Duration
+	Write   time.Duration
+}
+
+// Written returns the chunks written by the build.
+func (r *Result) Written() []Chunk {
+	written := []Chunk{}
+	for _, chunk := range r.Chunks {
+		if chunk.Written {
+			written = append(written, chunk)
+		}
+	}
+	return written
+}
+
+// Duration returns the total time taken by the build.
+func (r *Result) Duration() time.Duration {
+	return r.Compile + r.Find + r.Write
+}
+
+type Chunk struct {
+	// Output is the file name of the chunk in the output directory.
+	Output     string
+	Entrypoint string
+	// Dynamic is set instead of Entrypoint for chunks loaded with import().
+	Dynamic string
+	Files   []File
+	Size    int64
+	Hash    string
+	// Gzip and Brotli are the sizes of the compressed siblings of the chunk,
+	// or 0 if none were written.
+	Gzip   int64
+	Brotli int64
+
+	// Written is false if an identical chunk was written by a previous build.
+	Written bool
+}
+
+type File struct {
+	Name string
+	Size int64
+	Hash string
+}
+
+// Build compiles and bundles the project.
+func Build(ctx context.Context, opts Options) (*Result, error) {
+	b, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	return b.Build(ctx)
+}
+
+// Builder holds the state of a build between incremental rebuilds.
+type Builder struct {
+	config   *config.Config
+	compiler *compiler.Compiler
+	bundler  linker.Bundler
+	bundle   *linker.Bundle
+	outputs  map[string]bool
+}
+
+// New validates the options and returns a builder.
+func New(opts Options) (*Builder, error) {
+	c := opts.Config
+	if c == nil {
+		var err error
+		c, err = config.Load(opts.Root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if len(c.Entrypoints) == 0 {
+		return nil, fmt.Errorf("build: no entrypoints")
+	}
+
+	root, err := filepath.Abs(opts.Root)
+	if err != nil {
+		return nil, err
+	}
+	entrypoints := make([]string, len(c.Entrypoints))
+	for i, entry := range c.Entrypoints {
+		entrypoints[i] = filepath.Clean(entry)
+	}
+	html := ""
+	if c.HTML != "" {
+		html = filepath.Join(root, c.HTML)
+	}
+	return &Builder{
+		config:   c,
+		compiler: c.Compiler(root),
+		bundler:  c.Bundler(),
+		bundle: &linker.Bundle{
+			Root:        filepath.Join(root, c.Output),
+			Entrypoints: entrypoints,
+			DevServer:   opts.DevServer,
+			Hoist:       c.Mode == config.Production,
+			Minify:      c.Mode == config.Production,
+			HTML:        html,
+			Concurrency: c.Concurrency,
+
+			Compress:        c.Compressions(),
+			CompressMinSize: c.CompressMinSize,
+			Nonce:           c.Nonce,
+		},
+		outputs: map[string]bool{},
+	}, nil
+}
+
+// Bundle returns the bundle of the last build.
+func (b *Builder) Bundle() *linker.Bundle {
+	return b.bundle
+}
+
+// Close stops the compiler workers started by the builds.
+func (b *Builder) Close() error {
+	return b.compiler.Close()
+}
+
+// Build runs the complete pipeline and writes every chunk.
+func (b *Builder) Build(ctx context.Context) (*Result, error) {
+	r := &Result{}
+
+	t1 := time.Now()
+	var err error
+	if b.config.Compile == config.CompileEntrypoints {
+		err = b.compiler.CompileFrom(ctx, b.bundle.Entrypoints, nil)
+	} else {
+		err = b.compiler.Compile(ctx, b.config.Sources)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compile: %v", err)
+	}
+	r.Compile = time.Since(t1)
+
+	t2 := time.Now()
+	if err := b.bundle.Find(); err != nil {
+		return nil, fmt.Errorf("find: %v", err)
+	}
+	r.Find = time.Since(t2)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return r, b.link(r, true)
+}
+
+// Rebuild recompiles the changed files, relative to the root, refinds the
+// entrypoints reaching them and writes the chunks whose output changed.
+func (b *Builder) Rebuild(ctx context.Context, changed []string) (*Result, error) {
+	r := &Result{Changed: changed}
+
+	t1 := time.Now()
+	compile := b.withUnresolved(changed)
+	var err error
+	if b.config.Compile == config.CompileEntrypoints {
+		err = b.compiler.CompileFrom(ctx, b.reachable(compile), b.bundled)
+	} else {
+		err = b.compiler.CompileFiles(ctx, compile)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compile: %v", err)
+	}
+	r.Compile = time.Since(t1)
+
+	t2 := time.Now()
+	r.Affected = b.bundle.Affected(changed)
+	if err := b.bundle.Refind(r.Affected); err != nil {
+		return nil, fmt.Errorf("find: %v", err)
+	}
+	r.Find = time.Since(t2)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return r, b.link(r, false)
+}
+
+// withUnresolved adds the files with unresolved imports to the changed files
+// if any of them is outside the bundle, as it may have been added since the
+// last build and resolve one of the imports.
+func (b *Builder) withUnresolved(changed []string) []string {
+	files := []string{}
+	seen := map[string]bool{}
+	added := false
+	for _, name := range changed {
+		name = filepath.Clean(name)
+		if _, ok := b.bundle.Files[name]; !ok {
+			added = true
+		}
+		seen[name] = true
+		files = append(files, name)
+	}
+	if !added {
+		return files
+	}
+	for _, name := range b.bundle.Unresolved() {
+		if !seen[name] {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// reachable returns the changed files which are entrypoints or reached by
+// them. Only these and the files they newly import, see bundled, need to be
+// compiled.
+func (b *Builder) reachable(changed []string) []string {
+	reached := map[string]bool{}
+	for _, entrypoint := range b.bundle.Entrypoints {
+		reached[entrypoint] = true
+	}
+	for name := range b.bundle.Files {
+		reached[name] = true
+	}
+	files := []string{}
+	for _, name := range changed {
+		if reached[filepath.Clean(name)] {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// bundled returns whether the file is part of the bundle. Its output is up to
+// date unless it changed, so rebuilds do not compile or traverse it again.
+func (b *Builder) bundled(file string) bool {
+	_, ok := b.bundle.Files[file]
+	return ok
+}
+
+// link rebundles the files and writes the chunks whose output changed, or all
+// chunks if force is set.
+func (b *Builder) link(r *Result, force bool) error {
+	t1 := time.Now()
+	b.bundle.Chunks = nil
+	if err := b.bundler.Bundle(b.bundle); err != nil {
+		return fmt.Errorf("bundle: %v", err)
+	}
+	if b.config.Mode == config.Production {
+		eliminated, err := b.bundle.Shake()
+		if err != nil {
+			return fmt.Errorf("shake: %v", err)
+		}
+		r.Eliminated = eliminated
+	}
+
+	outputs := map[string]bool{}
+	stale := []*linker.Chunk{}
+	for _, chunk := range b.bundle.Chunks {
+		output := chunk.Output()
+		if force || !b.outputs[output] {
+			stale = append(stale, chunk)
+		}
+		outputs[output] = true
+	}
+	if err := b.bundle.WriteChunks(stale); err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+	b.outputs = outputs
+
+	written := map[*linker.Chunk]bool{}
+	for _, chunk := range stale {
+		written[chunk] = true
+	}
+	for _, chunk := range b.bundle.Chunks {
+		c, err := b.result(chunk)
+		if err != nil {
+			return err
+		}
+		c.Written = written[chunk]
+		r.Chunks = append(r.Chunks, c)
+	}
+	r.Warnings = b.bundle.Warnings()
+	r.Write = time.Since(t1)
+	return nil
+}
+
+func (b *Builder) result(chunk *linker.Chunk) (Chunk, error) {
+	c := Chunk{Output: chunk.Output(), Entrypoint: chunk.Entrypoint, Dynamic: chunk.Dynamic}
+	var err error
+	c.Size, c.Hash, err = digest(filepath.Join(b.bundle.Root, c.Output))
+	if err != nil {
+		return c, err
+	}
+	for _, format := range b.bundle.Compress {
+		st, err := os.Stat(filepath.Join(b.bundle.Root, c.Output+format))
+		if err != nil {
+			continue
+		}
+		switch format {
+		case linker.Gzip:
+			c.Gzip = st.Size()
+		case linker.Brotli:
+			c.Brotli = st.Size()
+		}
+	}
+	for _, name := range chunk.Files.Keys() {
+		f := File{Name: name, Hash: chunk.Files[name].Hash}
+		if st, err := os.Stat(filepath.Join(b.bundle.Root, name)); err == nil {
+			f.Size = st.Size()
+		}
+		c.Files = append(c.Files, f)
+	}
+	return c, nil
+}
+
+// digest returns the size and sha256 hash of a file.
+func digest(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
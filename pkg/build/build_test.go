@@ -0,0 +1,249 @@
+package build
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coldog/jsbld/pkg/config"
+)
+
+// project writes the files into a temporary project root.
+func project(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestBuild(t *testing.T) {
+	root := project(t, map[string]string{
+		"src/index.js":              `var lib = require("lib"); var a = require("./a"); require("./missing");`,
+		"src/a.js":                  `module.exports = "a";`,
+		"node_modules/lib/index.js": `module.exports = "lib";`,
+		"index.html":                "<html><head></head><body></body></html>",
+	})
+	defer os.RemoveAll(root)
+
+	c := config.Default()
+	c.Entrypoints = []string{"src/index.js"}
+	c.Compilers = map[string]string{"js": "cp $1 $2"}
+	c.HTML = "index.html"
+
+	b, err := New(Options{Root: root, Config: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.Build(context.Background())
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if len(r.Chunks) != 1 || len(r.Chunks[0].Files) != 3 {
+		t.Fatalf("unexpected chunks: %+v", r.Chunks)
+	}
+	chunk := r.Chunks[0]
+	if !chunk.Written || chunk.Size == 0 || len(chunk.Hash) != 64 {
+		t.Fatalf("unexpected chunk: %+v", chunk)
+	}
+	if _, err := os.Stat(filepath.Join(root, "dst", chunk.Output)); err != nil {
+		t.Fatalf("chunk not written: %v", err)
+	}
+	page, _ := ioutil.ReadFile(filepath.Join(root, "dst", "index.html"))
+	if !strings.Contains(string(page), `<script defer src="`+chunk.Output+`" integrity="sha384-`) {
+		t.Fatalf("html not written: %s", page)
+	}
+	if len(r.Warnings) != 1 {
+		t.Fatalf("expected unresolved require warning: %v", r.Warnings)
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "src/a.js"), []byte(`module.exports = "b";`), 0666)
+	r, err = b.Rebuild(context.Background(), []string{"src/a.js"})
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if len(r.Affected) != 1 || len(r.Written()) != 1 || r.Written()[0].Output == chunk.Output {
+		t.Fatalf("unexpected rebuild: %+v", r)
+	}
+
+	r, err = b.Rebuild(context.Background(), []string{"node_modules/lib/package.json"})
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if len(r.Written()) != 0 {
+		t.Fatalf("unexpected rebuild: %+v", r)
+	}
+
+	// Adding the missing file resolves the require of its importer.
+	ioutil.WriteFile(filepath.Join(root, "src/missing.js"), []byte(`module.exports = "missing";`), 0666)
+	r, err = b.Rebuild(context.Background(), []string{"src/missing.js"})
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if len(r.Affected) != 1 || len(r.Written()) != 1 || len(r.Chunks[0].Files) != 4 || len(r.Warnings) != 0 {
+		t.Fatalf("added file not bundled: %+v", r)
+	}
+}
+
+func TestCompileEntrypoints(t *testing.T) {
+	root := project(t, map[string]string{
+		"src/index.js":                `module.exports = require("lib");`,
+		"src/unused.js":               `module.exports = "unused";`,
+		"src/later.js":                `module.exports = "later";`,
+		"node_modules/lib/index.js":   `module.exports = "lib";`,
+		"node_modules/other/index.js": `module.exports = "other";`,
+	})
+	defer os.RemoveAll(root)
+
+	c := config.Default()
+	c.Entrypoints = []string{"src/index.js"}
+	c.Compilers = map[string]string{"js": "cp $1 $2"}
+	c.Compile = config.CompileEntrypoints
+
+	b, err := New(Options{Root: root, Config: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Build(context.Background()); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	compiled := func(name string) bool {
+		_, err := os.Stat(filepath.Join(root, "dst", name+".o"))
+		return err == nil
+	}
+	if !compiled("src/index.js") || !compiled("node_modules/lib/index.js") || compiled("src/unused.js") || compiled("node_modules/other/index.js") {
+		t.Fatal("unreachable files compiled")
+	}
+
+	// Changes to unreachable files are ignored, new imports are compiled.
+	ioutil.WriteFile(filepath.Join(root, "src/index.js"), []byte(`module.exports = require("./later");`), 0666)
+	if _, err := b.Rebuild(context.Background(), []string{"src/index.js", "src/unused.js"}); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if !compiled("src/later.js") || compiled("src/unused.js") {
+		t.Fatal("wrong files compiled on rebuild")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	root := project(t, map[string]string{
+		"src/index.js":              `module.exports = require("lib");`,
+		"node_modules/lib/index.js": `module.exports = "lib";`,
+		"index.html":                "<html><head></head><body></body></html>",
+	})
+	defer os.RemoveAll(root)
+
+	c := config.Default()
+	c.Entrypoints = []string{"src/index.js"}
+	c.Compilers = map[string]string{"js": "cp $1 $2"}
+	c.HTML = "index.html"
+	c.Compress = []string{"gzip", "brotli"}
+	c.CompressMinSize = 512
+
+	r, err := Build(context.Background(), Options{Root: root, Config: c})
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	chunk := r.Chunks[0]
+	if chunk.Gzip == 0 || chunk.Brotli == 0 || chunk.Gzip >= chunk.Size || chunk.Brotli >= chunk.Size {
+		t.Fatalf("unexpected compressed sizes: %+v", chunk)
+	}
+	f, err := os.Open(filepath.Join(root, "dst", chunk.Output+".gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil || int64(len(data)) != chunk.Size {
+		t.Fatalf("wrong gzip sibling: %d bytes, %v", len(data), err)
+	}
+	// The page is smaller than the threshold.
+	if _, err := os.Stat(filepath.Join(root, "dst", "index.html.gz")); !os.IsNotExist(err) {
+		t.Fatalf("small file compressed: %v", err)
+	}
+}
+
+func TestConcurrentBuilds(t *testing.T) {
+	compilers := []string{"cp $1 $2", "sh -c cat<$1>$2"}
+	roots := []string{}
+	for range compilers {
+		root := project(t, map[string]string{
+			"src/index.js": `require("./a");`,
+			"src/a.js":     `module.exports = 1;`,
+		})
+		defer os.RemoveAll(root)
+		roots = append(roots, root)
+	}
+
+	results := make(chan error, len(compilers))
+	for i, compiler := range compilers {
+		go func(i int, root, compiler string) {
+			c := config.Default()
+			c.Entrypoints = []string{"src/index.js"}
+			c.Sources = []string{"src"}
+			c.Compilers = map[string]string{"js": compiler}
+			r, err := Build(context.Background(), Options{Root: root, Config: c})
+			if err == nil && len(r.Chunks[0].Files) != 2 {
+				err = fmt.Errorf("build %d: unexpected chunk %+v", i, r.Chunks[0])
+			}
+			results <- err
+		}(i, roots[i], compiler)
+	}
+	for range compilers {
+		if err := <-results; err != nil {
+			t.Fatalf("failed: %v", err)
+		}
+	}
+}
+
+func TestProductionChunks(t *testing.T) {
+	for _, chunks := range []string{"entry", "shared"} {
+		root := project(t, map[string]string{
+			"src/a.js":      "import { s } from './shared';\nwindow.a = s;\nimport('./lazy');\n",
+			"src/b.js":      "import { s } from './shared';\nwindow.b = s;\n",
+			"src/shared.js": "export const s = 's';\nexport const unused = 'unused';\n",
+			"src/lazy.js":   "import { s } from './shared';\nimport { l } from './util';\nwindow.lazy = s + l;\n",
+			"src/util.js":   "export const l = 'l';\nexport const other = 'other';\n",
+			"index.html":    "<html><head></head><body></body></html>",
+		})
+		defer os.RemoveAll(root)
+
+		c := config.Default()
+		c.Entrypoints = []string{"src/a.js", "src/b.js"}
+		c.Compilers = map[string]string{"js": "cp $1 $2"}
+		c.HTML = "index.html"
+		c.Mode = config.Production
+		c.Chunks = chunks
+		c.Sources = []string{"src"}
+
+		r, err := Build(context.Background(), Options{Root: root, Config: c})
+		if err != nil {
+			t.Fatalf("%s: failed: %v", chunks, err)
+		}
+		if r.Eliminated == 0 {
+			t.Fatalf("%s: nothing shaken", chunks)
+		}
+		page, _ := ioutil.ReadFile(filepath.Join(root, "dst", "index.html"))
+		for _, chunk := range r.Chunks {
+			if chunk.Dynamic == "" && !strings.Contains(string(page), chunk.Output) {
+				t.Fatalf("%s: %s not loaded by the page:\n%s", chunks, chunk.Output, page)
+			}
+		}
+	}
+}
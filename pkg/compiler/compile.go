@@ -1,6 +1,8 @@
 package compiler
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -9,15 +11,17 @@ import (
 	"sync"
 	"time"
 
+	"github.com/coldog/jsbld/pkg/graph"
 	"github.com/coldog/jsbld/pkg/resolve"
-	"github.com/coldog/jsbld/pkg/util"
 )
 
 var (
-	BabelCompiler   = "babel $1 --compact=true --config-file=./.babelrc --out-file=$2"
+	BabelCompiler   = "babel $1 --compact=true --source-maps --config-file=./.babelrc --out-file=$2"
 	DefaultCompiler = "cp $1 $2"
 )
 
+const DefaultConcurrency = 10
+
 var Compilers = map[string]string{
 	"js":  BabelCompiler,
 	"jsx": BabelCompiler,
@@ -26,20 +30,109 @@ var Compilers = map[string]string{
 	"*":   DefaultCompiler,
 }
 
-func getCompiler(name, srcFile, dstFile string) []string {
+// Compiler compiles the files of a project root into an output directory.
+// Zero values default to the package level settings.
+type Compiler struct {
+	// Root is the project root. Compilers run from the root.
+	Root string
+	// Dst is the output directory, relative to the root.
+	Dst string
+
+	Compilers map[string]string
+	// Workers maps extensions, or "*", to the commands of persistent
+	// compilers, taking precedence over Compilers. Up to Concurrency workers
+	// are started per command and kept running until Close.
+	Workers     map[string]string
+	Extensions  []string
+	Concurrency int
+
+	// Mode is exported to compilers as NODE_ENV when set.
+	Mode string
+
+	lock  sync.Mutex
+	pools map[string]*workerPool
+}
+
+func (c *Compiler) getCompiler(name, srcFile, dstFile string) []string {
+	compilers := c.Compilers
+	if compilers == nil {
+		compilers = Compilers
+	}
 	spl := strings.Split(name, ".")
 	ext := spl[len(spl)-1]
-	c := Compilers[ext]
-	if c == "" {
-		c = Compilers["*"]
+	cmd := compilers[ext]
+	if cmd == "" {
+		cmd = compilers["*"]
 	}
-	c = strings.Replace(c, "$1", srcFile, 1)
-	c = strings.Replace(c, "$2", dstFile, 1)
-	return strings.Fields(c)
+	cmd = strings.Replace(cmd, "$1", srcFile, 1)
+	cmd = strings.Replace(cmd, "$2", dstFile, 1)
+	return strings.Fields(cmd)
 }
 
-func isJS(name string) bool {
-	for _, ext := range resolve.Extensions {
+// getWorker returns the pool of workers compiling the file, or nil if no
+// worker is configured for its extension.
+func (c *Compiler) getWorker(name, root string) *workerPool {
+	spl := strings.Split(name, ".")
+	ext := spl[len(spl)-1]
+	cmd := c.Workers[ext]
+	if cmd == "" {
+		cmd = c.Workers["*"]
+	}
+	if strings.TrimSpace(cmd) == "" {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if p, ok := c.pools[cmd]; ok {
+		return p
+	}
+	concurrency := c.Concurrency
+	if concurrency == 0 {
+		concurrency = DefaultConcurrency
+	}
+	if c.pools == nil {
+		c.pools = map[string]*workerPool{}
+	}
+	p := newWorkerPool(strings.Fields(cmd), root, c.env(), concurrency)
+	c.pools[cmd] = p
+	return p
+}
+
+// env returns the environment of compilers, or nil to inherit it.
+func (c *Compiler) env() []string {
+	if c.Mode == "" {
+		return nil
+	}
+	return append(os.Environ(), "NODE_ENV="+c.Mode)
+}
+
+// Close stops the workers started by the compiler. It may compile again
+// afterwards, starting new workers.
+func (c *Compiler) Close() error {
+	c.lock.Lock()
+	pools := c.pools
+	c.pools = nil
+	c.lock.Unlock()
+
+	var first error
+	for _, p := range pools {
+		if err := p.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (c *Compiler) extensions() []string {
+	if c.Extensions == nil {
+		return resolve.Extensions
+	}
+	return c.Extensions
+}
+
+func (c *Compiler) isJS(name string) bool {
+	for _, ext := range c.extensions() {
 		if strings.HasSuffix(name, ext) {
 			return true
 		}
@@ -47,11 +140,11 @@ func isJS(name string) bool {
 	return false
 }
 
-// compileFile is very simple in that it takes a file and writes a compiled
-// file.
-func compileFile(src, dst, file string) error {
-	srcFile := filepath.Join(src, file)
-	dstFile := filepath.Join(dst, src, file)
+// compileFile is very simple in that it takes a file, relative to the root,
+// and writes a compiled file. Cancelling the context kills the compiler.
+func (c *Compiler) compileFile(ctx context.Context, root, file string) error {
+	srcFile := filepath.Join(root, file)
+	dstFile := filepath.Join(root, c.Dst, file)
 	os.MkdirAll(filepath.Dir(dstFile), 0777)
 
 	object := Object{Filename: dstFile}
@@ -61,27 +154,37 @@ func compileFile(src, dst, file string) error {
 		if err != nil {
 			return err
 		}
-		if prev.Hash == h {
+		if prev.Hash == h && len(prev.Unresolved) == 0 {
 			return nil
 		}
 		object.Hash = h
 	}
 
-	compiler := getCompiler(file, srcFile, dstFile)
-	cmd := exec.Command(compiler[0], compiler[1:]...)
+	// Compilers may write a source map next to the output, remove any stale
+	// map of a previous compiler.
+	os.Remove(dstFile + ".map")
 
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		return err
+	if p := c.getWorker(file, root); p != nil {
+		if err := p.compile(ctx, srcFile, dstFile); err != nil {
+			return err
+		}
+	} else {
+		compiler := c.getCompiler(file, srcFile, dstFile)
+		cmd := exec.CommandContext(ctx, compiler[0], compiler[1:]...)
+
+		cmd.Dir = root
+		cmd.Stderr = os.Stderr
+		cmd.Env = c.env()
+		if err := cmd.Run(); err != nil {
+			return err
+		}
 	}
 
-	if isJS(file) {
-		imps, err := compileImports(srcFile, dstFile)
-		if err != nil {
+	if c.isJS(file) {
+		r := &resolve.Resolver{Root: root, Extensions: c.extensions()}
+		if err := compileImports(r, file, dstFile, &object); err != nil {
 			return err
 		}
-		object.Imports = imps
 	}
 
 	return WriteObjectFile(object)
@@ -98,74 +201,220 @@ func (e *errList) push(err error) {
 	e.lock.Unlock()
 }
 
-func (e *errList) first() error {
+// err returns nil, the single error pushed or a summary of all errors.
+func (e *errList) err() error {
 	e.lock.Lock()
 	defer e.lock.Unlock()
 
-	if len(e.errs) == 0 {
+	switch len(e.errs) {
+	case 0:
 		return nil
+	case 1:
+		return e.errs[0]
+	}
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
 	}
-	return e.errs[0]
+	return fmt.Errorf("%d errors:\n%s", len(e.errs), strings.Join(msgs, "\n"))
 }
 
+// Compile compiles every file under the srcs directories of root into dst
+// using the default settings.
 func Compile(root, dst string, srcs []string) error {
-	popd := util.Pushd(root)
-	defer popd()
-
-	concurrency := 10
-	os.MkdirAll(dst, 0700)
-
-	wg := sync.WaitGroup{}
-	errs := &errList{}
-	paths := make(chan struct {
-		path string
-		src  string
-	}, concurrency)
-
-	wg.Add(concurrency)
+	return (&Compiler{Root: root, Dst: dst}).Compile(context.Background(), srcs)
+}
 
-	for i := 0; i < concurrency; i++ {
-		go func(i int) {
-			defer wg.Done()
+// CompileFiles compiles only the given files, relative to root, into dst using
+// the default settings.
+func CompileFiles(root, dst string, files []string) error {
+	return (&Compiler{Root: root, Dst: dst}).CompileFiles(context.Background(), files)
+}
 
-			for path := range paths {
-				t1 := time.Now()
-				err := compileFile(path.src, dst, path.path)
+// Compile compiles every file under the srcs directories of the root.
+func (c *Compiler) Compile(ctx context.Context, srcs []string) error {
+	return c.compile(ctx, func(root string) ([]string, error) {
+		paths := []string{}
+		for _, src := range srcs {
+			err := filepath.Walk(filepath.Join(root, src), func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+				rel, err := filepath.Rel(root, path)
 				if err != nil {
-					errs.push(err)
+					return err
 				}
-				log.Printf("compile(%d): %s -- %v (%v)", i, path, err, time.Since(t1))
+				paths = append(paths, rel)
+				return nil
+			})
+			if err != nil {
+				return paths, err
+			}
+		}
+		return paths, nil
+	})
+}
+
+// CompileFiles compiles only the given files, relative to the root. Files
+// which no longer exist have their compiled output removed.
+func (c *Compiler) CompileFiles(ctx context.Context, files []string) error {
+	return c.compile(ctx, func(root string) ([]string, error) {
+		paths := []string{}
+		for _, file := range files {
+			if c.removeMissing(root, file) {
+				continue
 			}
-		}(i)
+			paths = append(paths, file)
+		}
+		return paths, nil
+	})
+}
+
+// removeMissing removes the compiled output of a file, relative to the root,
+// if it no longer exists and returns whether it did.
+func (c *Compiler) removeMissing(root, file string) bool {
+	if _, err := os.Stat(filepath.Join(root, file)); !os.IsNotExist(err) {
+		return false
+	}
+	dstFile := filepath.Join(root, c.Dst, file)
+	os.Remove(dstFile)
+	os.Remove(dstFile + ".o")
+	os.Remove(dstFile + ".map")
+	return true
+}
+
+// CompileFrom compiles the given files, relative to the root, and every file
+// they import. Files are nodes of a graph, the imports of a file are added
+// once it is compiled and its imports are resolved, so files which are not
+// reachable are never compiled. Imports for which skip, if set, returns true
+// are assumed up to date and neither compiled nor traversed. Files which no
+// longer exist have their compiled output removed.
+func (c *Compiler) CompileFrom(ctx context.Context, files []string, skip func(file string) bool) error {
+	root, err := filepath.Abs(c.Root)
+	if err != nil {
+		return err
+	}
+
+	concurrency := c.Concurrency
+	if concurrency == 0 {
+		concurrency = DefaultConcurrency
+	}
+	os.MkdirAll(filepath.Join(root, c.Dst), 0700)
+
+	// Paths grow as the graph expands while files compile concurrently.
+	lock := sync.Mutex{}
+	paths := []string{}
+	ids := map[string]int{}
+	add := func(path string, nodes map[int][]int) {
+		if _, ok := ids[path]; ok {
+			return
+		}
+		ids[path] = len(paths)
+		nodes[len(paths)] = nil
+		paths = append(paths, path)
+	}
+	path := func(id int) string {
+		lock.Lock()
+		defer lock.Unlock()
+		return paths[id]
 	}
 
-	for _, src := range srcs {
-		err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	errs := &errList{}
+	g := &graph.Graph{
+		Concurrency: concurrency,
+		Nodes:       map[int][]int{},
+		Process: func(ctx context.Context, id int) error {
+			path := path(id)
+			t1 := time.Now()
+			err := c.compileFile(ctx, root, path)
 			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
+				err = fmt.Errorf("%s: %v", path, err)
+				errs.push(err)
 			}
-			rel, err := filepath.Rel(src, path)
+			log.Printf("compile: %s -- %v (%v)", path, err, time.Since(t1))
+			return err
+		},
+		// Runs once a file compiled, on the goroutine scheduling the graph.
+		Expand: func(id int) map[int][]int {
+			path := path(id)
+			o, err := ReadObjectFile(filepath.Join(root, c.Dst, path))
 			if err != nil {
-				return err
+				errs.push(fmt.Errorf("%s: %v", path, err))
+				return nil
 			}
-			paths <- struct {
-				path string
-				src  string
-			}{
-				path: rel,
-				src:  src,
+			lock.Lock()
+			defer lock.Unlock()
+			nodes := map[int][]int{}
+			for _, imp := range append(append([]string{}, o.Imports...), o.DynamicImports...) {
+				if skip == nil || !skip(imp) {
+					add(imp, nodes)
+				}
 			}
-			return nil
-		})
-		if err != nil {
-			errs.push(err)
+			return nodes
+		},
+	}
+	for _, file := range files {
+		file = filepath.Clean(file)
+		if !c.removeMissing(root, file) {
+			add(file, g.Nodes)
 		}
 	}
+	// The error of every file is collected in errs. Cancelling the context
+	// stops the graph and kills the compilers running.
+	g.Solve(ctx)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errs.err()
+}
+
+// compile compiles every path returned by walk as a node of a graph. Paths
+// are relative to the absolute root passed to walk. Files do not depend on
+// each other, so a failure only skips the file itself.
+func (c *Compiler) compile(ctx context.Context, walk func(root string) ([]string, error)) error {
+	root, err := filepath.Abs(c.Root)
+	if err != nil {
+		return err
+	}
+
+	concurrency := c.Concurrency
+	if concurrency == 0 {
+		concurrency = DefaultConcurrency
+	}
+	os.MkdirAll(filepath.Join(root, c.Dst), 0700)
+
+	errs := &errList{}
+	paths, err := walk(root)
+	if err != nil {
+		errs.push(err)
+	}
 
-	close(paths)
-	wg.Wait()
-	return errs.first()
+	g := &graph.Graph{
+		Concurrency: concurrency,
+		Nodes:       map[int][]int{},
+		Process: func(ctx context.Context, id int) error {
+			path := paths[id]
+			t1 := time.Now()
+			err := c.compileFile(ctx, root, path)
+			if err != nil {
+				err = fmt.Errorf("%s: %v", path, err)
+				errs.push(err)
+			}
+			log.Printf("compile: %s -- %v (%v)", path, err, time.Since(t1))
+			return err
+		},
+	}
+	for id := range paths {
+		g.Nodes[id] = nil
+	}
+	// The error of every file is collected in errs. Cancelling the context
+	// stops the graph and kills the compilers running.
+	g.Solve(ctx)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errs.err()
 }
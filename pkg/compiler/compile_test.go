@@ -1,7 +1,19 @@
 package compiler
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/coldog/jsbld/pkg/resolve"
+	"github.com/coldog/jsbld/pkg/sourcemap"
 )
 
 func TestExample(t *testing.T) {
@@ -11,12 +23,329 @@ func TestExample(t *testing.T) {
 	}
 }
 
-// func TestCompileImports(t *testing.T) {
-// 	imps, err := compileImports("../../example/node_modules/react/index.js")
-// 	if err != nil {
-// 		t.Fatalf("failed: %v", err)
-// 	}
-// 	if fmt.Sprintf("%+v", imps) != "[./cjs/react.production.min.js]" {
-// 		t.Fatalf("wrong imports: '%+v'", imps)
-// 	}
-// }
+func TestCompileFrom(t *testing.T) {
+	root, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for name, src := range map[string]string{
+		"src/index.js":                "require('./a'); import('./lazy');",
+		"src/a.js":                    "require('lib'); require('./index');",
+		"src/lazy.js":                 "",
+		"src/unused.js":               "require('other');",
+		"node_modules/lib/index.js":   "",
+		"node_modules/other/index.js": "",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0777)
+		ioutil.WriteFile(filepath.Join(root, name), []byte(src), 0666)
+	}
+
+	c := &Compiler{Root: root, Dst: "dst", Compilers: map[string]string{"*": "cp $1 $2"}}
+	if err := c.CompileFrom(context.Background(), []string{"./src/index.js", "src/missing.js"}, nil); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	compiled := []string{}
+	filepath.Walk(filepath.Join(root, "dst"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, ".o") {
+			rel, _ := filepath.Rel(filepath.Join(root, "dst"), strings.TrimSuffix(path, ".o"))
+			compiled = append(compiled, rel)
+		}
+		return nil
+	})
+	expected := []string{"node_modules/lib/index.js", "src/a.js", "src/index.js", "src/lazy.js"}
+	if !reflect.DeepEqual(compiled, expected) {
+		t.Fatalf("wrong files compiled: %v", compiled)
+	}
+
+	// Skipped imports are not traversed, their imports are left as is.
+	lib, _ := ReadObjectFile(filepath.Join(root, "dst/node_modules/lib/index.js"))
+	ioutil.WriteFile(filepath.Join(root, "src/index.js"), []byte("require('./a'); require('./b');"), 0666)
+	ioutil.WriteFile(filepath.Join(root, "src/b.js"), []byte(""), 0666)
+	ioutil.WriteFile(filepath.Join(root, "node_modules/lib/index.js"), []byte("changed"), 0666)
+	skip := func(file string) bool { return file == "src/a.js" }
+	if err := c.CompileFrom(context.Background(), []string{"src/index.js"}, skip); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if _, err := ReadObjectFile(filepath.Join(root, "dst/src/b.js")); err != nil {
+		t.Fatalf("new import not compiled: %v", err)
+	}
+	if o, _ := ReadObjectFile(filepath.Join(root, "dst/node_modules/lib/index.js")); o.Hash != lib.Hash {
+		t.Fatal("import of a skipped file compiled")
+	}
+}
+
+func TestCompileCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "src"), 0777)
+	for i := 0; i < 4; i++ {
+		ioutil.WriteFile(filepath.Join(root, "src", fmt.Sprintf("%d.js", i)), nil, 0666)
+	}
+
+	// Cancelling the build kills the compilers running and starts no more.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c := &Compiler{Root: root, Dst: "dst", Concurrency: 2, Compilers: map[string]string{"*": "sleep 10"}}
+	t1 := time.Now()
+	if err := c.Compile(ctx, []string{"src"}); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d := time.Since(t1); d > 5*time.Second {
+		t.Fatalf("compilers not killed after %v", d)
+	}
+}
+
+func TestFindRequires(t *testing.T) {
+	for _, test := range []struct {
+		src   string
+		names []string
+	}{
+		{`require('a')`, []string{"a"}},
+		{`var b = require ( "b" );`, []string{"b"}},
+		{"require(\n  'c'\n)", []string{"c"}},
+		{"require(`d`)", []string{"d"}},
+		{"require(`d${x}`)", nil},
+		{"// require('e')\nrequire('f')", []string{"f"}},
+		{"/* require('e') */ require('f')", []string{"f"}},
+		{`var s = "require('e')"; require('f')`, []string{"f"}},
+		{`var s = "\"require('e')\""; require('f')`, []string{"f"}},
+		{`var s = 'it\'s require("e")'; require('f')`, []string{"f"}},
+		{"var s = `require('e')`; require('f')", []string{"f"}},
+		{`myrequire('e'); require2('e'); obj.require('e'); require('f')`, []string{"f"}},
+		{`function require(name) {} require('f')`, []string{"f"}},
+		{`require('e', 1); require(name)`, nil},
+		{`var re = /require('e')/; require('f')`, []string{"f"}},
+		{`var re = /[/]require('e')/g; require('f')`, []string{"f"}},
+		{`return /require("e")/.test(s) || require('f')`, []string{"f"}},
+		{`var x = a / require('f') / 2`, []string{"f"}},
+		{`var x = (a) / require('f') / 2`, []string{"f"}},
+		{`x = a++ / require('f') / 2`, []string{"f"}},
+		{`x = 1e+5 / require('f')`, []string{"f"}},
+		{"`${require('f')}`", []string{"f"}},
+		{"`a ${ {x: require('f')}.x } /* \\${require('e')} */ b` + require('g')", []string{"f", "g"}},
+		{"`${`${require('f')}`}` // require('e')", []string{"f"}},
+		{"`a ${b} c` / require('f')", []string{"f"}},
+		{"if (a) require('f')", []string{"f"}},
+		{"if (a) /require('e')/.test(s); require('f')", []string{"f"}},
+		{"while (x) /require('e')/.exec(s); require('f')", []string{"f"}},
+		{"for (;;) /require('e')/g; if (f(a)) /e/; require('f')", []string{"f"}},
+		{"if (a) (b) / require('f')", []string{"f"}},
+		{"var s = 'unterminated\nrequire('f')", []string{"f"}},
+		{"/* unterminated require('e')", nil},
+		{"import('a').then(f); import.meta; x.import('e')", []string{"a"}},
+	} {
+		names := []string{}
+		for _, call := range findRequires([]byte(test.src)) {
+			names = append(names, call.name)
+		}
+		if test.names == nil {
+			test.names = []string{}
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%s: got %v, expected %v", test.src, names, test.names)
+		}
+	}
+}
+
+func TestCompileImports(t *testing.T) {
+	root, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "src"), 0777)
+	os.MkdirAll(filepath.Join(root, "node_modules", "react"), 0777)
+	ioutil.WriteFile(filepath.Join(root, "src", "add.js"), nil, 0666)
+	ioutil.WriteFile(filepath.Join(root, "node_modules", "react", "index.js"), nil, 0666)
+
+	dst := filepath.Join(root, "out.js")
+	src := "var r = require(\"react\");\n// require('./add')\nvar add = require('./add');\nrequire('./missing');\nimport('./add').then(f);\n"
+	ioutil.WriteFile(dst, []byte(src), 0666)
+
+	o := &Object{}
+	err = compileImports(&resolve.Resolver{Root: root}, "src/index.js", dst, o)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	imps, warnings := o.Imports, o.Warnings
+	if !reflect.DeepEqual(imps, []string{"node_modules/react/index.js", "src/add.js"}) {
+		t.Fatalf("wrong imports: '%+v'", imps)
+	}
+	if !reflect.DeepEqual(o.DynamicImports, []string{"src/add.js"}) {
+		t.Fatalf("wrong dynamic imports: '%+v'", o.DynamicImports)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected a warning for the missing file: %v", warnings)
+	}
+	data, _ := ioutil.ReadFile(dst)
+	expected := "var r = require(\"node_modules/react/index.js\");\n// require('./add')\nvar add = require('src/add.js');\nrequire('./missing');\nrequire.dynamic('src/add.js').then(f);\n"
+	if string(data) != expected {
+		t.Fatalf("wrong output:\n%s", data)
+	}
+}
+
+func TestTransformModule(t *testing.T) {
+	if out, m, _ := transformModule([]byte(`var a = require('a'); import('./lazy'); import.meta;`)); out != nil || m != nil {
+		t.Fatalf("commonjs module transformed: %s", out)
+	}
+
+	src := `import def, { a as b, c } from './x';
+import * as ns from "./y";
+import './side';
+export { c, b as d };
+export * from './z';
+export { e as f, default } from './w';
+export const g = 1, { h, i: [j] } = o, k = [1, 2]
+export function l() { return def + b + ns.m + {c}.c + c(o.b) }
+export default class extends Base {}
+`
+	out, m, _ := transformModule([]byte(src))
+	expected := &Module{
+		Imports: []Binding{
+			{Name: "default", Local: "def", Source: "./x"},
+			{Name: "a", Local: "b", Source: "./x"},
+			{Name: "c", Local: "c", Source: "./x"},
+			{Name: "*", Local: "ns", Source: "./y"},
+			{Source: "./side"},
+		},
+		Exports: []Binding{
+			{Name: "c", Local: "c"},
+			{Name: "d", Local: "b"},
+			{Name: "f", Local: "e", Source: "./w"},
+			{Name: "default", Local: "default", Source: "./w"},
+			{Name: "g", Local: "g"},
+			{Name: "h", Local: "h"},
+			{Name: "j", Local: "j"},
+			{Name: "k", Local: "k"},
+			{Name: "l", Local: "l"},
+			{Name: "default", Local: defaultLocal},
+		},
+		StarExports: []string{"./z"},
+		Uses: []Binding{
+			{Name: "default", Source: "./x"},
+			{Name: "a", Source: "./x"},
+			{Name: "m", Source: "./y"},
+			{Name: "c", Source: "./x"},
+		},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("got module:\n%+v\nexpected:\n%+v", m, expected)
+	}
+
+	lines := strings.Split(string(out), "\n")
+	if len(lines) != strings.Count(src, "\n")+1 {
+		t.Fatalf("line numbers not kept:\n%s", out)
+	}
+	for i, line := range map[int]string{
+		6: "const g = 1, { h, i: [j] } = o, k = [1, 2]",
+		7: "function l() { return __jsbld0.default + __jsbld0.a + __jsbld1.m + {c: __jsbld0.c}.c + __jsbld0.c(o.b) }",
+		8: "var __jsbld_default = class extends Base {}",
+	} {
+		if lines[i] != line {
+			t.Fatalf("line %d: got %q, expected %q", i+1, lines[i], line)
+		}
+	}
+	header := `require.esm(exports, {"c": function() { return __jsbld0.c; }, "d": function() { return __jsbld0.a; }, ` +
+		`"f": function() { return __jsbld4.e; }, "default": function() { return __jsbld_default; }, ` +
+		`"g": function() { return g; }, "h": function() { return h; }, "j": function() { return j; }, ` +
+		`"k": function() { return k; }, "l": function() { return l; }});` +
+		`var __jsbld0 = require.interop(require("./x"));var __jsbld1 = require.interop(require("./y"));` +
+		`var __jsbld2 = require("./side");var __jsbld3 = require("./z");var __jsbld4 = require.interop(require("./w"));` +
+		`require.star(exports, __jsbld3);`
+	if !strings.HasPrefix(lines[0], header) {
+		t.Fatalf("unexpected header:\n%s\nexpected:\n%s", lines[0], header)
+	}
+}
+
+func TestTransformModuleShadowing(t *testing.T) {
+	src := `import { value, list, item } from './a';
+export function show(value) { return value + list; }
+function local() { if (y) { var value = 1; } let list = [value]; return list; }
+const pick = ({ value, list: [item] }) => value + item, named = function item() { return item; };
+try {} catch (value) { value; }
+if (x) { function value() {} value(); }
+export const total = value + list.length + item;
+`
+	out, m, _ := transformModule([]byte(src))
+	lines := strings.Split(string(out), "\n")
+	for i, line := range map[int]string{
+		1: "function show(value) { return value + __jsbld0.list; }",
+		2: "function local() { if (y) { var value = 1; } let list = [value]; return list; }",
+		3: "const pick = ({ value, list: [item] }) => value + item, named = function item() { return item; };",
+		4: "try {} catch (value) { value; }",
+		5: "if (x) { function value() {} value(); }",
+		6: "const total = __jsbld0.value + __jsbld0.list.length + __jsbld0.item;",
+	} {
+		if lines[i] != line {
+			t.Fatalf("line %d: got %q, expected %q", i+1, lines[i], line)
+		}
+	}
+	uses := []Binding{{Name: "list", Source: "./a"}, {Name: "value", Source: "./a"}, {Name: "item", Source: "./a"}}
+	if !reflect.DeepEqual(m.Uses, uses) {
+		t.Fatalf("wrong uses: %+v", m.Uses)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	root, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "src"), 0777)
+	os.MkdirAll(filepath.Join(root, "dst", "src"), 0777)
+	ioutil.WriteFile(filepath.Join(root, "src", "add.js"), nil, 0666)
+
+	// The compiled source maps each identifier to the same position of the
+	// original. The ES module header is inserted on the first line and the
+	// require path rewritten.
+	src := "import x from './add';\nvar a = require('./add'), b = x;\n//# sourceMappingURL=index.js.map\n"
+	dst := filepath.Join(root, "dst", "src", "index.js")
+	ioutil.WriteFile(dst, []byte(src), 0666)
+	m := &sourcemap.Map{Version: 3, Sources: []string{"index.js"}}
+	m.Encode([][]sourcemap.Segment{
+		{{Column: 7, Source: 0, SourceLine: 0, SourceColumn: 7, Name: -1}},
+		{
+			{Column: 4, Source: 0, SourceLine: 1, SourceColumn: 4, Name: -1},
+			{Column: 16, Source: 0, SourceLine: 1, SourceColumn: 16, Name: -1},
+			{Column: 26, Source: 0, SourceLine: 1, SourceColumn: 26, Name: -1},
+			{Column: 30, Source: 0, SourceLine: 1, SourceColumn: 30, Name: -1},
+		},
+	})
+	data, _ := json.Marshal(m)
+	ioutil.WriteFile(dst+".map", data, 0666)
+
+	err = compileImports(&resolve.Resolver{Root: root}, "src/index.js", dst, &Object{})
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	out, _ := ioutil.ReadFile(dst)
+	if strings.Contains(string(out), "sourceMappingURL") {
+		t.Fatalf("sourceMappingURL not stripped:\n%s", out)
+	}
+	m, err = sourcemap.ReadFile(dst + ".map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Sources, []string{"../../src/index.js"}) {
+		t.Fatalf("wrong sources: %v", m.Sources)
+	}
+	lines, _ := m.Decode()
+	if len(lines) != 2 || len(lines[1]) != 4 {
+		t.Fatalf("wrong mappings: %v", lines)
+	}
+	second := strings.Split(string(out), "\n")[1]
+	for i, prefix := range []string{"a = ", "'src/add.js'", "b = ", "__jsbld0.default;"} {
+		if seg := lines[1][i]; !strings.HasPrefix(second[seg.Column:], prefix) {
+			t.Fatalf("segment %+v maps to %q, expected %q", seg, second[seg.Column:], prefix)
+		}
+	}
+	// The removed import maps to the end of the header replacing it.
+	if first := strings.Split(string(out), "\n")[0]; lines[0][0].Column != len(first) {
+		t.Fatalf("wrong first line mappings: %v", lines[0])
+	}
+}
@@ -0,0 +1,561 @@
+package compiler
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/coldog/jsbld/pkg/js"
+)
+
+// Binding is an imported or exported name of an ES module.
+type Binding struct {
+	// Name is the imported or exported name. It is "default" for default
+	// bindings, "*" for namespaces and empty for side effect imports.
+	Name string `json:",omitempty"`
+	// Local is the local name of the binding. For re-exports it is the name
+	// imported from the source, "*" for a namespace.
+	Local string `json:",omitempty"`
+	// Source is the resolved module imported or re-exported from.
+	Source string `json:",omitempty"`
+}
+
+// Module records the import and export declarations of an ES module.
+type Module struct {
+	Imports     []Binding `json:",omitempty"`
+	Exports     []Binding `json:",omitempty"`
+	StarExports []string  `json:",omitempty"`
+	// Uses are the imported names referenced by the module, "*" for
+	// namespaces used as values and modules loaded with require().
+	Uses []Binding `json:",omitempty"`
+}
+
+const defaultLocal = "__jsbld_default"
+
+// statementKeywords start a new statement, used to find the end of a
+// declaration without semicolons.
+var statementKeywords = map[string]bool{
+	"import": true, "export": true, "var": true, "let": true, "const": true,
+	"function": true, "class": true, "if": true, "for": true, "while": true,
+	"do": true, "return": true, "switch": true, "try": true, "throw": true,
+}
+
+// esmTransform rewrites an ES module into the module format of the runtime:
+//
+//	import a, {b as c} from './x'; export const d = c;
+//
+// becomes, keeping line numbers intact:
+//
+//	require.esm(exports, {"d": function() { return d; }});var __jsbld0 = require.interop(require("./x"));
+//	const d = __jsbld0.b;
+//
+// References to imported bindings are rewritten to member accesses so they
+// stay live. Parameters and declarations of functions and blocks shadowing an
+// imported name keep their references.
+type esmTransform struct {
+	src    []byte
+	tokens []js.Token
+	edits  []js.Edit
+	module *Module
+
+	specs   []string
+	vars    map[string]int
+	interop map[int]bool
+	locals  map[string]string
+	getters map[string]string
+	order   []string
+	stars   []int
+}
+
+// transformModule returns the source with import and export declarations
+// rewritten and the edits applied, or nil if the source is not an ES module.
+func transformModule(src []byte) ([]byte, *Module, []js.Edit) {
+	t := &esmTransform{
+		src:     src,
+		tokens:  js.Lex(src),
+		module:  &Module{},
+		vars:    map[string]int{},
+		interop: map[int]bool{},
+		locals:  map[string]string{},
+		getters: map[string]string{},
+	}
+
+	found := false
+	depth := 0
+	for i := 0; i < len(t.tokens); i++ {
+		tok := t.tokens[i]
+		switch t.text(i) {
+		case "{", "(", "[":
+			depth++
+			continue
+		case "}", ")", "]":
+			depth--
+			continue
+		}
+		if depth != 0 || tok.Kind != js.Ident || t.text(i-1) == "." {
+			continue
+		}
+		switch t.text(i) {
+		case "import":
+			if next := t.text(i + 1); next == "(" || next == "." {
+				continue
+			}
+			found = true
+			i = t.parseImport(i) - 1
+		case "export":
+			found = true
+			i = t.parseExport(i) - 1
+		}
+	}
+	if !found {
+		return nil, nil, nil
+	}
+
+	t.rewriteReferences()
+	for _, call := range findRequires(src) {
+		if !call.dynamic {
+			t.use("*", call.name)
+		}
+	}
+	out, edits := t.output()
+	return out, t.module, edits
+}
+
+func (t *esmTransform) text(i int) string {
+	if i < 0 || i >= len(t.tokens) {
+		return ""
+	}
+	tok := t.tokens[i]
+	return string(t.src[tok.Start:tok.End])
+}
+
+// kind returns the kind of the token at i, punctuation past the end.
+func (t *esmTransform) kind(i int) js.Kind {
+	if i < 0 || i >= len(t.tokens) {
+		return js.Punct
+	}
+	return t.tokens[i].Kind
+}
+
+// name returns the identifier or string literal at i.
+func (t *esmTransform) name(i int) string {
+	if t.kind(i) == js.String {
+		s := t.text(i)
+		return s[1 : len(s)-1]
+	}
+	return t.text(i)
+}
+
+// remove replaces the source between the tokens, keeping its newlines.
+func (t *esmTransform) remove(from, to int) {
+	start := t.tokens[from].Start
+	end := len(t.src)
+	if to < len(t.tokens) {
+		end = t.tokens[to].Start
+	}
+	t.replace(start, end, "")
+}
+
+func (t *esmTransform) replace(start, end int, text string) {
+	text += strings.Repeat("\n", bytes.Count(t.src[start:end], []byte("\n")))
+	t.edits = append(t.edits, js.Edit{Start: start, End: end, Text: text})
+}
+
+// end returns the token after an optional semicolon at i.
+func (t *esmTransform) end(i int) int {
+	if t.text(i) == ";" {
+		return i + 1
+	}
+	return i
+}
+
+// spec returns the variable index of a module specifier.
+func (t *esmTransform) spec(name string) int {
+	if idx, ok := t.vars[name]; ok {
+		return idx
+	}
+	t.vars[name] = len(t.specs)
+	t.specs = append(t.specs, name)
+	return len(t.specs) - 1
+}
+
+func (t *esmTransform) export(name, expr string) {
+	if _, ok := t.getters[name]; !ok {
+		t.order = append(t.order, name)
+	}
+	t.getters[name] = expr
+}
+
+func specVar(idx int) string {
+	return "__jsbld" + strconv.Itoa(idx)
+}
+
+func (t *esmTransform) parseImport(i int) int {
+	j := i + 1
+	if t.kind(j) == js.String {
+		spec := t.name(j)
+		t.spec(spec)
+		t.module.Imports = append(t.module.Imports, Binding{Source: spec})
+		j = t.end(j + 1)
+		t.remove(i, j)
+		return j
+	}
+
+	type imported struct{ name, local string }
+	names := []imported{}
+	if t.kind(j) == js.Ident && !(t.text(j) == "from" && t.kind(j+1) == js.String) {
+		names = append(names, imported{"default", t.text(j)})
+		j++
+		if t.text(j) == "," {
+			j++
+		}
+	}
+	if t.text(j) == "*" && t.text(j+1) == "as" {
+		names = append(names, imported{"*", t.text(j + 2)})
+		j += 3
+	}
+	if t.text(j) == "{" {
+		j++
+		for j < len(t.tokens) && t.text(j) != "}" {
+			name, local := t.name(j), t.text(j)
+			j++
+			if t.text(j) == "as" {
+				local = t.text(j + 1)
+				j += 2
+			}
+			names = append(names, imported{name, local})
+			if t.text(j) == "," {
+				j++
+			}
+		}
+		j++
+	}
+	if t.text(j) != "from" || t.kind(j+1) != js.String {
+		// Not an import declaration we understand, leave it untouched.
+		return i + 1
+	}
+	spec := t.name(j + 1)
+	j = t.end(j + 2)
+
+	idx := t.spec(spec)
+	v := specVar(idx)
+	for _, n := range names {
+		t.module.Imports = append(t.module.Imports, Binding{Name: n.name, Local: n.local, Source: spec})
+		switch n.name {
+		case "*":
+			t.interop[idx] = true
+			t.locals[n.local] = v
+		case "default":
+			t.interop[idx] = true
+			t.locals[n.local] = v + ".default"
+		default:
+			t.locals[n.local] = v + "." + n.name
+		}
+	}
+	t.remove(i, j)
+	return j
+}
+
+func (t *esmTransform) parseExport(i int) int {
+	j := i + 1
+	switch t.text(j) {
+	case "*":
+		if t.text(j+1) == "as" {
+			ns := t.name(j + 2)
+			spec := t.name(j + 4)
+			idx := t.spec(spec)
+			t.module.Exports = append(t.module.Exports, Binding{Name: ns, Local: "*", Source: spec})
+			t.export(ns, specVar(idx))
+			j = t.end(j + 5)
+		} else {
+			spec := t.name(j + 2)
+			idx := t.spec(spec)
+			t.module.StarExports = append(t.module.StarExports, spec)
+			t.stars = append(t.stars, idx)
+			j = t.end(j + 3)
+		}
+		t.remove(i, j)
+		return j
+
+	case "{":
+		type exported struct{ local, name string }
+		names := []exported{}
+		j++
+		for j < len(t.tokens) && t.text(j) != "}" {
+			local, name := t.name(j), t.name(j)
+			j++
+			if t.text(j) == "as" {
+				name = t.name(j + 1)
+				j += 2
+			}
+			names = append(names, exported{local, name})
+			if t.text(j) == "," {
+				j++
+			}
+		}
+		j++
+		if t.text(j) == "from" {
+			spec := t.name(j + 1)
+			idx := t.spec(spec)
+			for _, n := range names {
+				t.module.Exports = append(t.module.Exports, Binding{Name: n.name, Local: n.local, Source: spec})
+				if n.local == "default" {
+					t.interop[idx] = true
+				}
+				t.export(n.name, specVar(idx)+"."+n.local)
+			}
+			j += 2
+		} else {
+			for _, n := range names {
+				t.module.Exports = append(t.module.Exports, Binding{Name: n.name, Local: n.local})
+				t.export(n.name, n.local)
+			}
+		}
+		j = t.end(j)
+		t.remove(i, j)
+		return j
+
+	case "default":
+		k := j + 1
+		if t.text(k) == "async" && t.text(k+1) == "function" {
+			k++
+		}
+		if kw := t.text(k); kw == "function" || kw == "class" {
+			n := k + 1
+			if t.text(n) == "*" {
+				n++
+			}
+			if t.kind(n) == js.Ident && t.text(n) != "extends" {
+				name := t.text(n)
+				t.module.Exports = append(t.module.Exports, Binding{Name: "default", Local: name})
+				t.export("default", name)
+				t.remove(i, j+1)
+				return n
+			}
+		}
+		t.module.Exports = append(t.module.Exports, Binding{Name: "default", Local: defaultLocal})
+		t.export("default", defaultLocal)
+		t.replace(t.tokens[i].Start, t.tokens[j+1].Start, "var "+defaultLocal+" = ")
+		return j + 1
+
+	case "var", "let", "const":
+		names := t.declNames(j + 1)
+		for _, name := range names {
+			t.module.Exports = append(t.module.Exports, Binding{Name: name, Local: name})
+			t.export(name, name)
+		}
+		t.remove(i, j)
+		return j
+
+	case "async", "function", "class":
+		n := j + 1
+		if t.text(j) == "async" {
+			n++
+		}
+		if t.text(n) == "*" {
+			n++
+		}
+		name := t.text(n)
+		t.module.Exports = append(t.module.Exports, Binding{Name: name, Local: name})
+		t.export(name, name)
+		t.remove(i, j)
+		return j
+	}
+	return j
+}
+
+// declNames returns the names bound by the declarators starting at i.
+func (t *esmTransform) declNames(i int) []string {
+	names := []string{}
+	j := i
+	for j < len(t.tokens) {
+		j = t.pattern(j, &names)
+		depth := 0
+	initializer:
+		for ; j < len(t.tokens); j++ {
+			switch s := t.text(j); {
+			case depth == 0 && s == ",":
+				j++
+				break initializer
+			case depth == 0 && s == ";":
+				return names
+			case depth == 0 && statementKeywords[s] && t.newlineBefore(j):
+				return names
+			case s == "{" || s == "(" || s == "[":
+				depth++
+			case s == "}" || s == ")" || s == "]":
+				depth--
+				if depth < 0 {
+					return names
+				}
+			}
+		}
+	}
+	return names
+}
+
+func (t *esmTransform) newlineBefore(i int) bool {
+	return i > 0 && bytes.IndexByte(t.src[t.tokens[i-1].End:t.tokens[i].Start], '\n') >= 0
+}
+
+// pattern collects the names bound by an identifier or destructuring pattern.
+func (t *esmTransform) pattern(j int, names *[]string) int {
+	switch t.text(j) {
+	case "{", "[":
+		closing := "}"
+		if t.text(j) == "[" {
+			closing = "]"
+		}
+		j++
+		for j < len(t.tokens) && t.text(j) != closing {
+			switch {
+			case t.text(j) == "," || t.text(j) == "...":
+				j++
+			case closing == "}" && t.text(j+1) == ":":
+				j = t.pattern(j+2, names)
+			default:
+				j = t.pattern(j, names)
+			}
+			if t.text(j) == "=" {
+				j = t.skipDefault(j + 1)
+			}
+		}
+		return j + 1
+	}
+	if t.kind(j) == js.Ident {
+		*names = append(*names, t.text(j))
+	}
+	return j + 1
+}
+
+// skipDefault skips a default value in a destructuring pattern.
+func (t *esmTransform) skipDefault(j int) int {
+	depth := 0
+	for ; j < len(t.tokens); j++ {
+		switch t.text(j) {
+		case "{", "(", "[":
+			depth++
+		case "}", ")", "]":
+			if depth == 0 {
+				return j
+			}
+			depth--
+		case ",":
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return j
+}
+
+// rewriteReferences replaces references to imported bindings with member
+// accesses on the imported module.
+func (t *esmTransform) rewriteReferences() {
+	refs := js.TopLevelRefs(t.src, t.tokens)
+	removed := func(pos int) bool {
+		for _, e := range t.edits {
+			if pos >= e.Start && pos < e.End {
+				return true
+			}
+		}
+		return false
+	}
+	// brackets is the stack of open brackets, used to tell shorthand object
+	// properties apart from other comma separated lists.
+	brackets := []byte{}
+	for i, tok := range t.tokens {
+		switch text := t.text(i); {
+		case tok.Kind == js.TemplatePart:
+			if text[0] == '}' && len(brackets) > 0 {
+				brackets = brackets[:len(brackets)-1]
+			}
+			if text[len(text)-1] == '{' {
+				brackets = append(brackets, '$')
+			}
+			continue
+		case text == "{" || text == "(" || text == "[":
+			brackets = append(brackets, text[0])
+			continue
+		case text == "}" || text == ")" || text == "]":
+			if len(brackets) > 0 {
+				brackets = brackets[:len(brackets)-1]
+			}
+			continue
+		case tok.Kind != js.Ident:
+			continue
+		}
+
+		expr, ok := t.locals[t.text(i)]
+		if !ok || !refs[i] || removed(tok.Start) {
+			continue
+		}
+		for _, b := range t.module.Imports {
+			if b.Local != t.text(i) {
+				continue
+			}
+			if b.Name == "*" && t.text(i+1) == "." && t.kind(i+2) == js.Ident {
+				t.use(t.text(i+2), b.Source)
+			} else {
+				t.use(b.Name, b.Source)
+			}
+		}
+		prev, next := t.text(i-1), t.text(i+1)
+		if (prev == "{" || prev == ",") && len(brackets) > 0 && brackets[len(brackets)-1] == '{' {
+			if next == ":" {
+				continue // object key
+			}
+			if next == "}" || next == "," {
+				expr = t.text(i) + ": " + expr // shorthand property
+			}
+		}
+		t.edits = append(t.edits, js.Edit{Start: tok.Start, End: tok.End, Text: expr})
+	}
+}
+
+// use records a referenced import.
+func (t *esmTransform) use(name, source string) {
+	b := Binding{Name: name, Source: source}
+	for _, u := range t.module.Uses {
+		if u == b {
+			return
+		}
+	}
+	t.module.Uses = append(t.module.Uses, b)
+}
+
+// header returns the export getters and requires hoisted to the top of the
+// module, kept on a single line.
+func (t *esmTransform) header() string {
+	var b strings.Builder
+	if len(t.order) > 0 {
+		b.WriteString("require.esm(exports, {")
+		for i, name := range t.order {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			expr := t.getters[name]
+			if local, ok := t.locals[expr]; ok {
+				expr = local
+			}
+			b.WriteString(strconv.Quote(name) + ": function() { return " + expr + "; }")
+		}
+		b.WriteString("});")
+	}
+	for idx, spec := range t.specs {
+		req := "require(" + strconv.Quote(spec) + ")"
+		if t.interop[idx] {
+			req = "require.interop(" + req + ")"
+		}
+		b.WriteString("var " + specVar(idx) + " = " + req + ";")
+	}
+	for _, idx := range t.stars {
+		b.WriteString("require.star(exports, " + specVar(idx) + ");")
+	}
+	return b.String()
+}
+
+func (t *esmTransform) output() ([]byte, []js.Edit) {
+	edits := append([]js.Edit{{Text: t.header()}}, t.edits...)
+	return js.Apply(t.src, edits)
+}
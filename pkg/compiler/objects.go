@@ -1,18 +1,31 @@
 package compiler
 
 import (
-	"encoding/hex"
-	"io"
-	"os"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"io/ioutil"
+	"os"
 )
 
 type Object struct {
 	Filename string
 	Hash     string
 	Imports  []string
+	Warnings []string
+
+	// DynamicImports are the modules loaded with import(), each is linked
+	// into a separate chunk loaded on demand.
+	DynamicImports []string `json:",omitempty"`
+
+	// Unresolved are the imports which could not be resolved. They may
+	// resolve to files added later, so the file is compiled again even if
+	// its source did not change.
+	Unresolved []string `json:",omitempty"`
+
+	// Module is set for ES modules.
+	Module *Module `json:",omitempty"`
 }
 
 func WriteObjectFile(o Object) error {
@@ -20,7 +33,7 @@ func WriteObjectFile(o Object) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(o.Filename + ".o", data, 0777)
+	return ioutil.WriteFile(o.Filename+".o", data, 0777)
 }
 
 func ReadObjectFile(file string) (Object, error) {
@@ -46,4 +59,3 @@ func hash(path string) (string, error) {
 	hash := hex.EncodeToString(h.Sum(nil))
 	return hash, nil
 }
-
@@ -1,119 +1,158 @@
 package compiler
 
 import (
-	"os"
-	"io"
-	"bytes"
-	"path/filepath"
-	"bufio"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"path/filepath"
 
+	"github.com/coldog/jsbld/pkg/js"
 	"github.com/coldog/jsbld/pkg/resolve"
 )
 
-// An efficient parsing function that does the following steps to setup require
-// statements for linking. It maintains a bit of ugly code below for a fast
-// implementation.
+// requireCall is a require("...") or dynamic import("...") call site. Start
+// and end locate the module name between the quotes, callee locates the
+// require or import identifier.
+type requireCall struct {
+	name    string
+	start   int
+	end     int
+	dynamic bool
+	callee  js.Token
+}
+
+// findRequires lexes the source and returns every genuine require or dynamic
+// import call with a single string literal argument. Calls inside comments,
+// strings, regular expressions and templates are ignored, as are member calls
+// like a.require() and function declarations named require.
+func findRequires(src []byte) []requireCall {
+	tokens := js.Lex(src)
+	calls := []requireCall{}
+	for i := 0; i+3 < len(tokens); i++ {
+		t := tokens[i]
+		if t.Kind != js.Ident {
+			continue
+		}
+		name := string(src[t.Start:t.End])
+		if name != "require" && name != "import" {
+			continue
+		}
+		if i > 0 {
+			prev := tokens[i-1]
+			switch string(src[prev.Start:prev.End]) {
+			case ".", "function":
+				continue
+			}
+		}
+		open, arg, close := tokens[i+1], tokens[i+2], tokens[i+3]
+		if string(src[open.Start:open.End]) != "(" || string(src[close.Start:close.End]) != ")" {
+			continue
+		}
+		if arg.Kind != js.String && arg.Kind != js.Template {
+			continue
+		}
+		calls = append(calls, requireCall{
+			name:    string(src[arg.Start+1 : arg.End-1]),
+			start:   arg.Start + 1,
+			end:     arg.End - 1,
+			dynamic: name == "import",
+			callee:  t,
+		})
+	}
+	return calls
+}
+
+// Sets up require statements for linking:
+//
+//  1. Rewrite ES module import and export declarations into require calls.
+//  2. Find all require(...) and dynamic import(...) calls.
+//  3. Rewrite require statements with the full path:
+//     require('react') -> require('node_modules/react').
+//     and dynamic imports with a call to the runtime chunk loader:
+//     import('./page') -> require.dynamic('src/page.js').
+//  4. Records full paths of all required files, the declarations of ES modules
+//     and warnings for requires which could not be resolved on the object.
+//  5. Shifts the source map written by the compiler, if any, to the rewritten
+//     source.
 //
-// 1. Parse all require(...) calls.
-// 2. Rewrite require statements with the full path:
-//		require('react') -> require('node_modules/react').
-// 3. Returns full paths of all required files.
-func compileImports(srcFile, dstFile string) ([]string, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, 1024))
-	f, err := os.OpenFile(dstFile, os.O_RDWR, 0777)
+// The srcFile is relative to the resolver root and paths are resolved from it.
+func compileImports(r *resolve.Resolver, srcFile, dstFile string, o *Object) error {
+	src, err := ioutil.ReadFile(dstFile)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	m, src, err := readSourceMap(dstFile, src)
+	if err != nil {
+		return err
 	}
-	defer f.Close()
 
-	var imports []string
-	var prev rune
-	var inR bool
+	if out, module, edits := transformModule(src); module != nil {
+		if m != nil {
+			if err := m.Shift(src, out, edits); err != nil {
+				return err
+			}
+		}
+		src = out
+		o.Module = module
+	}
 
-	rd := bufio.NewReader(f)
-	for {
-		c, _, err := rd.ReadRune()
+	resolved := map[string]string{}
+	edits := []js.Edit{}
+	for _, call := range findRequires(src) {
+		fullPath, err := r.Resolve(filepath.Dir(srcFile), call.name)
 		if err != nil {
-			if err == io.EOF {
-				break
+			log.Printf("failed to resolve: %s in %s -- %v", call.name, filepath.Dir(srcFile), err)
+			// If we couldn't resolve the path correctly we just leave this and
+			// don't log it as a dependent import. This means that if this
+			// require() is called that in the browser it will fail.
+			callee := "require"
+			if call.dynamic {
+				callee = "import"
 			}
-			return imports, err
+			o.Warnings = append(o.Warnings, fmt.Sprintf("%s: could not resolve %s(%q)", srcFile, callee, call.name))
+			o.Unresolved = append(o.Unresolved, call.name)
+			continue
 		}
-		switch c {
-		case 'r':
-			if !inR {
-				inR = true
-			} else if inR && prev != 'i' {
-				inR = false
-			}
-			buf.WriteRune(c)
-		case 'e':
-			if prev != 'r' {
-				inR = false
-			}
-			buf.WriteRune(c)
-		case 'q':
-			if prev != 'e' {
-				inR = false
-			}
-			buf.WriteRune(c)
-		case 'u':
-			if prev != 'q' {
-				inR = false
-			}
-			buf.WriteRune(c)
-		case 'i':
-			if prev != 'u' {
-				inR = false
-			}
-			buf.WriteRune(c)
-		case '(':
-			if prev != 'e' {
-				inR = false
-			}
-			buf.WriteRune(c)
-		case '\'', '"':
-			if prev != '(' {
-				inR = false
-			}
-			buf.WriteRune(c)
-			if inR {
-				imp, err := rd.ReadString(byte(c))
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-					return imports, err
-				}
-				imp = imp[:len(imp)-1]
+		resolved[call.name] = fullPath
+		if call.dynamic {
+			o.DynamicImports = append(o.DynamicImports, fullPath)
+			edits = append(edits, js.Edit{Start: call.callee.Start, End: call.callee.End, Text: "require.dynamic"})
+		} else {
+			o.Imports = append(o.Imports, fullPath)
+		}
+		edits = append(edits, js.Edit{Start: call.start, End: call.end, Text: fullPath})
+	}
+	out, edits := js.Apply(src, edits)
 
-				fullPath, err := resolve.Resolve(filepath.Dir(srcFile), imp)
-				if err == nil {
-					imports = append(imports, fullPath)
-					buf.WriteString(fullPath)
-				} else {
-					log.Printf("failed to resolve: %s in %s -- %v", imp, filepath.Dir(srcFile), err)
-					// If we couldn't resolve the path correctly we just leave
-					// this and don't log it as a dependent import. This means
-					// that if this require() is called that in the browser it
-					// will fail.
-					buf.WriteString(imp)
-				}
-				buf.WriteRune(c)
-				inR = false
-			}
-		default:
-			buf.WriteRune(c)
+	if m := o.Module; m != nil {
+		for i, b := range m.Imports {
+			m.Imports[i].Source = resolvedOr(resolved, b.Source)
+		}
+		for i, b := range m.Exports {
+			m.Exports[i].Source = resolvedOr(resolved, b.Source)
+		}
+		for i, b := range m.Uses {
+			m.Uses[i].Source = resolvedOr(resolved, b.Source)
+		}
+		for i, source := range m.StarExports {
+			m.StarExports[i] = resolvedOr(resolved, source)
 		}
-		prev = c
 	}
 
-	if _, err := f.Seek(0, 0); err != nil {
-		return nil, err
+	if m != nil {
+		if err := m.Shift(src, out, edits); err != nil {
+			return err
+		}
+		if err := writeSourceMap(m, filepath.Join(r.Root, srcFile), dstFile); err != nil {
+			return err
+		}
 	}
-	if _, err := buf.WriteTo(f); err != nil {
-		return nil, err
+	return ioutil.WriteFile(dstFile, out, 0777)
+}
+
+func resolvedOr(resolved map[string]string, name string) string {
+	if path, ok := resolved[name]; ok {
+		return path
 	}
-	return imports, nil
+	return name
 }
@@ -0,0 +1,42 @@
+package compiler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/coldog/jsbld/pkg/sourcemap"
+)
+
+var sourceMappingURL = regexp.MustCompile(`\n?//[#@] sourceMappingURL=\S*\s*$`)
+
+// readSourceMap reads the source map a compiler wrote next to dstFile, if
+// any, and strips the sourceMappingURL comment from the source.
+func readSourceMap(dstFile string, src []byte) (*sourcemap.Map, []byte, error) {
+	m, err := sourcemap.ReadFile(dstFile + ".map")
+	if os.IsNotExist(err) {
+		return nil, src, nil
+	}
+	if err != nil {
+		return nil, src, err
+	}
+	return m, sourceMappingURL.ReplaceAll(src, nil), nil
+}
+
+// writeSourceMap writes the source map of dstFile, pointing its source at
+// srcFile relative to the map.
+func writeSourceMap(m *sourcemap.Map, srcFile, dstFile string) error {
+	m.File = filepath.Base(dstFile)
+	if len(m.Sources) == 1 {
+		if rel, err := filepath.Rel(filepath.Dir(dstFile), srcFile); err == nil {
+			m.Sources[0] = filepath.ToSlash(rel)
+		}
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dstFile+".map", data, 0666)
+}
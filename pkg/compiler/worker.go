@@ -0,0 +1,230 @@
+package compiler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Workers are long lived compiler processes, started once and sent every file
+// to compile instead of running a command per file. They speak JSON over
+// stdio: a worker reads one WorkerRequest per line on stdin, writes the
+// compiled file, and its source map if any, to Dst and answers with one
+// WorkerResponse per line on stdout. A worker is sent one request at a time.
+// worker.js is a reference worker running babel.
+
+// WorkerRequest asks a worker to compile the file at Src into Dst. Paths are
+// absolute.
+type WorkerRequest struct {
+	ID  int    `json:"id"`
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+// WorkerResponse answers the request with the same ID. Error is set if the
+// file could not be compiled.
+type WorkerResponse struct {
+	ID    int    `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+type worker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	next   int
+}
+
+func startWorker(command []string, dir string, env []string) (*worker, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &worker{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// compile sends a request and returns the error reported by the worker. A
+// non nil error means the worker is unusable. Cancelling the context kills
+// the worker.
+func (w *worker) compile(ctx context.Context, src, dst string) (string, error) {
+	type result struct {
+		msg string
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		msg, err := w.request(src, dst)
+		results <- result{msg, err}
+	}()
+	select {
+	case r := <-results:
+		return r.msg, r.err
+	case <-ctx.Done():
+		w.cmd.Process.Kill()
+		<-results
+		return "", ctx.Err()
+	}
+}
+
+// request sends a request and waits for its response.
+func (w *worker) request(src, dst string) (string, error) {
+	w.next++
+	data, err := json.Marshal(WorkerRequest{ID: w.next, Src: src, Dst: dst})
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.stdin.Write(append(data, '\n')); err != nil {
+		return "", fmt.Errorf("worker: %v", err)
+	}
+	for {
+		line, err := w.stdout.ReadBytes('\n')
+		if err == io.EOF {
+			return "", errors.New("worker exited")
+		}
+		if err != nil {
+			return "", fmt.Errorf("worker: %v", err)
+		}
+		resp := WorkerResponse{}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return "", fmt.Errorf("worker: invalid response %q", strings.TrimSpace(string(line)))
+		}
+		if resp.ID == w.next {
+			return resp.Error, nil
+		}
+	}
+}
+
+// close asks the worker to exit by closing its stdin.
+func (w *worker) close() error {
+	w.stdin.Close()
+	return w.cmd.Wait()
+}
+
+func (w *worker) kill() {
+	w.cmd.Process.Kill()
+	w.cmd.Wait()
+}
+
+// workerPool starts up to size workers running the command, as requests
+// need them, and keeps them running between requests.
+type workerPool struct {
+	command []string
+	dir     string
+	env     []string
+	slots   chan struct{}
+
+	lock   sync.Mutex
+	idle   []*worker
+	busy   map[*worker]bool
+	closed bool
+	// running counts the requests in flight, which close waits for.
+	running sync.WaitGroup
+}
+
+func newWorkerPool(command []string, dir string, env []string, size int) *workerPool {
+	return &workerPool{command: command, dir: dir, env: env, slots: make(chan struct{}, size), busy: map[*worker]bool{}}
+}
+
+// compile compiles the file with an idle worker, starting one if there is
+// none. Workers which fail are replaced by the next request.
+func (p *workerPool) compile(ctx context.Context, src, dst string) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return errClosed
+	}
+	var w *worker
+	if n := len(p.idle); n > 0 {
+		w, p.idle = p.idle[n-1], p.idle[:n-1]
+	}
+	p.running.Add(1)
+	defer p.running.Done()
+	p.lock.Unlock()
+	if w == nil {
+		var err error
+		w, err = startWorker(p.command, p.dir, p.env)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		w.kill()
+		return errClosed
+	}
+	p.busy[w] = true
+	p.lock.Unlock()
+	msg, err := w.compile(ctx, src, dst)
+	p.lock.Lock()
+	delete(p.busy, w)
+	closed := p.closed
+	if err == nil && !closed {
+		p.idle = append(p.idle, w)
+	}
+	p.lock.Unlock()
+	switch {
+	case err != nil:
+		w.kill()
+		if closed {
+			return errClosed
+		}
+		return err
+	case closed:
+		w.close()
+	}
+	if msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+var errClosed = errors.New("worker: closed")
+
+// close stops the idle workers, kills the busy ones and waits for their
+// requests to return.
+func (p *workerPool) close() error {
+	p.lock.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	for w := range p.busy {
+		w.cmd.Process.Kill()
+	}
+	p.lock.Unlock()
+
+	var first error
+	for _, w := range idle {
+		if err := w.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	p.running.Wait()
+	return first
+}
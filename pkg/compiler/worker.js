@@ -0,0 +1,49 @@
+// Reference compiler worker compiling files with babel, configured with:
+//
+//   "workers": {"js": "node path/to/worker.js"}
+//
+// It reads one request {"id", "src", "dst"} per line on stdin, writes the
+// compiled file and its source map to dst and answers {"id"}, or {"id",
+// "error"} if the file could not be compiled, on stdout. It exits when stdin
+// is closed.
+
+var fs = require('fs');
+var path = require('path');
+var readline = require('readline');
+
+var babel;
+
+function compile(req) {
+  if (!babel) {
+    babel = require('@babel/core');
+  }
+  return babel.transformFileAsync(req.src, {
+    configFile: './.babelrc',
+    sourceMaps: true,
+    compact: true
+  }).then(function(result) {
+    var name = path.basename(req.dst) + '.map';
+    fs.writeFileSync(req.dst + '.map', JSON.stringify(result.map));
+    fs.writeFileSync(req.dst, result.code + '\n//# sourceMappingURL=' + name + '\n');
+  });
+}
+
+function respond(res) {
+  process.stdout.write(JSON.stringify(res) + '\n');
+}
+
+// Requests are answered in order, jsbld sends the next one after the answer.
+var queue = Promise.resolve();
+readline.createInterface({ input: process.stdin }).on('line', function(line) {
+  if (!line.trim()) {
+    return;
+  }
+  var req = JSON.parse(line);
+  queue = queue.then(function() {
+    return compile(req);
+  }).then(function() {
+    respond({ id: req.id });
+  }, function(err) {
+    respond({ id: req.id, error: String(err && err.message || err) });
+  });
+});
@@ -0,0 +1,216 @@
+package compiler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHelperWorker is the fake worker started by the tests. It copies the
+// source to the destination with its pid appended, fails files containing
+// FAIL, exits on files containing CRASH and never answers files containing
+// HANG.
+func TestHelperWorker(t *testing.T) {
+	if os.Getenv("JSBLD_HELPER_WORKER") != "1" {
+		return
+	}
+	out := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		req := WorkerRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			os.Exit(2)
+		}
+		data, err := ioutil.ReadFile(req.Src)
+		switch {
+		case err != nil:
+			out.Encode(WorkerResponse{ID: req.ID, Error: err.Error()})
+		case strings.Contains(string(data), "CRASH"):
+			os.Exit(1)
+		case strings.Contains(string(data), "HANG"):
+			time.Sleep(time.Hour)
+		case strings.Contains(string(data), "FAIL"):
+			out.Encode(WorkerResponse{ID: req.ID, Error: "cannot compile " + filepath.Base(req.Src)})
+		default:
+			data = append(data, fmt.Sprintf("\n// worker %d\n", os.Getpid())...)
+			ioutil.WriteFile(req.Dst, data, 0666)
+			out.Encode(WorkerResponse{ID: req.ID})
+		}
+	}
+	os.Exit(0)
+}
+
+func TestWorkers(t *testing.T) {
+	os.Setenv("JSBLD_HELPER_WORKER", "1")
+	defer os.Unsetenv("JSBLD_HELPER_WORKER")
+
+	root, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	write := func(name, src string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0777)
+		ioutil.WriteFile(filepath.Join(root, name), []byte(src), 0666)
+	}
+	for i := 0; i < 8; i++ {
+		write(fmt.Sprintf("src/%d.js", i), fmt.Sprintf("var n = %d;", i))
+	}
+	write("src/style.css", "body {}")
+
+	c := &Compiler{
+		Root:        root,
+		Dst:         "dst",
+		Compilers:   map[string]string{"*": "cp $1 $2"},
+		Workers:     map[string]string{"js": os.Args[0] + " -test.run=^TestHelperWorker$"},
+		Concurrency: 2,
+	}
+	defer c.Close()
+	if err := c.Compile(context.Background(), []string{"src"}); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	// compiledBy returns the worker line appended to the output.
+	compiledBy := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(root, "dst", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		return lines[len(lines)-1]
+	}
+	pids := map[string]bool{}
+	for i := 0; i < 8; i++ {
+		pids[compiledBy(fmt.Sprintf("src/%d.js", i))] = true
+	}
+	if len(pids) == 0 || len(pids) > 2 {
+		t.Fatalf("expected at most 2 workers, got %v", pids)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(root, "dst/src/style.css"))
+	if string(data) != "body {}" {
+		t.Fatalf("css not copied: %q", data)
+	}
+
+	// Workers report errors and keep running.
+	write("src/fail.js", "FAIL")
+	write("src/0.js", "var n = 10;")
+	err = c.CompileFiles(context.Background(), []string{"src/fail.js", "src/0.js"})
+	if err == nil || err.Error() != "src/fail.js: cannot compile fail.js" {
+		t.Fatalf("expected compile error, got %v", err)
+	}
+	if by := compiledBy("src/0.js"); !pids[by] {
+		t.Fatalf("expected a running worker to compile, got %q", by)
+	}
+
+	// Workers which exit are replaced.
+	write("src/crash.js", "CRASH")
+	err = c.CompileFiles(context.Background(), []string{"src/crash.js"})
+	if err == nil || err.Error() != "src/crash.js: worker exited" {
+		t.Fatalf("expected worker to exit, got %v", err)
+	}
+	write("src/1.js", "var n = 11;")
+	if err := c.CompileFiles(context.Background(), []string{"src/1.js"}); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func TestWorkerHang(t *testing.T) {
+	os.Setenv("JSBLD_HELPER_WORKER", "1")
+	defer os.Unsetenv("JSBLD_HELPER_WORKER")
+
+	root, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "src"), 0777)
+	ioutil.WriteFile(filepath.Join(root, "src/hang.js"), []byte("HANG"), 0666)
+
+	c := &Compiler{
+		Root:    root,
+		Dst:     "dst",
+		Workers: map[string]string{"js": os.Args[0] + " -test.run=^TestHelperWorker$"},
+	}
+	defer c.Close()
+
+	// Cancelling the build kills a worker which does not answer.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := c.CompileFiles(ctx, []string{"src/hang.js"}); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline, got %v", err)
+	}
+
+	// Closing the compiler kills busy workers.
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.CompileFiles(context.Background(), []string{"src/hang.js"})
+	}()
+	for busy := false; !busy; {
+		time.Sleep(10 * time.Millisecond)
+		c.lock.Lock()
+		for _, p := range c.pools {
+			p.lock.Lock()
+			busy = len(p.busy) > 0
+			p.lock.Unlock()
+		}
+		c.lock.Unlock()
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err == nil || err.Error() != "src/hang.js: worker: closed" {
+			t.Fatalf("expected closed worker, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("busy worker not killed")
+	}
+}
+
+func TestWorkerScript(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not installed")
+	}
+	root, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src := filepath.Join(root, "bad.js")
+	ioutil.WriteFile(src, []byte("export = ;"), 0666)
+
+	script, err := filepath.Abs("worker.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := startWorker([]string{node, script}, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file fails to compile, or babel is missing, either way the worker
+	// answers every request.
+	for i := 0; i < 2; i++ {
+		msg, err := w.compile(context.Background(), src, filepath.Join(root, "bad.out.js"))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if msg == "" {
+			t.Fatalf("request %d: expected an error", i)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+// Package config loads the jsbld.json project configuration file.
+//
+// A configuration looks like:
+//
+//	{
+//	  "entrypoints": ["src/index.js"],
+//	  "sources": ["src", "node_modules"],
+//	  "compile": "entrypoints",
+//	  "output": "dst",
+//	  "compilers": {"js": "babel $1 --out-file=$2", "*": "cp $1 $2"},
+//	  "workers": {"js": "node worker.js"},
+//	  "extensions": ["js", "jsx"],
+//	  "concurrency": 10,
+//	  "mode": "production",
+//	  "chunks": "shared",
+//	  "maxChunkSize": 250000,
+//	  "html": "index.html",
+//	  "compress": ["gzip", "brotli"],
+//	  "compressMinSize": 1024,
+//	  "nonce": "{{.Nonce}}"
+//	}
+//
+// Workers start persistent compilers for the extensions, taking precedence
+// over the compilers, see compiler.WorkerRequest for their protocol.
+// Compile is "sources" to compile every file under the sources, or
+// "entrypoints" to only compile the files reachable from the entrypoints.
+// Chunks selects the chunking strategy, one of the linker.Bundlers, and
+// maxChunkSize splits larger chunks into parts when set. The html template
+// is written into the output directory with tags loading the entrypoints.
+// Compress writes precompressed .gz and .br siblings of the output files of
+// at least compressMinSize bytes. The nonce is set on the tags of the html
+// page, typically as a placeholder the server replaces with the nonce of its
+// Content-Security-Policy, and scripts loaded by the runtime inherit it.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coldog/jsbld/pkg/compiler"
+	"github.com/coldog/jsbld/pkg/linker"
+	"github.com/coldog/jsbld/pkg/resolve"
+)
+
+// Filename is the name of the configuration file discovered at the root.
+const Filename = "jsbld.json"
+
+// Build modes.
+const (
+	Development = "development"
+	Production  = "production"
+)
+
+// Compile modes.
+const (
+	CompileSources     = "sources"
+	CompileEntrypoints = "entrypoints"
+)
+
+type Config struct {
+	Entrypoints  []string          `json:"entrypoints"`
+	Sources      []string          `json:"sources"`
+	Compile      string            `json:"compile"`
+	Output       string            `json:"output"`
+	Compilers    map[string]string `json:"compilers"`
+	Workers      map[string]string `json:"workers"`
+	Extensions   []string          `json:"extensions"`
+	Concurrency  int               `json:"concurrency"`
+	Mode         string            `json:"mode"`
+	Chunks       string            `json:"chunks"`
+	MaxChunkSize int64             `json:"maxChunkSize"`
+	HTML         string            `json:"html"`
+
+	Compress        []string `json:"compress"`
+	CompressMinSize int64    `json:"compressMinSize"`
+	Nonce           string   `json:"nonce"`
+
+	// file and lines locate validation errors, lines maps top level keys to
+	// the line they were declared on. flags maps the keys set on the command
+	// line to their flag.
+	file  string
+	lines map[string]int
+	flags map[string]string
+}
+
+// Error is a configuration error pointing at a line of the file, or at the
+// command line flag which set the value.
+type Error struct {
+	File string
+	Line int
+	Flag string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Flag != "" {
+		return "-" + e.Flag + ": " + e.Msg
+	}
+	if e.Line == 0 {
+		return e.File + ": " + e.Msg
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// Default returns the configuration used when no file exists.
+func Default() *Config {
+	return &Config{
+		Sources:     []string{"src", "node_modules"},
+		Compile:     CompileSources,
+		Output:      "dst",
+		Concurrency: compiler.DefaultConcurrency,
+		Mode:        Development,
+		Chunks:      "entry",
+
+		CompressMinSize: 1024,
+	}
+}
+
+// Load reads the configuration file from the root directory. Defaults are
+// returned if the file does not exist.
+func Load(root string) (*Config, error) {
+	return LoadFile(filepath.Join(root, Filename))
+}
+
+// LoadFile reads the configuration file at path. Defaults are returned if the
+// file does not exist.
+func LoadFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Default(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Parse(filepath.Base(path), data)
+}
+
+// Parse decodes and validates a configuration, filling in defaults for any
+// missing values. The file name is only used in errors.
+func Parse(file string, data []byte) (*Config, error) {
+	c := Default()
+	c.file = file
+	c.lines = keyLines(data)
+
+	for key, line := range c.lines {
+		if !known[key] {
+			return nil, &Error{File: file, Line: line, Msg: fmt.Sprintf("unknown key %q", key)}
+		}
+	}
+
+	if err := json.Unmarshal(data, c); err != nil {
+		switch err := err.(type) {
+		case *json.SyntaxError:
+			return nil, &Error{File: file, Line: line(data, err.Offset), Msg: err.Error()}
+		case *json.UnmarshalTypeError:
+			return nil, &Error{
+				File: file,
+				Line: line(data, err.Offset),
+				Msg:  fmt.Sprintf("%s must be %s, got %s", err.Field, typeName(err.Type.Kind().String()), err.Value),
+			}
+		default:
+			return nil, &Error{File: file, Msg: err.Error()}
+		}
+	}
+	return c, c.Validate()
+}
+
+var known = map[string]bool{
+	"entrypoints":  true,
+	"sources":      true,
+	"compile":      true,
+	"output":       true,
+	"compilers":    true,
+	"workers":      true,
+	"extensions":   true,
+	"concurrency":  true,
+	"mode":         true,
+	"chunks":       true,
+	"maxChunkSize": true,
+	"html":         true,
+
+	"compress":        true,
+	"compressMinSize": true,
+	"nonce":           true,
+}
+
+// Validate checks the configuration values.
+func (c *Config) Validate() error {
+	for _, entry := range c.Entrypoints {
+		if strings.TrimSpace(entry) == "" {
+			return c.errorf("entrypoints", "entrypoints must not contain empty paths")
+		}
+	}
+	if len(c.Sources) == 0 {
+		return c.errorf("sources", "at least one source directory is required")
+	}
+	for _, src := range c.Sources {
+		if strings.TrimSpace(src) == "" {
+			return c.errorf("sources", "sources must not contain empty paths")
+		}
+	}
+	if c.Compile != CompileSources && c.Compile != CompileEntrypoints {
+		return c.errorf("compile", "compile must be %q or %q, got %q", CompileSources, CompileEntrypoints, c.Compile)
+	}
+	if strings.TrimSpace(c.Output) == "" {
+		return c.errorf("output", "output must not be empty")
+	}
+	for ext, cmd := range c.Compilers {
+		if ext == "" {
+			return c.errorf("compilers", "compiler extensions must not be empty")
+		}
+		if !strings.Contains(cmd, "$1") || !strings.Contains(cmd, "$2") {
+			return c.errorf("compilers", "compiler for %q must reference the source $1 and destination $2", ext)
+		}
+	}
+	for ext, cmd := range c.Workers {
+		if ext == "" {
+			return c.errorf("workers", "worker extensions must not be empty")
+		}
+		if strings.TrimSpace(cmd) == "" {
+			return c.errorf("workers", "worker for %q must not be empty", ext)
+		}
+	}
+	for _, ext := range c.Extensions {
+		if strings.Trim(ext, ".") == "" || strings.ContainsAny(ext, "/\\") {
+			return c.errorf("extensions", "invalid extension %q", ext)
+		}
+	}
+	if c.Concurrency < 1 {
+		return c.errorf("concurrency", "concurrency must be at least 1, got %d", c.Concurrency)
+	}
+	if c.Mode != Development && c.Mode != Production {
+		return c.errorf("mode", "mode must be %q or %q, got %q", Development, Production, c.Mode)
+	}
+	if _, ok := linker.Bundlers[c.Chunks]; !ok {
+		names := []string{}
+		for name := range linker.Bundlers {
+			names = append(names, strconv.Quote(name))
+		}
+		sort.Strings(names)
+		return c.errorf("chunks", "chunks must be one of %s, got %q", strings.Join(names, ", "), c.Chunks)
+	}
+	if c.MaxChunkSize < 0 {
+		return c.errorf("maxChunkSize", "maxChunkSize must not be negative, got %d", c.MaxChunkSize)
+	}
+	for _, format := range c.Compress {
+		if _, ok := compressions[format]; !ok {
+			return c.errorf("compress", "compress must only contain \"gzip\" and \"brotli\", got %q", format)
+		}
+	}
+	if strings.Contains(c.Nonce, "\"") {
+		return c.errorf("nonce", "nonce must not contain double quotes, got %q", c.Nonce)
+	}
+	if c.CompressMinSize < 0 {
+		return c.errorf("compressMinSize", "compressMinSize must not be negative, got %d", c.CompressMinSize)
+	}
+	return nil
+}
+
+// compressions maps the compress formats to their linker names.
+var compressions = map[string]string{
+	"gzip":   linker.Gzip,
+	"brotli": linker.Brotli,
+}
+
+// Compressions returns the linker names of the compress formats.
+func (c *Config) Compressions() []string {
+	formats := []string{}
+	for _, format := range c.Compress {
+		formats = append(formats, compressions[format])
+	}
+	return formats
+}
+
+// Compiler returns a compiler for the project root using the configuration.
+func (c *Config) Compiler(root string) *compiler.Compiler {
+	compilers := map[string]string{}
+	for ext, cmd := range compiler.Compilers {
+		compilers[ext] = cmd
+	}
+	for ext, cmd := range c.Compilers {
+		compilers[strings.TrimPrefix(ext, ".")] = cmd
+	}
+	var workers map[string]string
+	if len(c.Workers) > 0 {
+		workers = map[string]string{}
+		for ext, cmd := range c.Workers {
+			workers[strings.TrimPrefix(ext, ".")] = cmd
+		}
+	}
+	exts := make([]string, len(resolve.Extensions))
+	copy(exts, resolve.Extensions)
+	if len(c.Extensions) > 0 {
+		exts = make([]string, len(c.Extensions))
+		for i, ext := range c.Extensions {
+			exts[i] = strings.TrimPrefix(ext, ".")
+		}
+	}
+	return &compiler.Compiler{
+		Root:        root,
+		Dst:         c.Output,
+		Compilers:   compilers,
+		Workers:     workers,
+		Extensions:  exts,
+		Concurrency: c.Concurrency,
+		Mode:        c.Mode,
+	}
+}
+
+// Bundler returns the chunking strategy of the configuration.
+func (c *Config) Bundler() linker.Bundler {
+	bundler := linker.Bundlers[c.Chunks]
+	if c.MaxChunkSize > 0 {
+		return &linker.SizeBundler{Bundler: bundler, MaxSize: c.MaxChunkSize}
+	}
+	return bundler
+}
+
+// SetFlag records that the value of the key was set by the command line flag,
+// so validation errors of the key point at the flag instead of the file.
+func (c *Config) SetFlag(key, flag string) {
+	if c.flags == nil {
+		c.flags = map[string]string{}
+	}
+	c.flags[key] = flag
+}
+
+func (c *Config) errorf(key, format string, args ...interface{}) error {
+	if flag, ok := c.flags[key]; ok {
+		return &Error{Flag: flag, Msg: fmt.Sprintf(format, args...)}
+	}
+	file := c.file
+	if file == "" {
+		file = Filename
+	}
+	return &Error{File: file, Line: c.lines[key], Msg: fmt.Sprintf(format, args...)}
+}
+
+// keyLines returns the line of every key in the top level object. Invalid
+// JSON is ignored here and reported when unmarshalling.
+func keyLines(data []byte) map[string]int {
+	lines := map[string]int{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	keyNext := false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return lines
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			keyNext = depth == 1 && tok == json.Delim('{')
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+			keyNext = depth == 1
+		default:
+			if depth != 1 {
+				continue
+			}
+			if key, ok := tok.(string); ok && keyNext {
+				lines[key] = line(data, dec.InputOffset())
+			}
+			keyNext = !keyNext
+		}
+	}
+}
+
+func line(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func typeName(kind string) string {
+	switch kind {
+	case "slice":
+		return "a list"
+	case "map":
+		return "an object"
+	case "int", "int64":
+		return "a number"
+	}
+	return "a " + kind
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse(Filename, []byte(`{
+  "entrypoints": ["src/index.js"],
+  "compilers": {"ts": "tsc $1 --outFile $2"},
+  "concurrency": 4,
+  "mode": "production"
+}`))
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if c.Output != "dst" || len(c.Sources) != 2 {
+		t.Fatalf("defaults not applied: %+v", c)
+	}
+	if c.Concurrency != 4 || c.Mode != Production || c.Compilers["ts"] == "" {
+		t.Fatalf("values not decoded: %+v", c)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, test := range []struct {
+		data string
+		err  string
+	}{
+		{"{\n  \"output\": \"dst\",\n  \"mode\": \"fast\"\n}", `jsbld.json:3: mode must be "development" or "production", got "fast"`},
+		{"{\n  \"concurrency\": 0\n}", "jsbld.json:2: concurrency must be at least 1, got 0"},
+		{"{\n  \"sources\": []\n}", "jsbld.json:2: at least one source directory is required"},
+		{"{\n\n  \"entry\": \"src/index.js\"\n}", `jsbld.json:3: unknown key "entry"`},
+		{"{\n  \"concurrency\": \"4\"\n}", "jsbld.json:2: concurrency must be a number, got string"},
+		{"{\n  \"compilers\": {\"js\": \"babel\"}\n}", `jsbld.json:2: compiler for "js" must reference the source $1 and destination $2`},
+		{"{\n  \"output\": \"dst\",\n  \"mode\": \n}", "jsbld.json:4: invalid character '}' looking for beginning of value"},
+		{"{\n  \"extensions\": [\"js\", \"a/b\"]\n}", `jsbld.json:2: invalid extension "a/b"`},
+		{"{\n  \"chunks\": \"split\"\n}", `jsbld.json:2: chunks must be one of "entry", "package", "shared", got "split"`},
+		{"{\n  \"compile\": \"lazy\"\n}", `jsbld.json:2: compile must be "sources" or "entrypoints", got "lazy"`},
+		{"{\n  \"maxChunkSize\": -1\n}", "jsbld.json:2: maxChunkSize must not be negative, got -1"},
+		{"{\n  \"compress\": [\"gzip\", \"zstd\"]\n}", `jsbld.json:2: compress must only contain "gzip" and "brotli", got "zstd"`},
+		{"{\n  \"workers\": {\"js\": \" \"}\n}", `jsbld.json:2: worker for "js" must not be empty`},
+		{"{\n  \"nonce\": \"a\\\"b\"\n}", `jsbld.json:2: nonce must not contain double quotes, got "a\"b"`},
+	} {
+		_, err := Parse(Filename, []byte(test.data))
+		if err == nil {
+			t.Fatalf("expected error for %s", test.data)
+		}
+		if !strings.HasPrefix(err.Error(), test.err) {
+			t.Fatalf("got error %q, expected %q", err, test.err)
+		}
+	}
+}
+
+func TestFlagErrors(t *testing.T) {
+	c, err := Parse(Filename, []byte("{\n  \"output\": \"dst\",\n  \"mode\": \"production\"\n}"))
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	c.Mode = "fast"
+	c.SetFlag("mode", "mode")
+	expected := `-mode: mode must be "development" or "production", got "fast"`
+	if err := c.Validate(); err == nil || err.Error() != expected {
+		t.Fatalf("got error %v, expected %q", err, expected)
+	}
+}
+
+func TestKeyLines(t *testing.T) {
+	lines := keyLines([]byte("{\n  \"a\": {\"b\": [1, {\"c\": 2}]},\n  \"d\": [\"e\"],\n\n  \"f\": 1\n}"))
+	if len(lines) != 3 || lines["a"] != 2 || lines["d"] != 3 || lines["f"] != 5 {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+}
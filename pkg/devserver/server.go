@@ -0,0 +1,120 @@
+// Package devserver serves build output and static files over HTTP and pushes
+// events to connected browsers using server-sent events.
+package devserver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// EventsPath is the URL path of the event stream.
+const EventsPath = "/__jsbld__/events"
+
+// Server serves files from Dirs, the first directory containing a file wins,
+// and streams events to every browser connected to EventsPath.
+type Server struct {
+	Dirs []string
+
+	lock    sync.Mutex
+	clients map[chan string]bool
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == EventsPath {
+		s.events(w, r)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	for _, dir := range s.Dirs {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		st, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if st.IsDir() {
+			file = filepath.Join(file, "index.html")
+			if _, err := os.Stat(file); err != nil {
+				continue
+			}
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, file)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// Reload tells every connected browser to reload the page.
+func (s *Server) Reload() {
+	s.Send("reload", "")
+}
+
+// Send broadcasts an event to every connected browser. Clients which are not
+// keeping up with the stream miss the event rather than block the sender.
+func (s *Server) Send(event, data string) {
+	msg := "event: " + event + "\n"
+	for _, line := range strings.Split(data, "\n") {
+		msg += "data: " + line + "\n"
+	}
+	msg += "\n"
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for client := range s.clients {
+		select {
+		case client <- msg:
+		default:
+		}
+	}
+}
+
+func (s *Server) subscribe() chan string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.clients == nil {
+		s.clients = map[chan string]bool{}
+	}
+	client := make(chan string, 8)
+	s.clients[client] = true
+	return client
+}
+
+func (s *Server) unsubscribe(client chan string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, client)
+}
+
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	client := s.subscribe()
+	defer s.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-client:
+			fmt.Fprint(w, msg)
+			flusher.Flush()
+		}
+	}
+}
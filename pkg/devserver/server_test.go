@@ -0,0 +1,90 @@
+package devserver
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeFiles(t *testing.T) {
+	out, err := ioutil.TempDir("", "devserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	os.MkdirAll(filepath.Join(out, "dst"), 0777)
+	ioutil.WriteFile(filepath.Join(out, "dst", "index.js"), []byte("bundle"), 0666)
+	ioutil.WriteFile(filepath.Join(out, "index.html"), []byte("html"), 0666)
+
+	srv := httptest.NewServer(&Server{Dirs: []string{filepath.Join(out, "dst"), out}})
+	defer srv.Close()
+
+	for path, expected := range map[string]string{
+		"/":             "html",
+		"/index.html":   "html",
+		"/index.js":     "bundle",
+		"/dst/index.js": "bundle",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(data) != expected {
+			t.Fatalf("%s: got %q, expected %q", path, data, expected)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/missing.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing file: %d", resp.StatusCode)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := &Server{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + EventsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	rd := bufio.NewReader(resp.Body)
+	if line, _ := rd.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("unexpected preamble %q", line)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Send("failed", "line 1\nline 2")
+	}()
+
+	msg := ""
+	for !strings.HasSuffix(msg, "\n\n") {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\n" && msg == "" {
+			continue
+		}
+		msg += line
+	}
+	expected := "event: failed\ndata: line 1\ndata: line 2\n\n"
+	if msg != expected {
+		t.Fatalf("got %q, expected %q", msg, expected)
+	}
+}
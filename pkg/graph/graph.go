@@ -3,7 +3,7 @@ package graph
 import (
 	"context"
 	"errors"
-	"log"
+	"sort"
 	"sync"
 )
 
@@ -24,36 +24,81 @@ type work struct {
 
 type ProcessFunc func(ctx context.Context, id int) error
 
+// Graph runs Process for every node once the nodes it depends on completed,
+// at most Concurrency at a time. Nodes maps each node to its dependencies.
+// A failed node skips the nodes depending on it, while other nodes still run.
 type Graph struct {
 	Concurrency int
 	Nodes       map[int][]int
 	Process     ProcessFunc
-
-	wg        *sync.WaitGroup
-	ctx       context.Context
-	cancel    context.CancelFunc
-	inFlight  map[int]bool
-	completed map[int]bool
-	work      chan work
-	err       error
-	done      chan done
+	// Expand, if set, is called once a node completed successfully and
+	// returns the nodes discovered by it, mapped to their dependencies. Nodes
+	// already in the graph are ignored, the others are added to Nodes.
+	Expand func(id int) map[int][]int
+
+	wg         *sync.WaitGroup
+	ctx        context.Context
+	cancel     context.CancelFunc
+	inFlight   map[int]bool
+	completed  map[int]bool
+	failed     map[int]bool
+	dependents map[int][]int
+	// waiting counts the dependencies of every node not completed yet, and
+	// queue holds the nodes ready to be sent.
+	waiting map[int]int
+	queue   []int
+	work    chan work
+	err     error
+	done    chan done
 }
 
 func (g *Graph) init() {
+	if g.Concurrency < 1 {
+		g.Concurrency = 1
+	}
+	if g.Nodes == nil {
+		g.Nodes = map[int][]int{}
+	}
 	g.completed = map[int]bool{}
+	g.failed = map[int]bool{}
 	g.inFlight = map[int]bool{}
+	g.dependents = map[int][]int{}
+	g.waiting = map[int]int{}
+	g.queue = nil
+	ids := []int{}
+	for id, deps := range g.Nodes {
+		ids = append(ids, id)
+		seen := map[int]bool{}
+		for _, dep := range deps {
+			if !seen[dep] {
+				seen[dep] = true
+				g.dependents[dep] = append(g.dependents[dep], id)
+				g.waiting[id]++
+			}
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if g.waiting[id] == 0 {
+			g.queue = append(g.queue, id)
+		}
+	}
 	g.work = make(chan work, g.Concurrency)
-	g.done = make(chan done)
+	g.done = make(chan done, g.Concurrency)
 	g.wg = &sync.WaitGroup{}
 	g.ctx, g.cancel = context.WithCancel(context.Background())
 }
 
+// Solve processes every node and returns the first error. Cancelling the
+// context cancels the context passed to Process and starts no more nodes.
+// ErrUnsolvable is returned if the dependencies of some nodes never complete.
 func (g *Graph) Solve(ctx context.Context) error {
 	g.init()
+	defer g.cancel()
 
 	g.wg.Add(g.Concurrency)
 	for i := 0; i < g.Concurrency; i++ {
-		go worker(i, g.Process, g.wg, g.work)
+		go worker(g.Process, g.wg, g.work)
 	}
 	err := g.pump(ctx)
 	g.wg.Wait()
@@ -62,124 +107,136 @@ func (g *Graph) Solve(ctx context.Context) error {
 }
 
 // Worker processes individual items from the work queue.
-func worker(i int, process ProcessFunc, wg *sync.WaitGroup, work chan work) {
-	log.Printf("worker[%d]: starting", i)
-	defer log.Printf("worker[%d]: stopping", i)
+func worker(process ProcessFunc, wg *sync.WaitGroup, work chan work) {
 	defer wg.Done()
 
 	for work := range work {
-		log.Printf("worker[%d]: starting work=%d", i, work.id)
 		err := process(work.ctx, work.id)
 		work.done <- struct {
 			id  int
 			err error
 		}{id: work.id, err: err}
-		log.Printf("worker[%d]: finished work=%d", i, work.id)
 	}
 }
 
 // Reads from done channel and pumps work into the work channel. This function
 // sets state on the graph object.
 func (g *Graph) pump(ctx context.Context) error {
-	log.Printf("pump: starting")
 	defer close(g.work)
 
-	// Prime the initial channel with work to be done. Block when sending work
-	// here as we need to get something into the initial channels or else we'll
-	// hit deadlock.
-	if !g.sendWork(true) {
-		return ErrUnsolvable
-	}
-
-	// Wait for a worker to be freed to send more work down the work channel.
-	// If jobs are still in flight, we continue to read from the done channel.
-	for !g.finished() || g.working() {
+	cancelled := ctx.Done()
+	for {
+		// Work is only sent to free workers, so sending never blocks.
+		if g.ctx.Err() == nil {
+			g.sendWork()
+		}
+		if !g.working() {
+			break
+		}
 		select {
 		case done := <-g.done:
-			log.Printf("pump: work done work=%d", done.id)
-			g.complete(done.id)
-
-			// If there's an error, mark this globally.
-			if done.err != nil {
-				log.Printf("pump: receive error: %v", done.err)
-				g.errored(done.err)
-			}
-
-			if !g.finished() {
-				sent := g.sendWork(false)
-				// Unsolvable case: no in flight processing and no new work
-				// sent to the queue. A circular dependency must exist.
-				if !sent && !g.working() {
-					return ErrUnsolvable
-				}
-			}
-		case <-ctx.Done():
-			log.Printf("pump: context cancelled - waiting for workers to exit")
+			g.complete(done.id, done.err)
+		case <-cancelled:
 			g.errored(ctx.Err())
+			g.cancel()
+			cancelled = nil
 		}
 	}
 
-	log.Println("pump: finished")
+	if g.err == nil && len(g.completed) < len(g.Nodes) {
+		// No work in flight and none ready. A circular dependency or a
+		// missing node must exist.
+		return ErrUnsolvable
+	}
 	return g.err
 }
 
-// Errorred sets the error on the graph and also should cancel all work.
+// Errored records the first error of the graph.
 func (g *Graph) errored(err error) {
-	g.err = err
-	g.cancel()
+	if g.err == nil {
+		g.err = err
+	}
 }
 
 func (g *Graph) working() bool {
 	return len(g.inFlight) > 0
 }
 
-// Finished
-func (g *Graph) finished() bool {
-	return g.err != nil || len(g.completed) >= len(g.Nodes)
-}
-
-// Complete a set of work marking it done and not in flight.
-func (g *Graph) complete(id int) {
+// Complete a set of work marking it done and not in flight. Failed work
+// skips every node depending on it.
+func (g *Graph) complete(id int, err error) {
 	g.completed[id] = true
 	delete(g.inFlight, id)
+	if err == nil {
+		for _, dependent := range g.dependents[id] {
+			g.waiting[dependent]--
+			if g.waiting[dependent] == 0 {
+				g.queue = append(g.queue, dependent)
+			}
+		}
+		if g.Expand != nil {
+			g.expand(g.Expand(id))
+		}
+		return
+	}
+	g.errored(err)
+	g.skip(id)
 }
 
-// SendWork pushes work into the work channel. If block is set to true it will
-// block and push all ready work into the channel. If block is false it returns
-// as soon as the channel blocks.
-func (g *Graph) sendWork(block bool) (sent bool) {
-	for id := range g.Nodes {
-		if g.ready(id) {
-			if block {
-				g.work <- work{id: id, ctx: g.ctx, done: g.done}
-			} else {
-				select {
-				case g.work <- work{id: id, ctx: g.ctx, done: g.done}:
-				default:
-					return
-				}
+// expand adds the new nodes, waiting for their dependencies not completed
+// yet. Nodes depending on a failed node are skipped.
+func (g *Graph) expand(nodes map[int][]int) {
+	ids := []int{}
+	for id := range nodes {
+		if _, ok := g.Nodes[id]; !ok {
+			ids = append(ids, id)
+			g.Nodes[id] = nodes[id]
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		seen := map[int]bool{}
+		failed := false
+		for _, dep := range g.Nodes[id] {
+			if seen[dep] {
+				continue
 			}
-
-			g.inFlight[id] = true
-			log.Printf("pump: send work work=%d inFlight=%+v", id, g.inFlight)
-			sent = true
+			seen[dep] = true
+			failed = failed || g.failed[dep]
+			if !g.completed[dep] {
+				g.dependents[dep] = append(g.dependents[dep], id)
+				g.waiting[id]++
+			}
+		}
+		if failed {
+			g.completed[id] = true
+			g.skip(id)
+		} else if g.waiting[id] == 0 {
+			g.queue = append(g.queue, id)
 		}
 	}
-	return
 }
 
-// Ready returns whether work can be started on.
-func (g *Graph) ready(id int) bool {
-	if g.inFlight[id] {
-		return false
-	}
-	if g.completed[id] {
-		return false
+func (g *Graph) skip(id int) {
+	g.failed[id] = true
+	for _, dependent := range g.dependents[id] {
+		if !g.failed[dependent] {
+			g.completed[dependent] = true
+			g.skip(dependent)
+		}
 	}
-	for _, dep := range g.Nodes[id] {
-		if !g.completed[dep] {
-			return false
+}
+
+// SendWork pushes ready work into the work channel until every worker is
+// busy.
+func (g *Graph) sendWork() {
+	for len(g.inFlight) < g.Concurrency && len(g.queue) > 0 {
+		id := g.queue[0]
+		g.queue = g.queue[1:]
+		if g.completed[id] {
+			continue
 		}
+		g.work <- work{id: id, ctx: g.ctx, done: g.done}
+		g.inFlight[id] = true
 	}
-	return true // All dependencies are completed.
 }
@@ -90,3 +90,104 @@ func TestGraphCircular(t *testing.T) {
 	}
 	fmt.Printf("c: %v, err: %v\n", completed, err)
 }
+
+func TestGraphSkipsDependents(t *testing.T) {
+	g := &Graph{
+		Concurrency: 2,
+		Nodes: map[int][]int{
+			1: []int{},
+			2: []int{1},
+			3: []int{2},
+			4: []int{},
+			5: []int{4},
+		},
+	}
+
+	completed, err := runGraph(t, g, errMap{1: true})
+	if err == nil || err.Error() != "err: 1" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(completed) != 3 || completed[2] != 0 || completed[3] != 0 || completed[5] != 1 {
+		t.Fatalf("invalid completion %+v", completed)
+	}
+}
+
+func TestGraphWide(t *testing.T) {
+	// More nodes are ready than workers.
+	nodes := map[int][]int{0: []int{}}
+	for i := 1; i <= 1000; i++ {
+		nodes[i] = []int{0}
+	}
+	l := sync.Mutex{}
+	count := 0
+	g := &Graph{
+		Concurrency: 3,
+		Nodes:       nodes,
+		Process: func(ctx context.Context, id int) error {
+			l.Lock()
+			count++
+			l.Unlock()
+			return nil
+		},
+	}
+	if err := g.Solve(context.Background()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if count != len(nodes) {
+		t.Fatalf("processed %d nodes", count)
+	}
+
+	g.Nodes = map[int][]int{}
+	if err := g.Solve(context.Background()); err != nil {
+		t.Fatalf("unexpected error for empty graph %v", err)
+	}
+}
+
+func TestGraphCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := 0
+	g := &Graph{
+		Concurrency: 1,
+		Nodes:       map[int][]int{1: []int{}, 2: []int{1}},
+		Process: func(ctx context.Context, id int) error {
+			started++
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	if err := g.Solve(ctx); err != context.Canceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if started != 1 {
+		t.Fatalf("started %d nodes", started)
+	}
+}
+
+func TestGraphExpand(t *testing.T) {
+	g := &Graph{
+		Concurrency: 2,
+		Nodes: map[int][]int{
+			1: []int{},
+			2: []int{},
+		},
+		Expand: func(id int) map[int][]int {
+			switch id {
+			case 1:
+				return map[int][]int{3: nil, 4: {3}, 2: {4}}
+			case 3:
+				return map[int][]int{5: {1, 4}, 6: {2}}
+			}
+			return nil
+		},
+	}
+
+	completed, err := runGraph(t, g, errMap{2: true})
+	if err == nil || err.Error() != "err: 2" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// The added node depending on the failed node is skipped.
+	if len(completed) != 5 || completed[6] != 0 || len(g.Nodes) != 6 {
+		t.Fatalf("invalid completion %+v", completed)
+	}
+}
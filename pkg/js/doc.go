@@ -0,0 +1,7 @@
+// Package js implements a small javascript lexer and source editing helpers.
+//
+// The lexer only distinguishes the tokens needed to find module references
+// and bindings reliably: identifiers, punctuators, string and template
+// literals, regular expressions and numbers, and skips comments. Malformed
+// input never fails, the lexer simply stops at the end of the source.
+package js
@@ -0,0 +1,34 @@
+package js
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Edit replaces the source between Start and End with Text.
+type Edit struct {
+	Start int
+	End   int
+	Text  string
+}
+
+// Apply replaces the source ranges of the edits, sorted by start, and returns
+// the output along with the edits applied. Edits overlapping a previous one
+// are skipped.
+func Apply(src []byte, edits []Edit) ([]byte, []Edit) {
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].Start < edits[j].Start })
+	var b bytes.Buffer
+	applied := []Edit{}
+	last := 0
+	for _, e := range edits {
+		if e.Start < last {
+			continue
+		}
+		b.Write(src[last:e.Start])
+		b.WriteString(e.Text)
+		last = e.End
+		applied = append(applied, e)
+	}
+	b.Write(src[last:])
+	return b.Bytes(), applied
+}
@@ -0,0 +1,133 @@
+package js
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	src := []byte("a = b / 2 /* c */ + /d/g.test(`e${f}g`) // h\n'i'")
+	texts := []string{}
+	kinds := []Kind{}
+	for _, tok := range Lex(src) {
+		texts = append(texts, string(src[tok.Start:tok.End]))
+		kinds = append(kinds, tok.Kind)
+	}
+	expected := []string{"a", "=", "b", "/", "2", "+", "/d/g", ".", "test", "(", "`e${", "f", "}g`", ")", "'i'"}
+	if !reflect.DeepEqual(texts, expected) {
+		t.Fatalf("wrong tokens: %q", texts)
+	}
+	if kinds[4] != Number || kinds[6] != Regex || kinds[10] != TemplatePart || kinds[14] != String {
+		t.Fatalf("wrong kinds: %v", kinds)
+	}
+
+	// A slash after the head of a statement starts a regular expression.
+	for _, test := range []struct {
+		src   string
+		regex bool
+	}{
+		{"if (a) /b/.test(s)", true},
+		{"while (f(x)) /b/g", true},
+		{"for (;;) /b/", true},
+		{"with (o) /b/", true},
+		{"x = (a) / b", false},
+		{"if (a) x = f(b) / c", false},
+	} {
+		src := []byte(test.src)
+		regex := false
+		for _, tok := range Lex(src) {
+			if tok.Kind == Regex {
+				regex = true
+			}
+		}
+		if regex != test.regex {
+			t.Errorf("%s: got regex %v", test.src, regex)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	out, applied := Apply([]byte("abcdef"), []Edit{
+		{Start: 4, End: 5, Text: "E"},
+		{Start: 0, End: 0, Text: ">"},
+		{Start: 1, End: 3, Text: "BC"},
+		{Start: 2, End: 4, Text: "skipped"},
+	})
+	if string(out) != ">aBCdEf" || len(applied) != 3 {
+		t.Fatalf("wrong output: %s %v", out, applied)
+	}
+}
+
+func TestMinify(t *testing.T) {
+	for _, test := range []struct{ src, expected string }{
+		// Whitespace and comments.
+		{"var a = b + +c; // d\nx = y\n/* z */ ++w", "var a=b+ +c;x=y\n++w"},
+		{"return 1 .toString()", "return 1 .toString()"},
+		// Constant folding.
+		{"x = 60 * 60 * 24 + 1", "x=86401"},
+		{"x = y * 2 * 3", "x=y*2*3"},
+		{"x = 1 + 2 * y", "x=1+2*y"},
+		{"x = 10 / 4 - 3 ** 2", "x=2.5-3**2"},
+		{"x = 'a' + 'b' + c", "x='ab'+c"},
+		{"x = 1 / 0", "x=1/0"},
+		// Renaming.
+		{"function f(first, second) { var sum = first + second; return sum; }", "function f(a,b){var c=a+b;return c;}"},
+		{"(function() { let value = 1; const o = { value, key: value }; o.value = value; })()", "(function(){let a=1;const o={value:a,key:a};o.value=a;})()"},
+		{"(function() { var window = 1; return (item) => item + window; })()", "(function(){var a=1;return(b)=>b+a;})()"},
+		{"(function(outer) { function inner(a) { return a + outer; } })", "(function(b){function c(a){return a+b;}})"},
+		{"(function() { try {} catch (error) { const st = error; } })", "(function(){try{}catch(a){const b=a;}})"},
+		{"(function() { class Thing { method(size) { this.size = size; } } })", "(function(){class a{method(a){this.size=a;}}})"},
+		// Names reachable by eval are kept.
+		{"(function(value) { eval('value') })", "(function(value){eval('value')})"},
+	} {
+		out, _ := Minify([]byte(test.src))
+		if string(out) != test.expected {
+			t.Errorf("%s:\ngot      %s\nexpected %s", test.src, out, test.expected)
+		}
+	}
+}
+
+func TestMinifyRun(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	run := func(src string) string {
+		out, err := exec.Command(node, "-e", src).CombinedOutput()
+		if err != nil {
+			t.Fatalf("node failed: %v\n%s\n%s", err, src, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	// Names within regular expressions after a statement head are not
+	// renamed.
+	src := `(function() {
+	function count(flag, value) {
+		var n = 0;
+		if (flag) /count value/.test(value) && n++;
+		while (!flag) /value/.test(value) ? flag = n++ : flag = true;
+		return n;
+	}
+	console.log(count(true, "count value"), count(false, "value"));
+})()`
+	out, _ := Minify([]byte(src))
+	if expected, got := run(src), run(string(out)); got != expected {
+		t.Fatalf("got %q, want %q:\n%s", got, expected, out)
+	}
+}
+
+func TestTopLevelRefs(t *testing.T) {
+	src := []byte("a(b.a, {a: 1, b}); function f(a) { return a + c; } { let c; c; }")
+	tokens := Lex(src)
+	refs := []string{}
+	for i, ref := range TopLevelRefs(src, tokens) {
+		if ref {
+			refs = append(refs, string(src[tokens[i].Start:tokens[i].End]))
+		}
+	}
+	if expected := []string{"a", "b", "b", "f", "c"}; !reflect.DeepEqual(refs, expected) {
+		t.Fatalf("wrong references: %q", refs)
+	}
+}
@@ -0,0 +1,271 @@
+package js
+
+// Kind is the kind of a token.
+type Kind int
+
+const (
+	Ident Kind = iota
+	Number
+	String
+	Template     // a template literal without substitutions
+	TemplatePart // part of a template literal with substitutions
+	Regex
+	Punct
+)
+
+// Token locates a token in the source.
+type Token struct {
+	Kind  Kind
+	Start int
+	End   int
+}
+
+// regexKeywords are keywords after which a slash starts a regular expression.
+var regexKeywords = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true,
+	"of": true, "new": true, "delete": true, "void": true, "throw": true,
+	"case": true, "do": true, "else": true, "yield": true, "await": true,
+}
+
+type lexer struct {
+	src    []byte
+	pos    int
+	tokens []Token
+
+	// braces is the current brace depth and templates holds the brace depth
+	// at which each open template substitution started.
+	braces    int
+	templates []int
+
+	// parens holds whether each open parenthesis starts the head of an if,
+	// while, for or with statement, after which a slash starts a regular
+	// expression. header is set when the last closed one did.
+	parens []bool
+	header bool
+}
+
+// headerKeywords are followed by a parenthesized head and a statement.
+var headerKeywords = map[string]bool{
+	"if": true, "while": true, "for": true, "with": true,
+}
+
+// Lex returns the tokens of the source, skipping whitespace and comments.
+func Lex(src []byte) []Token {
+	l := &lexer{src: src}
+	for l.pos < len(l.src) {
+		l.next()
+	}
+	return l.tokens
+}
+
+func (l *lexer) emit(kind Kind, start int) {
+	l.tokens = append(l.tokens, Token{Kind: kind, Start: start, End: l.pos})
+}
+
+func (l *lexer) text(t Token) string {
+	return string(l.src[t.Start:t.End])
+}
+
+func (l *lexer) peek(offset int) byte {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+func (l *lexer) next() {
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f':
+		l.pos++
+	case c == '/' && l.peek(1) == '/':
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	case c == '/' && l.peek(1) == '*':
+		l.pos += 2
+		for l.pos < len(l.src) && !(l.src[l.pos] == '*' && l.peek(1) == '/') {
+			l.pos++
+		}
+		l.pos += 2
+		if l.pos > len(l.src) {
+			l.pos = len(l.src)
+		}
+	case c == '/' && l.regexAllowed():
+		l.regex()
+		l.emit(Regex, start)
+	case c == '\'' || c == '"':
+		l.pos++
+		l.quoted(c)
+		l.emit(String, start)
+	case c == '`':
+		l.pos++
+		l.template(start, Template)
+	case isDigit(c) || (c == '.' && isDigit(l.peek(1))):
+		l.number()
+		l.emit(Number, start)
+	case isIdent(c):
+		for l.pos < len(l.src) && (isIdent(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		l.emit(Ident, start)
+	case c == '{':
+		l.braces++
+		l.pos++
+		l.emit(Punct, start)
+	case c == '}':
+		if n := len(l.templates); n > 0 && l.templates[n-1] == l.braces {
+			l.templates = l.templates[:n-1]
+			l.pos++
+			l.template(start, TemplatePart)
+			return
+		}
+		l.braces--
+		l.pos++
+		l.emit(Punct, start)
+	case c == '(':
+		header := false
+		if n := len(l.tokens); n > 0 && l.tokens[n-1].Kind == Ident {
+			header = headerKeywords[l.text(l.tokens[n-1])]
+		}
+		l.parens = append(l.parens, header)
+		l.pos++
+		l.emit(Punct, start)
+	case c == ')':
+		l.header = false
+		if n := len(l.parens); n > 0 {
+			l.header = l.parens[n-1]
+			l.parens = l.parens[:n-1]
+		}
+		l.pos++
+		l.emit(Punct, start)
+	case (c == '+' || c == '-') && l.peek(1) == c:
+		l.pos += 2
+		l.emit(Punct, start)
+	default:
+		l.pos++
+		l.emit(Punct, start)
+	}
+}
+
+// regexAllowed returns whether a slash at the current position starts a
+// regular expression rather than a division, based on the previous token.
+func (l *lexer) regexAllowed() bool {
+	if len(l.tokens) == 0 {
+		return true
+	}
+	prev := l.tokens[len(l.tokens)-1]
+	switch prev.Kind {
+	case Ident:
+		return regexKeywords[l.text(prev)]
+	case TemplatePart:
+		return l.src[prev.End-1] == '{'
+	case Punct:
+		switch l.text(prev) {
+		case ")":
+			return l.header
+		case "]", "++", "--":
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// quoted consumes a string literal up to and including the closing quote.
+func (l *lexer) quoted(quote byte) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '\\':
+			l.pos++
+		case quote, '\n':
+			return
+		}
+	}
+	if l.pos > len(l.src) {
+		l.pos = len(l.src)
+	}
+}
+
+// template consumes template characters up to the closing backtick or the
+// start of a substitution, which is lexed as regular tokens.
+func (l *lexer) template(start int, kind Kind) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch {
+		case c == '\\':
+			l.pos++
+		case c == '`':
+			l.emit(kind, start)
+			return
+		case c == '$' && l.peek(0) == '{':
+			l.pos++
+			l.templates = append(l.templates, l.braces)
+			l.emit(TemplatePart, start)
+			return
+		}
+	}
+	if l.pos > len(l.src) {
+		l.pos = len(l.src)
+	}
+	l.emit(kind, start)
+}
+
+// regex consumes a regular expression literal including its flags.
+func (l *lexer) regex() {
+	l.pos++
+	inClass := false
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch {
+		case c == '\\':
+			l.pos++
+		case c == '\n':
+			return
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '/' && !inClass:
+			for l.pos < len(l.src) && isIdent(l.src[l.pos]) {
+				l.pos++
+			}
+			return
+		}
+	}
+	if l.pos > len(l.src) {
+		l.pos = len(l.src)
+	}
+}
+
+func (l *lexer) number() {
+	hex := l.src[l.pos] == '0' && isHex(l.peek(1))
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case isDigit(c) || isIdent(c) || c == '.':
+			l.pos++
+		case (c == '+' || c == '-') && !hex && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E'):
+			l.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isHex(c byte) bool {
+	return c == 'x' || c == 'X'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdent(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || c >= 0x80
+}
@@ -0,0 +1,233 @@
+package js
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// item is a token of the minified source, spanning several source tokens
+// once folded.
+type item struct {
+	Token
+	text string
+	// key is the property name of a shorthand property, written as key: text
+	// once the variable is renamed.
+	key string
+	// newline is set if a line break precedes the token.
+	newline bool
+}
+
+// Minify removes the whitespace and comments of the source, folds arithmetic
+// on literals and renames the variables declared in functions and blocks to
+// short names. It returns the output and the edits applied to the source.
+//
+// Newlines are kept where removing them could change automatic semicolon
+// insertion. Functions and blocks containing eval or with keep their names.
+func Minify(src []byte) ([]byte, []Edit) {
+	items := newItems(src, Lex(src))
+	items = fold(items)
+	rename(items)
+
+	edits := []Edit{}
+	end := 0
+	for i, it := range items {
+		sep := ""
+		if i > 0 {
+			sep = separator(items[i-1], it)
+		}
+		if string(src[end:it.Start]) != sep {
+			edits = append(edits, Edit{Start: end, End: it.Start, Text: sep})
+		}
+		text := it.text
+		if it.key != "" && it.key != text {
+			text = it.key + ":" + text
+		}
+		if string(src[it.Start:it.End]) != text {
+			edits = append(edits, Edit{Start: it.Start, End: it.End, Text: text})
+		}
+		end = it.End
+	}
+	if end < len(src) {
+		edits = append(edits, Edit{Start: end, End: len(src)})
+	}
+	return Apply(src, edits)
+}
+
+// newItems returns the items of the tokens of the source.
+func newItems(src []byte, tokens []Token) []item {
+	items := make([]item, len(tokens))
+	end := 0
+	for i, tok := range tokens {
+		items[i] = item{Token: tok, text: string(src[tok.Start:tok.End]), newline: i > 0 && strings.Contains(string(src[end:tok.Start]), "\n")}
+		end = tok.End
+	}
+	return items
+}
+
+// separator returns the whitespace needed between two tokens.
+func separator(prev, next item) string {
+	if next.newline && endsExpr(prev) && startsExpr(next) {
+		return "\n"
+	}
+	a, c := prev.text[len(prev.text)-1], next.text[0]
+	if next.key != "" {
+		c = next.key[0]
+	}
+	switch {
+	case isWord(a) && (isWord(c) || c == '#'):
+		return " "
+	case prev.Kind == Number && c == '.':
+		return " "
+	}
+	switch string([]byte{a, c}) {
+	case "++", "--", "//", "/*", "<!":
+		return " "
+	}
+	return ""
+}
+
+func isWord(c byte) bool {
+	return isIdent(c) || isDigit(c)
+}
+
+// endsExpr returns whether a statement may end with the token.
+func endsExpr(it item) bool {
+	switch it.Kind {
+	case Ident, Number, String, Template, Regex:
+		return true
+	case TemplatePart:
+		return strings.HasSuffix(it.text, "`")
+	}
+	switch it.text {
+	case ")", "]", "}", "++", "--":
+		return true
+	}
+	return false
+}
+
+// startsExpr returns whether a statement may start with the token.
+func startsExpr(it item) bool {
+	switch it.Kind {
+	case Ident, Number, String, Template, Regex:
+		return true
+	case TemplatePart:
+		return strings.HasPrefix(it.text, "`")
+	}
+	switch it.text {
+	case "(", "[", "{", "+", "-", "!", "~", "++", "--", "#":
+		return true
+	}
+	return false
+}
+
+// fold replaces arithmetic on number literals and concatenation of string
+// literals with their result, where operator precedence allows.
+func fold(items []item) []item {
+	text := func(i int) string {
+		if i < 0 || i >= len(items) {
+			return ""
+		}
+		return items[i].text
+	}
+	for folded := true; folded; {
+		folded = false
+		for i := 0; i+2 < len(items); i++ {
+			op := text(i + 1)
+			if len(op) != 1 || !strings.Contains("+-*/%", op) {
+				continue
+			}
+			left, right := items[i], items[i+2]
+			result, ok := "", false
+			switch {
+			case left.Kind == Number && right.Kind == Number:
+				result, ok = foldNumbers(left.text, op, right.text)
+			case left.Kind == String && right.Kind == String && op == "+" && left.text[0] == right.text[0]:
+				result, ok = left.text[:len(left.text)-1]+right.text[1:], true
+			}
+			if !ok || !foldLeft(items, i-1, op) || !foldRight(items, i+3, op) {
+				continue
+			}
+			items[i] = item{Token: Token{Kind: left.Kind, Start: left.Start, End: right.End}, text: result, newline: left.newline}
+			items = append(items[:i+1], items[i+3:]...)
+			folded = true
+		}
+	}
+	return items
+}
+
+// foldLeft returns whether the token before a folded operation binds less
+// tightly than the operator.
+func foldLeft(items []item, i int, op string) bool {
+	if i < 0 {
+		return true
+	}
+	switch items[i].text {
+	case "(", "[", ",", ";", "{", "}", ":", "?", "=", "<", ">", "&", "|", "^", "return", "case", "throw":
+		return true
+	case "+", "-":
+		// Negating a product folds the same either way.
+		return op != "+" && op != "-"
+	}
+	return false
+}
+
+// foldRight returns whether the token after a folded operation binds less
+// tightly than the operator, or as tightly and left associative.
+func foldRight(items []item, i int, op string) bool {
+	if i >= len(items) {
+		return true
+	}
+	switch items[i].text {
+	case ")", "]", ",", ";", ":", "}", "?", "=", "<", ">", "&", "|", "^", "!", "+", "-":
+		return true
+	case "*", "/", "%":
+		exp := i+1 < len(items) && items[i+1].text == "*" && items[i+1].Start == items[i].End
+		return op != "+" && op != "-" && !exp
+	}
+	return false
+}
+
+func foldNumbers(a, op, b string) (string, bool) {
+	x, ok := decimal(a)
+	if !ok {
+		return "", false
+	}
+	y, ok := decimal(b)
+	if !ok {
+		return "", false
+	}
+	var v float64
+	switch op {
+	case "+":
+		v = x + y
+	case "-":
+		v = x - y
+	case "*":
+		v = x * y
+	case "/":
+		v = x / y
+	case "%":
+		v = math.Mod(x, y)
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) || (v == 0 && math.Signbit(v)) {
+		return "", false
+	}
+	if v == math.Trunc(v) && math.Abs(v) < 1e21 {
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	if strings.Contains(s, "e") {
+		return "", false // JavaScript formats exponents differently
+	}
+	return s, true
+}
+
+// decimal parses a decimal number literal.
+func decimal(s string) (float64, bool) {
+	if strings.Trim(s, "0123456789.eE+-") != "" || (len(s) > 1 && s[0] == '0' && isDigit(s[1])) {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
@@ -0,0 +1,697 @@
+package js
+
+import (
+	"sort"
+	"strings"
+)
+
+// scope is a function, block or catch clause declaring variables, spanning
+// the items from start to end.
+type scope struct {
+	start, end int
+	parent     *scope
+	fn         bool
+	// decls are the items declaring the variables of the scope.
+	decls []int
+	// params are the parameter names of functions, defaults is set if any
+	// has a default value: variables of the body may then be shadowed in
+	// the parameters.
+	params   map[string]bool
+	defaults bool
+	// unsafe scopes end ambiguously and keep their names.
+	unsafe bool
+}
+
+// frame is an open bracket: '(' and '[', 'o' for objects, 'c' for class
+// bodies, 'b' for blocks, 'f' for function bodies and catch blocks, and '$'
+// for template substitutions.
+type frame struct {
+	kind byte
+	// ternary counts the conditional operators waiting for their colon.
+	ternary int
+}
+
+// scoper finds the scopes and the references to variables of the items.
+type scoper struct {
+	items []item
+	match []int
+
+	scopes []*scope
+	// refs marks the items referring to a variable, rather than a property.
+	refs []bool
+	// labels are never renamed, labeled statements aren't tracked.
+	labels map[string]bool
+	// ternaries marks the colons of conditional operators.
+	ternaries map[int]bool
+	// eval is set if the source uses eval or with, which may refer to any
+	// variable by name.
+	eval bool
+
+	frames []frame
+	open   []*scope
+	// bodies maps the opening brace of function bodies and catch blocks to
+	// their scope.
+	bodies map[int]*scope
+	// classes counts the class keywords waiting for their body.
+	classes int
+	// strict scopes function declarations in blocks to the block.
+	strict bool
+}
+
+// reserved are the words which can't be used as variable names.
+var reserved = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`break case catch class const continue debugger default delete do else
+		enum export extends false finally for function if import in instanceof new null return super switch
+		this throw true try typeof var void while with yield let static implements interface package private
+		protected public await arguments eval undefined NaN Infinity async of get set`) {
+		reserved[word] = true
+	}
+}
+
+// rename shortens the variables declared in functions and blocks. A
+// variable is renamed within the whole scope declaring it, including nested
+// scopes, to a name which none of the items of the scope uses.
+func rename(items []item) {
+	s := newScoper(items)
+	s.scan()
+	if s.eval {
+		return
+	}
+
+	for _, sc := range s.scopes {
+		if sc.unsafe {
+			continue
+		}
+		used := map[string]bool{}
+		counts := map[string]int{}
+		for i := sc.start; i <= sc.end && i < len(items); i++ {
+			if items[i].Kind == Ident && !s.member(i) {
+				used[items[i].text] = true
+				if s.refs[i] {
+					counts[items[i].text]++
+				}
+			}
+		}
+
+		names := []string{}
+		seen := map[string]bool{}
+		for _, d := range sc.decls {
+			name := items[d].text
+			if seen[name] || s.labels[name] || reserved[name] || (sc.defaults && !sc.params[name]) {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+		sort.SliceStable(names, func(i, j int) bool { return counts[names[i]] > counts[names[j]] })
+
+		next := 0
+		for _, name := range names {
+			short := ""
+			for {
+				short = shortName(next)
+				next++
+				if !used[short] && !reserved[short] {
+					break
+				}
+			}
+			if len(short) >= len(name) {
+				next--
+				continue
+			}
+			used[short] = true
+			for i := sc.start; i <= sc.end && i < len(items); i++ {
+				if s.refs[i] && items[i].text == name {
+					items[i].text = short
+				}
+			}
+		}
+	}
+}
+
+func newScoper(items []item) *scoper {
+	return &scoper{
+		items:     items,
+		match:     matchBrackets(items),
+		refs:      make([]bool, len(items)),
+		labels:    map[string]bool{},
+		ternaries: map[int]bool{},
+		bodies:    map[int]*scope{},
+	}
+}
+
+// TopLevelRefs returns whether each of the tokens of the source refers to a
+// variable of the top level scope: it is neither a property name nor a
+// variable declared in a function, block or catch clause around it. The
+// source is strict, as ES modules are, so functions declared in blocks are
+// scoped to the block.
+func TopLevelRefs(src []byte, tokens []Token) []bool {
+	s := newScoper(newItems(src, tokens))
+	s.strict = true
+	s.scan()
+
+	// shadows maps the declared names to the item ranges of their scopes.
+	shadows := map[string][][2]int{}
+	for _, sc := range s.scopes {
+		for _, d := range sc.decls {
+			name := s.items[d].text
+			shadows[name] = append(shadows[name], [2]int{sc.start, sc.end})
+		}
+	}
+	refs := make([]bool, len(tokens))
+	for i, ref := range s.refs {
+		if !ref || reserved[s.items[i].text] {
+			continue
+		}
+		refs[i] = true
+		for _, r := range shadows[s.items[i].text] {
+			if r[0] <= i && i <= r[1] {
+				refs[i] = false
+				break
+			}
+		}
+	}
+	return refs
+}
+
+const (
+	firstChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_$"
+	nextChars  = firstChars + "0123456789"
+)
+
+// shortName returns the nth shortest variable name.
+func shortName(n int) string {
+	name := []byte{firstChars[n%len(firstChars)]}
+	n /= len(firstChars)
+	for n > 0 {
+		n--
+		name = append(name, nextChars[n%len(nextChars)])
+		n /= len(nextChars)
+	}
+	return string(name)
+}
+
+// matchBrackets returns the index of the matching bracket of every bracket,
+// -1 for other items.
+func matchBrackets(items []item) []int {
+	match := make([]int, len(items))
+	stack := []int{}
+	for i, it := range items {
+		match[i] = -1
+		switch it.text {
+		case "(", "[", "{":
+			stack = append(stack, i)
+		case ")", "]", "}":
+			if n := len(stack); n > 0 {
+				match[i], match[stack[n-1]] = stack[n-1], i
+				stack = stack[:n-1]
+			}
+		}
+		if it.Kind == TemplatePart {
+			if it.text[0] == '}' && len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			if strings.HasSuffix(it.text, "${") {
+				stack = append(stack, i)
+			}
+		}
+	}
+	return match
+}
+
+func (s *scoper) text(i int) string {
+	if i < 0 || i >= len(s.items) {
+		return ""
+	}
+	return s.items[i].text
+}
+
+func (s *scoper) kind(i int) Kind {
+	if i < 0 || i >= len(s.items) {
+		return Punct
+	}
+	return s.items[i].Kind
+}
+
+// close returns the bracket matching the one at i, or the last item.
+func (s *scoper) close(i int) int {
+	if i >= 0 && i < len(s.match) && s.match[i] >= 0 {
+		return s.match[i]
+	}
+	return len(s.items) - 1
+}
+
+// member returns whether the identifier at i is a property access or a
+// private name.
+func (s *scoper) member(i int) bool {
+	return s.text(i-1) == "." && s.text(i-2) != "." || s.text(i-1) == "#"
+}
+
+// arrow returns whether the items at i are =>.
+func (s *scoper) arrow(i int) bool {
+	return s.text(i) == "=" && s.text(i+1) == ">" && s.items[i].End == s.items[i+1].Start
+}
+
+func (s *scoper) top() *frame {
+	if len(s.frames) == 0 {
+		return &frame{kind: 'b'}
+	}
+	return &s.frames[len(s.frames)-1]
+}
+
+// inner returns the innermost open scope, or the innermost function scope.
+func (s *scoper) inner(fn bool) *scope {
+	for i := len(s.open) - 1; i >= 0; i-- {
+		if !fn || s.open[i].fn {
+			return s.open[i]
+		}
+	}
+	return nil
+}
+
+func (s *scoper) push(sc *scope) *scope {
+	sc.parent = s.inner(false)
+	s.scopes = append(s.scopes, sc)
+	s.open = append(s.open, sc)
+	return sc
+}
+
+func (s *scoper) declare(sc *scope, decls []int) {
+	if sc != nil {
+		sc.decls = append(sc.decls, decls...)
+	}
+}
+
+// statement returns whether the item at i starts a statement.
+func (s *scoper) statement(i int) bool {
+	switch s.text(i - 1) {
+	case "", ";", "{", "}", "export":
+		return true
+	case "default":
+		return s.text(i-2) == "export"
+	case ":":
+		return s.top().kind != 'o' && !s.ternaries[i-1]
+	}
+	return s.items[i].newline && endsExpr(s.items[i-1])
+}
+
+// scan walks the items once, tracking brackets, and records the scopes,
+// declarations and references.
+func (s *scoper) scan() {
+	for i := 0; i < len(s.items); i++ {
+		for len(s.open) > 0 && s.open[len(s.open)-1].end < i {
+			s.open = s.open[:len(s.open)-1]
+		}
+		it := s.items[i]
+		text := it.text
+
+		if it.Kind == TemplatePart {
+			if text[0] == '}' && len(s.frames) > 0 {
+				s.frames = s.frames[:len(s.frames)-1]
+			}
+			if strings.HasSuffix(text, "${") {
+				s.frames = append(s.frames, frame{kind: '$'})
+			}
+			continue
+		}
+
+		switch text {
+		case "(":
+			s.paren(i)
+			s.frames = append(s.frames, frame{kind: '('})
+			continue
+		case "[":
+			s.frames = append(s.frames, frame{kind: '['})
+			continue
+		case "{":
+			s.frames = append(s.frames, frame{kind: s.brace(i)})
+			continue
+		case ")", "]", "}":
+			if len(s.frames) > 0 {
+				s.frames = s.frames[:len(s.frames)-1]
+			}
+			continue
+		case "?":
+			if s.text(i+1) != "." {
+				s.top().ternary++
+			}
+			continue
+		case ":":
+			if f := s.top(); f.ternary > 0 {
+				f.ternary--
+				s.ternaries[i] = true
+			}
+			continue
+		}
+		if it.Kind != Ident || s.member(i) {
+			continue
+		}
+
+		top := s.top()
+		prev, next := s.text(i-1), s.text(i+1)
+		if top.kind == 'o' || top.kind == 'c' {
+			if s.key(i, top.kind) {
+				continue
+			}
+		}
+
+		switch text {
+		case "eval", "with":
+			s.eval = true
+		case "break", "continue":
+			if s.kind(i+1) == Ident && s.items[i].End < s.items[i+1].Start {
+				s.labels[next] = true
+			}
+		case "var":
+			s.declare(s.inner(true), s.declarators(i+1))
+			continue
+		case "let", "const":
+			if next == "[" || next == "{" || s.kind(i+1) == Ident {
+				s.declare(s.inner(false), s.declarators(i+1))
+				continue
+			}
+		case "class":
+			s.classes++
+			if s.kind(i+1) == Ident && next != "extends" && s.statement(i) {
+				s.declare(s.inner(false), []int{i + 1})
+			}
+			continue
+		case "function":
+			n := i + 1
+			if s.text(n) == "*" {
+				n++
+			}
+			if s.kind(n) == Ident && s.text(n+1) == "(" && (s.statement(i) || (prev == "async" && s.statement(i-1))) {
+				// Declarations in blocks are hoisted in sloppy mode, only
+				// rename them in function bodies unless strict.
+				if sc := s.inner(false); sc != nil && (sc.fn || s.strict) {
+					s.declare(sc, []int{n})
+				}
+			}
+			continue
+		}
+		if next == ":" && top.ternary == 0 && (top.kind == 'b' || top.kind == 'f') && s.statement(i) {
+			s.labels[text] = true
+			continue
+		}
+		if s.arrow(i + 1) {
+			sc := s.push(&scope{start: i, fn: true, params: map[string]bool{text: true}, decls: []int{i}})
+			s.arrowBody(sc, i+3)
+		}
+		s.refs[i] = true
+	}
+}
+
+// key returns whether the identifier at i of an object literal or class body
+// is a property name or one of its modifiers, and marks shorthand properties.
+func (s *scoper) key(i int, kind byte) bool {
+	start := i
+	for modifiers[s.text(start-1)] {
+		start--
+	}
+	switch prev := s.text(start - 1); {
+	case prev == "{" || prev == ",":
+	case kind == 'c' && (prev == "}" || prev == ";" || s.items[start].newline):
+	default:
+		return false
+	}
+
+	next := s.text(i + 1)
+	if modifiers[s.text(i)] {
+		switch s.kind(i + 1) {
+		case Ident, String, Number:
+			return true
+		}
+		if next == "[" || next == "*" {
+			return true
+		}
+	}
+	if start < i {
+		return true
+	}
+	switch next {
+	case ":", "(":
+		return true
+	case "}", ",", "=", ";":
+		if kind == 'c' {
+			return true
+		}
+		if next != ";" {
+			s.items[i].key = s.items[i].text
+		}
+	}
+	return false
+}
+
+// modifiers precede the names of methods.
+var modifiers = map[string]bool{"get": true, "set": true, "async": true, "static": true, "*": true}
+
+// brace returns the kind of the brace at i.
+func (s *scoper) brace(i int) byte {
+	if _, ok := s.bodies[i]; ok {
+		return 'f'
+	}
+	if s.classes > 0 {
+		s.classes--
+		return 'c'
+	}
+	switch prev := s.text(i - 1); prev {
+	case "", ")", ";", "{", "}", "else", "try", "finally", "do":
+		s.block(i)
+		return 'b'
+	case ":":
+		if s.top().kind != 'o' && !s.ternaries[i-1] {
+			s.block(i)
+			return 'b'
+		}
+	}
+	if s.items[i].newline && endsExpr(s.items[i-1]) {
+		s.block(i)
+		return 'b'
+	}
+	return 'o'
+}
+
+// block opens the scope of a block.
+func (s *scoper) block(i int) {
+	s.push(&scope{start: i, end: s.close(i)})
+}
+
+// paren handles the parenthesis at i opening the parameters of a function,
+// a catch clause or a for statement.
+func (s *scoper) paren(i int) {
+	prev := s.text(i - 1)
+	end := s.close(i)
+	switch {
+	case prev == "catch" && !s.member(i-1):
+		body := end + 1
+		sc := s.push(&scope{start: i, end: s.close(body)})
+		s.declare(sc, s.params(i+1, end, sc))
+		// The block can't redeclare the parameter, it shares its scope.
+		s.bodies[body] = sc
+		return
+	case prev == "for" && !s.member(i-1):
+		switch s.text(i + 1) {
+		case "let", "const":
+			sc := &scope{start: i, end: s.close(end + 1)}
+			if s.text(end+1) != "{" {
+				// Statements without braces end somewhere, don't rename.
+				sc.unsafe = true
+				sc.end = end
+			}
+			s.push(sc)
+		}
+		return
+	}
+
+	if s.arrow(end + 1) {
+		sc := s.push(&scope{start: i, fn: true, params: map[string]bool{}})
+		s.declare(sc, s.params(i+1, end, sc))
+		s.arrowBody(sc, end+3)
+		return
+	}
+
+	if s.text(end+1) != "{" {
+		return
+	}
+	start := -1
+	fn := i - 1
+	if s.kind(fn) == Ident && fn > 0 && s.text(fn) != "function" {
+		fn--
+	}
+	if s.text(fn) == "*" {
+		fn--
+	}
+	switch {
+	case s.text(fn) == "function":
+		start = i
+		if fn < i-1 && !s.statement(fn) && !(s.text(fn-1) == "async" && s.statement(fn-1)) {
+			// The name of function expressions is bound in the function.
+			start = fn + 1
+			if s.text(start) == "*" {
+				start++
+			}
+		}
+	default:
+		top := s.top().kind
+		if (top == 'o' || top == 'c') && (s.kind(i-1) == Ident || s.kind(i-1) == String || s.kind(i-1) == Number || prev == "]") {
+			start = i // method
+		}
+	}
+	if start < 0 {
+		return
+	}
+	sc := s.push(&scope{start: start, end: s.close(end + 1), fn: true, params: map[string]bool{}})
+	if start < i {
+		sc.decls = append(sc.decls, start)
+	}
+	s.declare(sc, s.params(i+1, end, sc))
+	s.bodies[end+1] = sc
+}
+
+// arrowBody sets the end of an arrow function whose body starts at i. The
+// end of an expression body is ambiguous when a line may continue it.
+func (s *scoper) arrowBody(sc *scope, i int) {
+	if s.text(i) == "{" {
+		sc.end = s.close(i)
+		s.bodies[i] = sc
+		return
+	}
+	ternary, templates := 0, 0
+	j := i
+body:
+	for ; j < len(s.items); j++ {
+		if j > i && s.items[j].newline && endsExpr(s.items[j-1]) {
+			switch text := s.text(j); {
+			case text == "(" || text == "[" || text == "+" || text == "-" || text == "/" || s.kind(j) == Template || s.kind(j) == TemplatePart:
+				sc.unsafe = true
+			case text == "in" || text == "instanceof":
+			case startsExpr(s.items[j]):
+				break body
+			}
+		}
+		switch s.text(j) {
+		case "(", "[", "{":
+			j = s.close(j)
+		case ",", ";", ")", "]", "}":
+			break body
+		case "?":
+			if s.text(j+1) != "." {
+				ternary++
+			}
+		case ":":
+			if ternary == 0 {
+				break body
+			}
+			ternary--
+		default:
+			if s.kind(j) != TemplatePart {
+				break
+			}
+			if s.text(j)[0] == '}' {
+				if templates == 0 {
+					break body
+				}
+				templates--
+			}
+			if strings.HasSuffix(s.text(j), "${") {
+				templates++
+			}
+		}
+	}
+	sc.end = j - 1
+}
+
+// params returns the items declaring the parameters between start and end.
+func (s *scoper) params(start, end int, sc *scope) []int {
+	decls := []int{}
+	for i := start; i < end; {
+		if s.text(i) == "." && s.text(i+1) == "." && s.text(i+2) == "." {
+			i += 3
+		}
+		i = s.pattern(i, &decls, sc)
+		if s.text(i) == "=" {
+			sc.defaults = true
+			i = s.skip(i+1, end)
+		}
+		if s.text(i) == "," {
+			i++
+		} else if i < end {
+			break
+		}
+	}
+	for _, d := range decls {
+		if sc.params != nil {
+			sc.params[s.text(d)] = true
+		}
+	}
+	return decls
+}
+
+// declarators returns the items declared by the declaration list at i.
+func (s *scoper) declarators(i int) []int {
+	decls := []int{}
+	for i < len(s.items) {
+		i = s.pattern(i, &decls, nil)
+		if s.text(i) == "=" {
+			i = s.skip(i+1, len(s.items))
+		}
+		if s.text(i) != "," {
+			return decls
+		}
+		i++
+	}
+	return decls
+}
+
+// pattern collects the identifiers bound by a binding pattern at i and
+// returns the item after it.
+func (s *scoper) pattern(i int, decls *[]int, sc *scope) int {
+	switch s.text(i) {
+	case "{", "[":
+		end := s.close(i)
+		for j := i + 1; j < end; {
+			switch {
+			case s.text(j) == ",":
+				j++
+				continue
+			case s.text(j) == "." && s.text(j+1) == "." && s.text(j+2) == ".":
+				j += 3
+			case s.text(i) == "{" && s.text(j) == "[":
+				j = s.close(j) + 2
+			case s.text(i) == "{" && s.text(j+1) == ":":
+				j += 2
+			}
+			j = s.pattern(j, decls, sc)
+			if s.text(j) == "=" {
+				if sc != nil {
+					sc.defaults = true
+				}
+				j = s.skip(j+1, end)
+			}
+			if s.text(j) != "," && j < end {
+				break
+			}
+		}
+		return end + 1
+	}
+	if s.kind(i) == Ident {
+		*decls = append(*decls, i)
+	}
+	return i + 1
+}
+
+// skip returns the next comma or semicolon at the depth of i, or the end.
+func (s *scoper) skip(i, end int) int {
+	for ; i < end; i++ {
+		switch s.text(i) {
+		case "(", "[", "{":
+			i = s.close(i)
+		case ",", ";", ")", "]", "}":
+			return i
+		}
+	}
+	return i
+}
@@ -1,22 +1,291 @@
 package linker
 
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
 
+// A Bundler splits the files of a bundle into its chunks.
+type Bundler interface {
+	Bundle(b *Bundle) error
+}
+
+// BundlerFunc adapts a function to the Bundler interface.
+type BundlerFunc func(b *Bundle) error
+
+func (f BundlerFunc) Bundle(b *Bundle) error {
+	return f(b)
+}
+
+// Bundlers are the built-in chunking strategies by name.
+var Bundlers = map[string]Bundler{
+	"entry":   BundlerFunc(StandardBundler),
+	"shared":  BundlerFunc(SharedBundler),
+	"package": BundlerFunc(PackageBundler),
+}
+
+// StandardBundler bundles every file into the chunk of each entrypoint which
+// reaches it.
 func StandardBundler(b *Bundle) error {
+	return split(b, func(name string, entrypoints []string) (string, string) {
+		return "", ""
+	})
+}
+
+// SharedBundler groups files by the set of entrypoints which reach them. Files
+// reached by a single entrypoint are bundled into its chunk, files reached by
+// several are extracted into a shared chunk per set of entrypoints, with
+// node_modules split into a separate vendor chunk. Entrypoint chunks load
+// their shared chunks before starting.
+func SharedBundler(b *Bundle) error {
+	return split(b, shared)
+}
+
+// PackageBundler extracts every package in node_modules into its own chunk,
+// loaded by each entrypoint using the package. Other files are grouped like
+// the SharedBundler does.
+func PackageBundler(b *Bundle) error {
+	return split(b, func(name string, entrypoints []string) (string, string) {
+		if pkg := packageName(name); pkg != "" {
+			return "package:" + pkg, strings.Replace(strings.TrimPrefix(pkg, "@"), "/", "-", -1)
+		}
+		return shared(name, entrypoints)
+	})
+}
+
+func shared(name string, entrypoints []string) (string, string) {
+	if len(entrypoints) < 2 {
+		return "", ""
+	}
+	prefix := "shared"
+	if packageName(name) != "" {
+		prefix = "vendor"
+	}
+	return prefix + ":" + strings.Join(entrypoints, ","), prefix
+}
+
+// SizeBundler splits the entrypoint and shared chunks of another bundler into
+// parts of at most MaxSize bytes. Chunks consisting of a single larger file
+// are kept whole and async chunks are never split.
+type SizeBundler struct {
+	Bundler Bundler
+	MaxSize int64
+}
+
+func (s *SizeBundler) Bundle(b *Bundle) error {
+	if err := s.Bundler.Bundle(b); err != nil {
+		return err
+	}
+	if s.MaxSize <= 0 {
+		return nil
+	}
+
+	chunks := []*Chunk{}
+	replaced := map[string][]string{}
+	for _, c := range b.Chunks {
+		if c.Entrypoint != "" || c.Dynamic != "" {
+			continue
+		}
+		output := c.Output()
+		parts := s.split(b.Root, c, c.Name)
+		for _, part := range parts {
+			replaced[output] = append(replaced[output], part.Output())
+		}
+		chunks = append(chunks, parts...)
+	}
+	for _, c := range b.Chunks {
+		if c.Entrypoint == "" {
+			continue
+		}
+		loads := []string{}
+		for _, load := range c.Loads {
+			if parts, ok := replaced[load]; ok {
+				loads = append(loads, parts...)
+			} else {
+				loads = append(loads, load)
+			}
+		}
+		c.Loads = loads
+		parts := s.split(b.Root, c, strings.Split(filepath.Base(c.Entrypoint), ".")[0])
+		for _, part := range parts[1:] {
+			c.Loads = append(c.Loads, part.Output())
+		}
+		chunks = append(chunks, parts...)
+	}
+	for _, c := range b.Chunks {
+		if c.Dynamic != "" {
+			chunks = append(chunks, c)
+		}
+	}
+	b.Chunks = chunks
+	return nil
+}
+
+// split moves files of the chunk exceeding the maximum size into new chunks,
+// returning the chunk followed by the new ones.
+func (s *SizeBundler) split(root string, c *Chunk, name string) []*Chunk {
+	parts := []*Chunk{c}
+	size := int64(0)
+	for _, file := range c.Files.Keys() {
+		var fileSize int64
+		if st, err := os.Stat(filepath.Join(root, file)); err == nil {
+			fileSize = st.Size()
+		}
+		last := parts[len(parts)-1]
+		if size > 0 && size+fileSize > s.MaxSize {
+			last = &Chunk{Name: name, Files: Files{}}
+			parts = append(parts, last)
+			size = 0
+		}
+		size += fileSize
+		if last != c {
+			last.Files[file] = c.Files[file]
+			delete(c.Files, file)
+		}
+	}
+	return parts
+}
+
+// split creates a chunk for every entrypoint and async module and bundles
+// the files into them. The group func returns the key and output prefix of
+// the shared chunk a file reached by the given entrypoints is extracted
+// into, or an empty key to bundle the file into each entrypoint chunk.
+// Shared chunks are loaded by every entrypoint reaching any of their files.
+func split(b *Bundle, group func(name string, entrypoints []string) (string, string)) error {
 	chunks := map[string]*Chunk{}
 	for _, entrypoint := range b.Entrypoints {
 		chunks[entrypoint] = &Chunk{
 			Entrypoint: entrypoint,
-			Files: Files{},
+			Files:      Files{},
+		}
+	}
+	for _, module := range b.Async {
+		chunks[module] = &Chunk{
+			Dynamic: module,
+			Files:   Files{},
 		}
 	}
+
+	shared := map[string]*Chunk{}
+	loaders := map[string]map[string]bool{}
 	for name, file := range b.Files {
-		for _, entrypoint := range file.Entrypoints {
-			chunks[entrypoint].Files[name] = file
+		entrypoints := []string{}
+		for _, root := range file.Entrypoints {
+			if chunks[root].Entrypoint != "" {
+				entrypoints = append(entrypoints, root)
+			} else {
+				chunks[root].Files[name] = file
+			}
 		}
+		if len(entrypoints) == 0 {
+			continue
+		}
+
+		sort.Strings(entrypoints)
+		key, prefix := group(name, entrypoints)
+		if key == "" {
+			for _, entrypoint := range entrypoints {
+				chunks[entrypoint].Files[name] = file
+			}
+			continue
+		}
+		c, ok := shared[key]
+		if !ok {
+			c = &Chunk{Name: prefix, Files: Files{}}
+			shared[key] = c
+			loaders[key] = map[string]bool{}
+		}
+		c.Files[name] = file
+		for _, entrypoint := range entrypoints {
+			loaders[key][entrypoint] = true
+		}
+	}
+
+	keys := []string{}
+	for key := range shared {
+		keys = append(keys, key)
 	}
-	for _, c := range chunks {
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := shared[key]
+		output := c.Output()
+		for _, entrypoint := range b.Entrypoints {
+			if loaders[key][entrypoint] {
+				chunks[entrypoint].Loads = append(chunks[entrypoint].Loads, output)
+			}
+		}
 		b.Chunks = append(b.Chunks, c)
 	}
+
+	linkAsync(b, chunks)
+	for _, root := range b.Roots() {
+		if c := chunks[root]; c.Entrypoint != "" || len(c.Files) > 0 {
+			b.Chunks = append(b.Chunks, c)
+		}
+	}
 	return nil
 }
 
+// packageName returns the name of the node_modules package containing the
+// file, or an empty string for files outside of node_modules.
+func packageName(name string) string {
+	i := strings.LastIndex("/"+name, "/node_modules/")
+	if i < 0 {
+		return ""
+	}
+	parts := strings.Split(name[i+len("node_modules/"):], "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	if strings.HasPrefix(parts[0], "@") && len(parts) > 2 {
+		return parts[0] + "/" + parts[1]
+	}
+	return parts[0]
+}
+
+// linkAsync removes the files every importer of an async chunk has already
+// loaded from the chunk, and fills the table of async chunks of each
+// entrypoint chunk. Chunks are keyed by entrypoint or async module.
+func linkAsync(b *Bundle, chunks map[string]*Chunk) {
+	importers := map[string][]string{}
+	for _, root := range b.Roots() {
+		for _, module := range b.Dynamic[root] {
+			importers[module] = append(importers[module], root)
+		}
+	}
+	for _, module := range b.Async {
+		c := chunks[module]
+		for name := range c.Files {
+			loaded := len(importers[module]) > 0
+			for _, importer := range importers[module] {
+				if !b.Files.Has(name, importer) {
+					loaded = false
+				}
+			}
+			if loaded {
+				delete(c.Files, name)
+			}
+		}
+	}
+
+	for _, entrypoint := range b.Entrypoints {
+		c := chunks[entrypoint]
+		c.Async = map[string]string{}
+		seen := map[string]bool{}
+		queue := append([]string{}, b.Dynamic[entrypoint]...)
+		for len(queue) > 0 {
+			module := queue[0]
+			queue = queue[1:]
+			if seen[module] {
+				continue
+			}
+			seen[module] = true
+			if async, ok := chunks[module]; ok && async.Dynamic != "" && len(async.Files) > 0 {
+				c.Async[module] = async.Output()
+			}
+			queue = append(queue, b.Dynamic[module]...)
+		}
+	}
+}
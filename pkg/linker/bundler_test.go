@@ -0,0 +1,188 @@
+package linker
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// bundlerGraph has two entrypoints sharing application code and packages, and
+// an async module.
+var bundlerGraph = map[string][]string{
+	"src/a.js":                       {"src/shared.js", "node_modules/react/index.js"},
+	"src/b.js":                       {"src/shared.js", "src/only-b.js", "node_modules/react/index.js", "node_modules/@x/y/index.js"},
+	"src/page.js":                    {"src/shared.js", "node_modules/left-pad/index.js"},
+	"src/shared.js":                  {},
+	"src/only-b.js":                  {},
+	"node_modules/react/index.js":    {"node_modules/react/lib.js"},
+	"node_modules/react/lib.js":      {},
+	"node_modules/@x/y/index.js":     {},
+	"node_modules/left-pad/index.js": {},
+}
+
+// chunkFiles returns the files of every chunk keyed by its name.
+func chunkFiles(b *Bundle) map[string][]string {
+	files := map[string][]string{}
+	for _, c := range b.Chunks {
+		name := c.Entrypoint + c.Dynamic
+		if name == "" {
+			name = c.Name
+		}
+		files[name] = c.Files.Keys()
+	}
+	return files
+}
+
+func TestBundlers(t *testing.T) {
+	root := writeDynamicObjects(t, bundlerGraph, map[string][]string{"src/a.js": {"src/page.js"}})
+	defer os.RemoveAll(root)
+
+	for _, test := range []struct {
+		bundler string
+		files   map[string][]string
+		loads   map[string][]string
+	}{
+		{
+			bundler: "entry",
+			files: map[string][]string{
+				"src/a.js":    {"node_modules/react/index.js", "node_modules/react/lib.js", "src/a.js", "src/shared.js"},
+				"src/b.js":    {"node_modules/@x/y/index.js", "node_modules/react/index.js", "node_modules/react/lib.js", "src/b.js", "src/only-b.js", "src/shared.js"},
+				"src/page.js": {"node_modules/left-pad/index.js", "src/page.js"},
+			},
+			loads: map[string][]string{},
+		},
+		{
+			bundler: "shared",
+			files: map[string][]string{
+				"shared":      {"src/shared.js"},
+				"vendor":      {"node_modules/react/index.js", "node_modules/react/lib.js"},
+				"src/a.js":    {"src/a.js"},
+				"src/b.js":    {"node_modules/@x/y/index.js", "src/b.js", "src/only-b.js"},
+				"src/page.js": {"node_modules/left-pad/index.js", "src/page.js"},
+			},
+			loads: map[string][]string{
+				"src/a.js": {"shared", "vendor"},
+				"src/b.js": {"shared", "vendor"},
+			},
+		},
+		{
+			bundler: "package",
+			files: map[string][]string{
+				"x-y":         {"node_modules/@x/y/index.js"},
+				"react":       {"node_modules/react/index.js", "node_modules/react/lib.js"},
+				"shared":      {"src/shared.js"},
+				"src/a.js":    {"src/a.js"},
+				"src/b.js":    {"src/b.js", "src/only-b.js"},
+				"src/page.js": {"node_modules/left-pad/index.js", "src/page.js"},
+			},
+			loads: map[string][]string{
+				"src/a.js": {"react", "shared"},
+				"src/b.js": {"x-y", "react", "shared"},
+			},
+		},
+	} {
+		b := &Bundle{Root: root, Entrypoints: []string{"src/a.js", "src/b.js"}}
+		if err := b.Find(); err != nil {
+			t.Fatalf("failed: %v", err)
+		}
+		if err := Bundlers[test.bundler].Bundle(b); err != nil {
+			t.Fatalf("%s failed: %v", test.bundler, err)
+		}
+		if files := chunkFiles(b); !reflect.DeepEqual(files, test.files) {
+			t.Fatalf("%s chunks: %v", test.bundler, files)
+		}
+
+		loads := map[string][]string{}
+		for _, c := range b.Chunks {
+			for _, load := range c.Loads {
+				prefix := strings.Split(load, "-")[0]
+				if strings.HasPrefix(load, "x-y-") {
+					prefix = "x-y"
+				}
+				loads[c.Entrypoint] = append(loads[c.Entrypoint], prefix)
+			}
+		}
+		if !reflect.DeepEqual(loads, test.loads) {
+			t.Fatalf("%s loads: %v", test.bundler, loads)
+		}
+	}
+}
+
+func TestSizeBundler(t *testing.T) {
+	// Every file is 12 bytes: "// src/x.js\n".
+	root := writeObjects(t, map[string][]string{
+		"src/a.js": {"src/w.js", "src/x.js", "src/y.js"},
+		"src/w.js": {},
+		"src/x.js": {},
+		"src/y.js": {},
+	})
+	defer os.RemoveAll(root)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/a.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	bundler := &SizeBundler{Bundler: Bundlers["entry"], MaxSize: 24}
+	if err := bundler.Bundle(b); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if len(b.Chunks) != 2 {
+		t.Fatalf("chunks: %d", len(b.Chunks))
+	}
+	entry, part := b.Chunks[0], b.Chunks[1]
+	if !reflect.DeepEqual(entry.Files.Keys(), []string{"src/a.js", "src/w.js"}) {
+		t.Fatalf("entry chunk: %v", entry.Files.Keys())
+	}
+	if !reflect.DeepEqual(part.Files.Keys(), []string{"src/x.js", "src/y.js"}) {
+		t.Fatalf("split chunk: %v", part.Files.Keys())
+	}
+	if !reflect.DeepEqual(entry.Loads, []string{part.Output()}) {
+		t.Fatalf("entry loads: %v", entry.Loads)
+	}
+}
+
+func TestSharedBundler(t *testing.T) {
+	root := writeObjects(t, map[string][]string{
+		"src/a.js":                    {"src/shared.js", "node_modules/react/index.js"},
+		"src/b.js":                    {"src/shared.js", "src/only-b.js", "node_modules/react/index.js"},
+		"src/shared.js":               {},
+		"src/only-b.js":               {},
+		"node_modules/react/index.js": {},
+	})
+	defer os.RemoveAll(root)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/a.js", "src/b.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := SharedBundler(b); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	members := [][]string{}
+	for _, c := range b.Chunks {
+		members = append(members, c.Files.Keys())
+	}
+	expected := [][]string{
+		{"src/shared.js"},
+		{"node_modules/react/index.js"},
+		{"src/a.js"},
+		{"src/b.js", "src/only-b.js"},
+	}
+	if !reflect.DeepEqual(members, expected) {
+		t.Fatalf("chunks: %v", members)
+	}
+	loads := []string{b.Chunks[0].Output(), b.Chunks[1].Output()}
+	if !strings.HasPrefix(loads[0], "shared-") || !strings.HasPrefix(loads[1], "vendor-") {
+		t.Fatalf("shared outputs: %v", loads)
+	}
+	for _, c := range b.Chunks[2:] {
+		if !reflect.DeepEqual(c.Loads, loads) {
+			t.Fatalf("%s loads: %v", c.Entrypoint, c.Loads)
+		}
+	}
+	if err := b.Write(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+}
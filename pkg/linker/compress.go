@@ -0,0 +1,98 @@
+package linker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coldog/jsbld/pkg/brotli"
+)
+
+// Compression formats, named by the extension of the siblings they write.
+const (
+	Gzip   = ".gz"
+	Brotli = ".br"
+)
+
+var encoders = map[string]func(data []byte) ([]byte, error){
+	Gzip: func(data []byte) ([]byte, error) {
+		buf := &bytes.Buffer{}
+		w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+	Brotli: func(data []byte) ([]byte, error) {
+		return brotli.Encode(data), nil
+	},
+}
+
+func checkFormats(formats []string) error {
+	for _, format := range formats {
+		if encoders[format] == nil {
+			return fmt.Errorf("unknown compression format %q", format)
+		}
+	}
+	return nil
+}
+
+// compress writes a sibling of every output file, relative to the root, in
+// every format of the bundle. Smaller files than CompressMinSize get none,
+// and their stale siblings are removed.
+func (b *Bundle) compress(names []string) error {
+	if err := checkFormats(b.Compress); err != nil {
+		return err
+	}
+	for _, name := range names {
+		for _, format := range b.Compress {
+			if err := b.compressFile(name, format); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// compressChunk compresses a written chunk and its source map, if any.
+func (b *Bundle) compressChunk(output, format string) error {
+	names := []string{output}
+	if _, err := os.Stat(filepath.Join(b.Root, output+".map")); err == nil {
+		names = append(names, output+".map")
+	}
+	for _, name := range names {
+		if err := b.compressFile(name, format); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (b *Bundle) compressFile(name, format string) error {
+	path := filepath.Join(b.Root, name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) < b.CompressMinSize {
+		err := os.Remove(path + format)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	out, err := encoders[format](data)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+format, out, 0666)
+}
@@ -0,0 +1,103 @@
+var hotData = {};
+var hotHandlers = {};
+
+hot = function(module) {
+  var handlers = { accepted: false, accept: [], dispose: [] };
+  hotHandlers[module.name] = handlers;
+  return {
+    data: hotData[module.name],
+    accept: function(cb) {
+      handlers.accepted = true;
+      if (cb) {
+        handlers.accept.push(cb);
+      }
+    },
+    dispose: function(cb) {
+      handlers.dispose.push(cb);
+    }
+  };
+};
+
+// Applies new module factories. Every module between an updated module and
+// the nearest accepting module is disposed and removed from the cache, then
+// the accepting modules are executed again. Returns false if an update
+// reaches a module with no importers that does not accept it.
+function hotApply(updates) {
+  var invalid = {};
+  var accepting = {};
+
+  function invalidate(name) {
+    if (invalid[name]) {
+      return true;
+    }
+    invalid[name] = true;
+    if (!cache[name]) {
+      return true;
+    }
+    var handlers = hotHandlers[name];
+    if (handlers && handlers.accepted) {
+      accepting[name] = handlers;
+      return true;
+    }
+    var importers = Object.keys(parents[name] || {});
+    if (importers.length === 0) {
+      return false;
+    }
+    for (var i = 0; i < importers.length; i++) {
+      if (!invalidate(importers[i])) {
+        return false;
+      }
+    }
+    return true;
+  }
+
+  var names = Object.keys(updates);
+  for (var i = 0; i < names.length; i++) {
+    if (!invalidate(names[i])) {
+      return false;
+    }
+  }
+
+  names.forEach(function(name) {
+    modules[name] = new Function('module', 'exports', 'require', updates[name]);
+  });
+  Object.keys(invalid).forEach(function(name) {
+    var handlers = hotHandlers[name];
+    var data = {};
+    if (handlers) {
+      handlers.dispose.forEach(function(cb) { cb(data); });
+    }
+    hotData[name] = data;
+    delete hotHandlers[name];
+    delete cache[name];
+  });
+  Object.keys(accepting).forEach(function(name) {
+    require(name);
+    accepting[name].accept.forEach(function(cb) { cb(); });
+  });
+  return true;
+}
+
+(function() {
+  if (typeof EventSource === 'undefined') {
+    return;
+  }
+  var source = new EventSource(devServer);
+  source.addEventListener('reload', function() {
+    window.location.reload();
+  });
+  source.addEventListener('update', function(e) {
+    var applied = false;
+    try {
+      applied = hotApply(JSON.parse(e.data));
+    } catch (err) {
+      console.error('jsbld: hot update failed', err);
+    }
+    if (!applied) {
+      window.location.reload();
+    }
+  });
+  source.addEventListener('failed', function(e) {
+    console.error('jsbld: rebuild failed\n' + e.data);
+  });
+})();
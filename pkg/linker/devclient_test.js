@@ -0,0 +1,140 @@
+// Tests of the hot updates of devclient.js, run with node by TestDevClient
+// which defines runtimeSource and devClientSource. Every test instantiates the
+// runtime and the dev client with a fake event stream.
+
+// newPage returns a page running the runtime and the dev client, with the
+// modules defined before the runtime starts. Modules log their runs to
+// page.runs.
+function newPage(modules) {
+  var page = { window: { location: {} }, runs: [], reloads: 0, listeners: {} };
+  page.window.__modules__ = modules(page);
+  page.window.location.reload = function() {
+    page.reloads++;
+  };
+  var document = { currentScript: { src: 'https://cdn.test/js/main.js' } };
+  var EventSource = function(url) {
+    page.url = url;
+  };
+  EventSource.prototype.addEventListener = function(name, fn) {
+    page.listeners[name] = fn;
+  };
+  var setTimeout = function() {
+    throw new Error('unexpected timer');
+  };
+  var runtime = new Function('window', 'document', 'setTimeout', 'EventSource', 'devServer',
+    runtimeSource + devClientSource + '\nreturn { require: require };');
+  page.runtime = runtime(page.window, document, setTimeout, EventSource, '/events');
+
+  // update sends an update event with the sources of the new factories,
+  // which refer to the page as a global.
+  page.update = function(updates) {
+    global.page = page;
+    page.runs = [];
+    page.listeners.update({ data: JSON.stringify(updates) });
+  };
+  return page;
+}
+
+// counter returns the modules of a page where main.js renders app.js, which
+// keeps a count across updates and accepts updates of itself and view.js.
+function counter(page) {
+  return {
+    'main.js': function(module, exports, require) {
+      page.runs.push('main');
+      page.app = require('app.js');
+    },
+    'app.js': function(module, exports, require) {
+      page.runs.push('app');
+      var state = module.hot.data || { count: 0 };
+      state.count++;
+      module.hot.accept();
+      module.hot.dispose(function(data) {
+        data.count = state.count;
+      });
+      exports.render = function() {
+        return require('view.js')(state.count);
+      };
+      page.render = exports.render;
+    },
+    'view.js': function(module) {
+      page.runs.push('view');
+      module.exports = function(count) {
+        return 'count ' + count;
+      };
+    }
+  };
+}
+
+function assertEqual(actual, expected, what) {
+  var a = JSON.stringify(actual);
+  var e = JSON.stringify(expected);
+  if (a !== e) {
+    throw new Error(what + ': got ' + a + ', want ' + e);
+  }
+}
+
+var tests = {
+  'accepting modules run again with the data of their previous run': function() {
+    var page = newPage(counter);
+    page.runtime.require('main.js');
+    assertEqual(page.runs, ['main', 'app'], 'runs');
+    assertEqual(page.render(), 'count 1', 'render');
+    assertEqual(page.url, '/events', 'url');
+
+    page.update({
+      'view.js': "page.runs.push('view 2'); module.exports = function(count) { return 'clicks ' + count; };"
+    });
+    assertEqual(page.runs, ['app'], 'runs after update');
+    assertEqual(page.render(), 'clicks 2', 'render after update');
+    assertEqual(page.reloads, 0, 'reloads');
+  },
+
+  'importers of accepting modules are not run again': function() {
+    var page = newPage(counter);
+    page.runtime.require('main.js');
+    var app = page.app;
+
+    page.update({
+      'app.js': "page.runs.push('app 2'); var state = module.hot.data; module.hot.accept();" +
+        "exports.render = function() { return require('view.js')(state.count * 10); }; page.render = exports.render;"
+    });
+    assertEqual(page.runs, ['app 2'], 'runs after update');
+    assertEqual(page.render(), 'count 10', 'render after update');
+    if (page.app !== app) {
+      throw new Error('main holds new exports');
+    }
+    assertEqual(page.reloads, 0, 'reloads');
+  },
+
+  'updates no module accepts reload the page': function() {
+    var page = newPage(counter);
+    page.runtime.require('main.js');
+
+    page.update({ 'main.js': "page.runs.push('main 2');" });
+    assertEqual(page.runs, [], 'runs after update');
+    assertEqual(page.reloads, 1, 'reloads');
+    assertEqual(page.runtime.require('main.js'), {}, 'cached main');
+  },
+
+  'updates of modules not run yet only replace them': function() {
+    var page = newPage(counter);
+    page.runtime.require('view.js');
+    page.update({ 'app.js': "page.runs.push('app 2');" });
+    assertEqual(page.runs, [], 'runs after update');
+    assertEqual(page.reloads, 0, 'reloads');
+    page.runtime.require('app.js');
+    assertEqual(page.runs, ['app 2'], 'runs after require');
+  }
+};
+
+var failures = 0;
+Object.keys(tests).forEach(function(name) {
+  try {
+    tests[name]();
+    console.log('ok   ' + name);
+  } catch (err) {
+    failures++;
+    console.log('FAIL ' + name + ': ' + (err && err.stack || err));
+  }
+});
+process.exit(failures > 0 ? 1 : 0);
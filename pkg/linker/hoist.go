@@ -0,0 +1,694 @@
+package linker
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coldog/jsbld/pkg/compiler"
+	"github.com/coldog/jsbld/pkg/js"
+	"github.com/coldog/jsbld/pkg/sourcemap"
+)
+
+// Scope hoisting concatenates ES modules into the factory of the module
+// importing them, dropping their wrappers and the member accesses on their
+// exports. A module is inlined when:
+//
+//   - it is an ES module of the chunk which is not an entrypoint, not loaded
+//     with import() and not part of a cycle,
+//   - every importer is an ES module of the chunk in the same scope, which
+//     does not also require() it,
+//   - importers only access its exports by name, not as a namespace,
+//   - it does not use module, exports, eval or arguments, or export *.
+//
+// Top level declarations colliding with identifiers of other modules in the
+// scope are renamed. Other modules keep their wrappers.
+
+// hoister decides which modules of a chunk are concatenated.
+type hoister struct {
+	// files are all files of the bundle, used to find the importers of a
+	// module in other chunks.
+	files Files
+	// roots are the entrypoints and async modules, which are always loaded
+	// by name.
+	roots map[string]bool
+}
+
+// scope is the factory registered for a module and the modules concatenated
+// into it, in evaluation order and ending with the module itself.
+type scope struct {
+	name    string
+	modules []hoisted
+}
+
+type hoisted struct {
+	name      string
+	code      []byte
+	sourceMap *sourcemap.Map
+}
+
+// module is a parsed ES module.
+type module struct {
+	name      string
+	src       []byte
+	sourceMap *sourcemap.Map
+	tokens    []js.Token
+	imports   []compiler.Binding
+	exports   []compiler.Binding
+
+	// esm is the require.esm() statement of the header.
+	esm   *js.Edit
+	specs []spec
+	// stars are the require.star() statements of the header, named by the
+	// variable of the module.
+	stars []spec
+	// body is the first token after the header.
+	body int
+	// requires are modules required outside the header.
+	requires map[string]bool
+	// safe is false for modules which can't be inlined into another scope.
+	safe bool
+
+	// renames maps top level declarations to their names in the scope.
+	renames map[string]string
+}
+
+// spec is a var statement of the header requiring a module.
+type spec struct {
+	name   string
+	source string
+	start  int
+	end    int
+}
+
+func (h *hoister) scopes(load loader, files Files) ([]*scope, error) {
+	modules := map[string]*module{}
+	for _, name := range files.Keys() {
+		if files[name].Module == nil {
+			continue
+		}
+		src, sourceMap, err := load(name)
+		if err != nil {
+			return nil, err
+		}
+		modules[name] = parseModule(name, src, files[name].Module)
+		modules[name].sourceMap = sourceMap
+	}
+
+	importers := map[string][]string{}
+	for _, name := range h.files.Keys() {
+		seen := map[string]bool{}
+		for _, imp := range h.files[name].Imports {
+			if !seen[imp] {
+				seen[imp] = true
+				importers[imp] = append(importers[imp], name)
+			}
+		}
+	}
+
+	// Visit importers before the modules they import, so that the scope of
+	// every importer is known.
+	order, cyclic := sortModules(files, modules)
+	scopeOf := map[string]string{}
+	for _, name := range order {
+		scopeOf[name] = name
+		if !cyclic[name] && h.inlinable(modules, importers, scopeOf, name) {
+			scopeOf[name] = scopeOf[importers[name][0]]
+		}
+	}
+
+	scopes := []*scope{}
+	for _, name := range files.Keys() {
+		m := modules[name]
+		if m == nil {
+			code, sourceMap, err := load(name)
+			if err != nil {
+				return nil, err
+			}
+			scopes = append(scopes, &scope{name: name, modules: []hoisted{{name, code, sourceMap}}})
+			continue
+		}
+		if scopeOf[name] != name {
+			continue
+		}
+
+		members := []*module{}
+		visited := map[string]bool{}
+		var visit func(m *module)
+		visit = func(m *module) {
+			visited[m.name] = true
+			for _, s := range m.specs {
+				if t := modules[s.source]; t != nil && !visited[s.source] && scopeOf[s.source] == name && s.source != name {
+					visit(t)
+				}
+			}
+			members = append(members, m)
+		}
+		visit(m)
+
+		rename(members)
+		s := &scope{name: name}
+		for _, member := range members {
+			code, sourceMap, err := member.hoist(modules, scopeOf, member.name == name)
+			if err != nil {
+				return nil, err
+			}
+			s.modules = append(s.modules, hoisted{member.name, code, sourceMap})
+		}
+		scopes = append(scopes, s)
+	}
+	return scopes, nil
+}
+
+// inlinable returns whether the module can be concatenated into the scope of
+// its importers.
+func (h *hoister) inlinable(modules map[string]*module, importers map[string][]string, scopeOf map[string]string, name string) bool {
+	m := modules[name]
+	if m == nil || !m.safe || h.roots[name] || len(importers[name]) == 0 {
+		return false
+	}
+	scope := ""
+	for _, imp := range importers[name] {
+		im := modules[imp]
+		if im == nil || im.requires[name] {
+			return false
+		}
+		if scope != "" && scopeOf[imp] != scope {
+			return false
+		}
+		scope = scopeOf[imp]
+		if scope == "" {
+			return false
+		}
+		if !im.namedAccess(modules, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// namedAccess returns whether the module only accesses the exports of the
+// imported module by name.
+func (m *module) namedAccess(modules map[string]*module, imported string) bool {
+	vars := map[string]bool{}
+	for _, s := range m.specs {
+		if s.source == imported {
+			vars[s.name] = true
+		}
+	}
+	if len(vars) == 0 {
+		return false
+	}
+	for i, tok := range m.tokens {
+		if tok.Kind != js.Ident || !vars[m.text(i)] || m.isMember(i) {
+			continue
+		}
+		if m.text(i-1) == "var" {
+			continue // the spec declaration
+		}
+		if m.text(i+1) != "." || m.kind(i+2) != js.Ident {
+			return false
+		}
+		if _, ok := binding(modules[imported], modules, m.text(i+2), nil); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// binding returns the expression referring to an export of the module, or
+// false if the module does not declare it. Exports re-exported from modules
+// inlined in the same scope resolve to their binding in that module.
+func binding(m *module, modules map[string]*module, name string, scopeOf map[string]string) (string, bool) {
+	for _, e := range m.exports {
+		if e.Name != name {
+			continue
+		}
+		if e.Source == "" {
+			// Imported bindings exported again are re-exports.
+			for _, imp := range m.imports {
+				if imp.Local == e.Local && imp.Source != "" {
+					e = compiler.Binding{Name: e.Name, Local: imp.Name, Source: imp.Source}
+					if imp.Name == "*" {
+						e.Local = "*"
+					}
+				}
+			}
+		}
+		if e.Source == "" {
+			return m.local(e.Local), true
+		}
+		for _, s := range m.specs {
+			if s.source != e.Source {
+				continue
+			}
+			if t := modules[e.Source]; t != nil && scopeOf != nil && scopeOf[e.Source] == scopeOf[m.name] {
+				if e.Local == "*" {
+					return "", false
+				}
+				return binding(t, modules, e.Local, scopeOf)
+			}
+			if e.Local == "*" {
+				return m.local(s.name), true
+			}
+			return m.local(s.name) + "." + e.Local, true
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// hoist returns the code of the module in its scope. The header of modules
+// inlined into another scope is dropped, along with the requires of modules
+// inlined into the same scope and member accesses on them.
+func (m *module) hoist(modules map[string]*module, scopeOf map[string]string, isScope bool) ([]byte, *sourcemap.Map, error) {
+	inlined := func(source string) bool {
+		return modules[source] != nil && source != scopeOf[m.name] && scopeOf[source] == scopeOf[m.name]
+	}
+
+	edits := []js.Edit{}
+	if m.esm != nil && !isScope {
+		edits = append(edits, *m.esm)
+	}
+	vars := map[string]string{}
+	for _, s := range m.specs {
+		if inlined(s.source) {
+			vars[s.name] = s.source
+			edits = append(edits, js.Edit{Start: s.start, End: s.end})
+		}
+	}
+
+	brackets := []byte{}
+	class := false
+	for i, tok := range m.tokens {
+		text := m.text(i)
+		switch {
+		case tok.Kind == js.TemplatePart:
+			if text[0] == '}' && len(brackets) > 0 {
+				brackets = brackets[:len(brackets)-1]
+			}
+			if text[len(text)-1] == '{' {
+				brackets = append(brackets, '$')
+			}
+			continue
+		case text == "{":
+			kind := m.braceKind(i)
+			if class {
+				kind, class = 'c', false
+			}
+			brackets = append(brackets, kind)
+			continue
+		case text == "(" || text == "[":
+			brackets = append(brackets, text[0])
+			continue
+		case text == "}" || text == ")" || text == "]":
+			if len(brackets) > 0 {
+				brackets = brackets[:len(brackets)-1]
+			}
+			continue
+		case tok.Kind != js.Ident || m.isMember(i):
+			continue
+		case text == "class":
+			class = true
+			continue
+		}
+
+		if source, ok := vars[text]; ok && m.text(i+1) == "." {
+			expr, _ := binding(modules[source], modules, m.text(i+2), scopeOf)
+			edits = append(edits, js.Edit{Start: tok.Start, End: m.tokens[i+2].End, Text: expr})
+			continue
+		}
+		name, ok := m.renames[text]
+		if !ok {
+			continue
+		}
+		top := byte(0)
+		if len(brackets) > 0 {
+			top = brackets[len(brackets)-1]
+		}
+		prev, next := m.text(i-1), m.text(i+1)
+		switch top {
+		case 'o':
+			if prev == "{" || prev == "," {
+				if next == ":" || next == "(" {
+					continue // key or method
+				}
+				if next == "}" || next == "," || next == "=" {
+					name = text + ": " + name // shorthand property
+				}
+			}
+			if (prev == "get" || prev == "set" || prev == "async" || prev == "*") && next == "(" {
+				continue
+			}
+		case 'c':
+			switch prev {
+			case "{", "}", ";", "static", "get", "set", "async", "*":
+				switch next {
+				case "(", "=", ";", "}":
+					continue // method or field
+				}
+			}
+		}
+		edits = append(edits, js.Edit{Start: tok.Start, End: tok.End, Text: name})
+	}
+
+	out, applied := js.Apply(m.src, edits)
+	if m.sourceMap == nil {
+		return out, nil, nil
+	}
+	return out, m.sourceMap, m.sourceMap.Shift(m.src, out, applied)
+}
+
+// braceKind returns 'o' for braces starting an object literal or pattern and
+// '{' for blocks.
+func (m *module) braceKind(i int) byte {
+	switch prev := m.text(i - 1); prev {
+	case "", ")", ";", "{", "}", "else", "try", "finally", "do":
+		return '{'
+	case ">":
+		if m.text(i-2) == "=" {
+			return '{' // arrow function body
+		}
+	}
+	return 'o'
+}
+
+// rename renames top level declarations of the modules colliding with
+// identifiers of the other modules of the scope.
+func rename(members []*module) {
+	idents := make([]map[string]bool, len(members))
+	all := map[string]bool{}
+	for k, m := range members {
+		idents[k] = map[string]bool{}
+		for i, tok := range m.tokens {
+			if tok.Kind == js.Ident && !m.isMember(i) {
+				idents[k][m.text(i)] = true
+				all[m.text(i)] = true
+			}
+		}
+	}
+	for k, m := range members {
+		m.renames = map[string]string{}
+		for _, name := range m.declarations() {
+			collides := false
+			for j := range members {
+				if j != k && idents[j][name] {
+					collides = true
+				}
+			}
+			if !collides {
+				continue
+			}
+			renamed := name + "$" + strconv.Itoa(k)
+			for all[renamed] {
+				renamed += "$"
+			}
+			all[renamed] = true
+			m.renames[name] = renamed
+		}
+	}
+}
+
+// declarations returns the names declared by var, let, const, function and
+// class at any depth. Renaming nested declarations along with top level
+// ones is harmless as every reference is renamed.
+func (m *module) declarations() []string {
+	names := map[string]bool{}
+	for i := range m.tokens {
+		if m.kind(i) != js.Ident || m.isMember(i) {
+			continue
+		}
+		switch m.text(i) {
+		case "var", "let", "const":
+			m.declarators(i+1, names)
+		case "function", "class":
+			n := i + 1
+			if m.text(n) == "*" {
+				n++
+			}
+			if m.kind(n) == js.Ident && m.text(n) != "extends" {
+				names[m.text(n)] = true
+			}
+		}
+	}
+	list := []string{}
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// declarators adds the names of a declaration list starting at i.
+func (m *module) declarators(i int, names map[string]bool) {
+	for i < len(m.tokens) {
+		i = m.pattern(i, names)
+		if m.text(i) == "=" {
+			i = m.skipExpr(i+1, ",")
+		}
+		if m.text(i) != "," {
+			return
+		}
+		i++
+	}
+}
+
+// pattern adds the names bound by a binding pattern at i and returns the
+// token after it.
+func (m *module) pattern(i int, names map[string]bool) int {
+	switch m.text(i) {
+	case "{", "[":
+		closing := "}"
+		if m.text(i) == "[" {
+			closing = "]"
+		}
+		i++
+		for i < len(m.tokens) && m.text(i) != closing {
+			switch {
+			case m.text(i) == ",":
+				i++
+				continue
+			case m.text(i) == "." && m.text(i+1) == "." && m.text(i+2) == ".":
+				i += 3
+			case closing == "}" && m.text(i) == "[":
+				i = m.skipExpr(i+1, "]") + 1
+				i++ // the colon
+			case closing == "}" && m.text(i+1) == ":":
+				i += 2
+			}
+			i = m.pattern(i, names)
+			if m.text(i) == "=" {
+				i = m.skipExpr(i+1, ",", closing)
+			}
+		}
+		return i + 1
+	}
+	if m.kind(i) == js.Ident {
+		names[m.text(i)] = true
+	}
+	return i + 1
+}
+
+// skipExpr returns the index of the first stop token at the depth of i, or of
+// the end of the statement.
+func (m *module) skipExpr(i int, stops ...string) int {
+	depth := 0
+	for ; i < len(m.tokens); i++ {
+		text := m.text(i)
+		if depth == 0 {
+			for _, stop := range stops {
+				if text == stop {
+					return i
+				}
+			}
+		}
+		switch text {
+		case "{", "(", "[":
+			depth++
+		case "}", ")", "]":
+			depth--
+			if depth < 0 {
+				return i
+			}
+		case ";":
+			if depth == 0 {
+				return i
+			}
+		}
+		if m.kind(i) == js.TemplatePart {
+			if text[0] == '}' {
+				depth--
+			}
+			if text[len(text)-1] == '{' {
+				depth++
+			}
+		}
+	}
+	return i
+}
+
+// parseModule parses the compiled ES module and its header.
+func parseModule(name string, src []byte, esm *compiler.Module) *module {
+	m := &module{
+		name:     name,
+		src:      src,
+		tokens:   js.Lex(src),
+		imports:  esm.Imports,
+		exports:  esm.Exports,
+		requires: map[string]bool{},
+		safe:     true,
+	}
+
+	i := 0
+header:
+	for i < len(m.tokens) {
+		switch {
+		case m.is(i, "require", ".", "esm", "("):
+			end := m.skipExpr(i+4, ")")
+			if m.text(end+1) != ";" {
+				break header
+			}
+			m.esm = &js.Edit{Start: m.tokens[i].Start, End: m.tokens[end+1].End}
+			i = end + 2
+		case m.is(i, "require", ".", "star", "("):
+			m.safe = false
+			end := m.skipExpr(i+4, ")") + 1
+			s := spec{name: m.text(end - 2), start: m.tokens[i].Start, end: len(m.src)}
+			if end < len(m.tokens) {
+				s.end = m.tokens[end].End
+			}
+			m.stars = append(m.stars, s)
+			i = end + 1
+		case m.is(i, "var") && isSpec(m.text(i+1)) && m.text(i+2) == "=":
+			end := m.skipExpr(i+3, ";")
+			s := spec{name: m.text(i + 1), start: m.tokens[i].Start, end: len(m.src)}
+			if end < len(m.tokens) {
+				s.end = m.tokens[end].End
+			}
+			for j := i + 3; j < end; j++ {
+				if m.kind(j) == js.String && m.text(j-1) == "(" && m.text(j-2) == "require" {
+					s.source, _ = strconv.Unquote(m.text(j))
+				}
+			}
+			m.specs = append(m.specs, s)
+			i = end + 1
+		default:
+			break header
+		}
+	}
+
+	m.body = i
+	for ; i < len(m.tokens); i++ {
+		if m.kind(i) != js.Ident || m.isMember(i) {
+			continue
+		}
+		switch m.text(i) {
+		case "module", "exports", "eval", "arguments":
+			m.safe = false
+		case "require":
+			if m.text(i+1) == "(" && m.kind(i+2) == js.String {
+				source, _ := strconv.Unquote(m.text(i + 2))
+				if source == "" {
+					source = m.text(i + 2)[1 : len(m.text(i+2))-1]
+				}
+				m.requires[source] = true
+			}
+		}
+	}
+	return m
+}
+
+// isSpec returns whether the name is the variable of an import of the header,
+// __jsbld followed by its index. The __jsbld_default declaration of the body
+// is not.
+func isSpec(name string) bool {
+	index := strings.TrimPrefix(name, "__jsbld")
+	if index == name || index == "" {
+		return false
+	}
+	_, err := strconv.Atoi(index)
+	return err == nil
+}
+
+func (m *module) text(i int) string {
+	if i < 0 || i >= len(m.tokens) {
+		return ""
+	}
+	return string(m.src[m.tokens[i].Start:m.tokens[i].End])
+}
+
+func (m *module) kind(i int) js.Kind {
+	if i < 0 || i >= len(m.tokens) {
+		return js.Punct
+	}
+	return m.tokens[i].Kind
+}
+
+// is returns whether the tokens starting at i match the texts.
+func (m *module) is(i int, texts ...string) bool {
+	for j, text := range texts {
+		if m.text(i+j) != text {
+			return false
+		}
+	}
+	return true
+}
+
+// isMember returns whether the identifier at i is a property access, and not
+// spread with ...
+func (m *module) isMember(i int) bool {
+	return m.text(i-1) == "." && m.text(i-2) != "."
+}
+
+func (m *module) local(name string) string {
+	if renamed, ok := m.renames[name]; ok {
+		return renamed
+	}
+	return name
+}
+
+// sortModules orders the ES modules so that importers come before the modules
+// they import, and returns the modules which are part of a cycle.
+func sortModules(files Files, modules map[string]*module) ([]string, map[string]bool) {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	cyclic := map[string]bool{}
+	stack := []string{}
+	order := []string{}
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, imp := range files[name].Imports {
+			if modules[imp] == nil {
+				continue
+			}
+			switch state[imp] {
+			case visiting:
+				for j := len(stack) - 1; j >= 0; j-- {
+					cyclic[stack[j]] = true
+					if stack[j] == imp {
+						break
+					}
+				}
+			case 0:
+				visit(imp)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+		order = append(order, name)
+	}
+	for _, name := range files.Keys() {
+		if modules[name] != nil && state[name] == 0 {
+			visit(name)
+		}
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order, cyclic
+}
@@ -0,0 +1,151 @@
+package linker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coldog/jsbld/pkg/compiler"
+)
+
+// compileSources compiles the sources with the ES module transform and
+// bundles the entrypoint src/index.js into a temporary directory.
+func compileSources(t *testing.T, sources map[string]string) *Bundle {
+	root, err := ioutil.TempDir("", "hoist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(root, "node_modules"), 0777)
+	for name, src := range sources {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &compiler.Compiler{Root: root, Dst: "dst", Compilers: map[string]string{"*": "cp $1 $2"}}
+	if err := c.Compile(context.Background(), []string{"src", "node_modules"}); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	b := &Bundle{Root: filepath.Join(root, "dst"), Entrypoints: []string{"src/index.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := StandardBundler(b); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	return b
+}
+
+// writeBundle writes the bundle and returns the code of its entrypoint
+// chunk.
+func writeBundle(t *testing.T, b *Bundle) string {
+	if err := b.Write(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(b.Root, b.Chunks[0].Output()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// hoistSources returns the hoisted bundle of the sources.
+func hoistSources(t *testing.T, sources map[string]string) string {
+	b := compileSources(t, sources)
+	defer os.RemoveAll(filepath.Dir(b.Root))
+	b.Hoist = true
+	return writeBundle(t, b)
+}
+
+// factories returns the modules registered by the bundle.
+func factories(out string) []string {
+	names := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "modules[\"") {
+			names = append(names, strings.Split(line, "\"")[1])
+		}
+	}
+	return names
+}
+
+// evalResult runs the bundle with node, if installed, and returns the JSON of
+// window.result.
+func evalResult(t *testing.T, out string) string {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	script := "global.window = global; global.document = {currentScript: {src: 'http://localhost/index.js'}};\n" +
+		out + "\nconsole.log(JSON.stringify(window.result));\n"
+	result, err := exec.Command(node, "-e", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("node failed: %v\n%s", err, result)
+	}
+	return strings.TrimSpace(string(result))
+}
+
+func TestHoist(t *testing.T) {
+	out := hoistSources(t, map[string]string{
+		"src/index.js": `import { add, name } from './math';
+import greet from './greet';
+import * as util from './util';
+import cjs from './cjs';
+const value = 1;
+function helper() { return 'index'; }
+const o = { value, helper };
+window.result = [add(value, 2), name, greet(), util.twice(3), helper(), cjs.x, o.value];
+`,
+		"src/math.js": `const value = 10;
+function helper() { return { value, helper: 1 }; }
+export function add(a, b) { return a + b + helper().value - value; }
+export { value as name };
+`,
+		"src/greet.js": "import { name } from './math';\nexport default function() { return `hi ${name}`; }\n",
+		"src/util.js":  "export const twice = (x) => x * 2;\n",
+		"src/cjs.js":   "module.exports = { x: 'cjs' };\n",
+	})
+
+	if names := factories(out); !reflect.DeepEqual(names, []string{"src/cjs.js", "src/index.js"}) {
+		t.Fatalf("wrong factories %v:\n%s", names, out)
+	}
+	for _, want := range []string{"const value$0 = 10;", "const o = { value: value$3, helper: helper$3 };", "twice(3)"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q:\n%s", want, out)
+		}
+	}
+	if result := evalResult(t, out); result != `[3,10,"hi 10",6,"index","cjs",1]` {
+		t.Fatalf("wrong result %s:\n%s", result, out)
+	}
+}
+
+func TestHoistFallback(t *testing.T) {
+	// Cycles keep their wrappers.
+	out := hoistSources(t, map[string]string{
+		"src/index.js": "import { a } from './a';\nwindow.result = a;\n",
+		"src/a.js":     "import { b } from './b';\nexport function a() { return b(); }\n",
+		"src/b.js":     "import { a } from './a';\nexport function b() { return a; }\n",
+	})
+	if names := factories(out); !reflect.DeepEqual(names, []string{"src/a.js", "src/b.js", "src/index.js"}) {
+		t.Fatalf("wrong factories %v:\n%s", names, out)
+	}
+
+	// Namespaces used as values and CommonJS modules keep their wrappers.
+	out = hoistSources(t, map[string]string{
+		"src/index.js": "import * as ns from './ns';\nimport { c } from './c';\nwindow.result = [Object.keys(ns), c];\n",
+		"src/ns.js":    "export const x = 1;\n",
+		"src/c.js":     "export const c = typeof module;\n",
+	})
+	if names := factories(out); !reflect.DeepEqual(names, []string{"src/c.js", "src/index.js", "src/ns.js"}) {
+		t.Fatalf("wrong factories %v:\n%s", names, out)
+	}
+	if result := evalResult(t, out); result != `[["x"],"object"]` {
+		t.Fatalf("wrong result %s:\n%s", result, out)
+	}
+}
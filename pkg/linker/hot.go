@@ -0,0 +1,26 @@
+package linker
+
+import (
+	"io/ioutil"
+	"path/filepath"
+)
+
+// HotUpdate returns the compiled source of the given files keyed by module
+// name, to be sent to the dev client as new module factories. It returns
+// false if any file is not a module of the bundle, in which case the page
+// must be reloaded instead.
+func (b *Bundle) HotUpdate(files []string) (map[string]string, bool, error) {
+	updates := map[string]string{}
+	for _, name := range files {
+		name = filepath.Clean(name)
+		if _, ok := b.Files[name]; !ok {
+			return nil, false, nil
+		}
+		data, err := ioutil.ReadFile(filepath.Join(b.Root, name))
+		if err != nil {
+			return nil, false, err
+		}
+		updates[name] = string(data)
+	}
+	return updates, true, nil
+}
@@ -0,0 +1,74 @@
+package linker
+
+import (
+	"bytes"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// WriteHTML writes the HTML template at path into the output directory,
+// injecting preload links for the chunks of every entrypoint before </head>
+// and script tags loading them in order before </body>. Tags are appended if
+// the template lacks either element. Tags carry the integrity of the chunks
+// and the nonce of the bundle, if set.
+func (b *Bundle) WriteHTML(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	m, err := b.Manifest()
+	if err != nil {
+		return err
+	}
+	out := injectHTML(data, b.Entrypoints, m, b.Nonce)
+	name := filepath.Base(path)
+	if err := ioutil.WriteFile(filepath.Join(b.Root, name), out, 0666); err != nil {
+		return err
+	}
+	return b.compress([]string{name})
+}
+
+func injectHTML(data []byte, entrypoints []string, m *Manifest, nonce string) []byte {
+	preloads := &bytes.Buffer{}
+	scripts := &bytes.Buffer{}
+	seen := map[string]bool{}
+	for _, entrypoint := range entrypoints {
+		entry := m.Entrypoints[entrypoint]
+		if entry == nil {
+			continue
+		}
+		for _, c := range append(append([]ManifestChunk{}, entry.Loads...), entry.ManifestChunk) {
+			if seen[c.File] {
+				continue
+			}
+			seen[c.File] = true
+			src := html.EscapeString(c.File)
+			attrs := ""
+			if c.Integrity != "" {
+				attrs += ` integrity="` + html.EscapeString(c.Integrity) + `" crossorigin="anonymous"`
+			}
+			if nonce != "" {
+				// Written as is to keep template placeholders intact.
+				attrs += ` nonce="` + nonce + `"`
+			}
+			preloads.WriteString(`<link rel="preload" href="` + src + `" as="script"` + attrs + ">\n")
+			scripts.WriteString(`<script defer src="` + src + `"` + attrs + "></script>\n")
+		}
+	}
+	data = insertBefore(data, "</head>", preloads.Bytes())
+	return insertBefore(data, "</body>", scripts.Bytes())
+}
+
+// insertBefore inserts tags before the last occurrence of the closing tag,
+// ignoring case, or appends them if it is missing.
+func insertBefore(data []byte, tag string, tags []byte) []byte {
+	i := bytes.LastIndex(bytes.ToLower(data), []byte(tag))
+	if i < 0 {
+		return append(data, tags...)
+	}
+	out := make([]byte, 0, len(data)+len(tags))
+	out = append(out, data[:i]...)
+	out = append(out, tags...)
+	return append(out, data[i:]...)
+}
@@ -8,15 +8,15 @@
 package linker
 
 import (
-	"log"
-	"sort"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"log"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/coldog/jsbld/pkg/compiler"
-	"github.com/coldog/jsbld/pkg/util"
 )
 
 type File struct {
@@ -27,7 +27,17 @@ type File struct {
 type Files map[string]File
 
 func (f Files) Add(file, entrypoint string) {
-	f[file] = File{Entrypoints: append(f[file].Entrypoints, entrypoint)}
+	f[file] = File{Entrypoints: append(f[file].Entrypoints, entrypoint), Object: f[file].Object}
+}
+
+// Has returns whether the file has already been reached from the entrypoint.
+func (f Files) Has(file, entrypoint string) bool {
+	for _, e := range f[file].Entrypoints {
+		if e == entrypoint {
+			return true
+		}
+	}
+	return false
 }
 
 func (f Files) SetObject(file string, o compiler.Object) {
@@ -47,16 +57,42 @@ type Chunk struct {
 	Files      Files
 	Entrypoint string
 	Loads      []string
-}
 
+	// Dynamic is the module an async chunk is loaded for with import().
+	Dynamic string
+	// Name prefixes the output of chunks shared between entrypoints.
+	Name string
+	// Async maps the modules an entrypoint chunk may load with import() to
+	// the chunks containing them.
+	Async map[string]string
+}
 
 func (c Chunk) Output() string {
 	h := sha256.New()
-	for _, f := range c.Files {
-		h.Write([]byte(f.Hash))
+	for _, name := range c.Files.Keys() {
+		h.Write([]byte(name))
+		h.Write([]byte(c.Files[name].Hash))
+	}
+	for _, load := range c.Loads {
+		h.Write([]byte(load))
+	}
+	modules := []string{}
+	for module := range c.Async {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+	for _, module := range modules {
+		h.Write([]byte(module + c.Async[module]))
 	}
 	hash := hex.EncodeToString(h.Sum(nil))
-	prefix := strings.Split(filepath.Base(c.Entrypoint), ".")[0]
+	name := c.Entrypoint
+	if name == "" {
+		name = c.Dynamic
+	}
+	if name == "" {
+		name = c.Name
+	}
+	prefix := strings.Split(filepath.Base(name), ".")[0]
 	return prefix + "-" + hash + ".js"
 }
 
@@ -65,52 +101,366 @@ type Bundle struct {
 	Files       Files
 	Entrypoints []string
 	Chunks      []*Chunk
+
+	// Async lists the modules loaded with import(). Each is traversed like an
+	// entrypoint and linked into a chunk loaded on demand.
+	Async []string
+	// Dynamic maps entrypoints and async modules to the modules they load
+	// with import().
+	Dynamic map[string][]string
+
+	// DevServer is the URL of the development server event stream. When set,
+	// entrypoint chunks include a client which reloads the page on rebuilds.
+	DevServer string
+	// Hoist concatenates ES modules into the scope of their importer where
+	// possible, see hoister.
+	Hoist bool
+	// Minify writes chunks minified with js.Minify.
+	Minify bool
+	// Compress lists the formats, Gzip or Brotli, of the precompressed
+	// siblings written for chunks, source maps and the HTML page of at least
+	// CompressMinSize bytes.
+	Compress        []string
+	CompressMinSize int64
+	// Nonce is set on the script and preload tags of the HTML page, and on
+	// scripts injected by the runtime when the page sets no nonce of its own.
+	Nonce string
+	// HTML is the path of the template of the HTML page, see WriteHTML.
+	HTML string
+	// Concurrency limits the outputs written at once, defaulting to
+	// compiler.DefaultConcurrency.
+	Concurrency int
+
+	// shaken is the code of the modules changed by Shake.
+	shaken map[string]*shaken
 }
 
+// Write writes every chunk of the bundle, the manifest and the HTML page.
 func (b *Bundle) Write() error {
-	popd := util.Pushd(b.Root)
-	defer popd()
-
-	for _, chunk := range b.Chunks {
-		log.Printf("writing: %s", chunk.Output())
-		var err error
-		if chunk.Entrypoint != "" {
-			err = bundle(chunk.Files, chunk.Entrypoint, chunk.Output(), chunk.Loads)
-		} else {
-			err = bundleChunk(chunk.Files, chunk.Output())
+	return b.WriteChunks(b.Chunks)
+}
+
+// WriteChunks writes the given chunks of the bundle and their compressed
+// siblings, then the manifest and the HTML page, as nodes of a graph.
+// Entrypoint chunks depend on the chunks they load, whose integrity they
+// embed, and the manifest depends on every chunk.
+func (b *Bundle) WriteChunks(chunks []*Chunk) error {
+	if err := checkFormats(b.Compress); err != nil {
+		return err
+	}
+	var h *hoister
+	if b.Hoist {
+		h = &hoister{files: b.Files, roots: map[string]bool{}}
+		for _, root := range b.Roots() {
+			h.roots[root] = true
 		}
-		if err != nil {
-			return err
+	}
+
+	t := &tasks{nodes: map[int][]int{}}
+	writes := map[string]int{}
+	for _, chunk := range chunks {
+		chunk := chunk
+		output := chunk.Output()
+		writes[output] = t.add(func() error {
+			log.Printf("writing: %s", output)
+			var err error
+			if chunk.Entrypoint != "" {
+				err = b.bundle(chunk, h)
+			} else {
+				err = b.bundleChunk(chunk, h)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", output, err)
+			}
+			return nil
+		})
+	}
+	all := []int{}
+	for _, chunk := range chunks {
+		id := writes[chunk.Output()]
+		all = append(all, id)
+		if chunk.Entrypoint == "" {
+			continue
+		}
+		loads := append([]string{}, chunk.Loads...)
+		for _, output := range chunk.Async {
+			loads = append(loads, output)
+		}
+		for _, load := range loads {
+			if dep, ok := writes[load]; ok {
+				t.nodes[id] = append(t.nodes[id], dep)
+			}
 		}
 	}
-	return nil
+	for _, chunk := range chunks {
+		output := chunk.Output()
+		for _, format := range b.Compress {
+			format := format
+			t.add(func() error { return b.compressChunk(output, format) }, writes[output])
+		}
+	}
+	manifest := t.add(func() error {
+		if err := b.WriteManifest(); err != nil {
+			return fmt.Errorf("%s: %v", ManifestFile, err)
+		}
+		return nil
+	}, all...)
+	if b.HTML != "" {
+		t.add(func() error {
+			if err := b.WriteHTML(b.HTML); err != nil {
+				return fmt.Errorf("%s: %v", filepath.Base(b.HTML), err)
+			}
+			return nil
+		}, manifest)
+	}
+
+	concurrency := b.Concurrency
+	if concurrency == 0 {
+		concurrency = compiler.DefaultConcurrency
+	}
+	return t.run(concurrency)
 }
 
 func (b *Bundle) Find() error {
-	popd := util.Pushd(b.Root)
-	defer popd()
-
 	b.Files = Files{}
-	for _, entrypoint := range b.Entrypoints {
-		b.Files.Add(entrypoint, entrypoint)
+	b.Async = nil
+	b.Dynamic = nil
+	return b.Refind(b.Entrypoints)
+}
+
+// Roots returns the entrypoints followed by the async modules.
+func (b *Bundle) Roots() []string {
+	return append(append([]string{}, b.Entrypoints...), b.Async...)
+}
+
+func (b *Bundle) isRoot(module string) bool {
+	for _, root := range b.Roots() {
+		if root == module {
+			return true
+		}
+	}
+	return false
+}
+
+// Warnings returns the compiler warnings of every file in the bundle followed
+// by the import cycles, which run with the exports of a module so far.
+func (b *Bundle) Warnings() []string {
+	warnings := []string{}
+	for _, name := range b.Files.Keys() {
+		warnings = append(warnings, b.Files[name].Warnings...)
+	}
+	for _, cycle := range b.Cycles() {
+		warnings = append(warnings, "circular dependency: "+strings.Join(cycle, " -> "))
+	}
+	return warnings
+}
+
+// Cycles returns the import cycles found traversing the files in order, each
+// as the path from its first file, in order of names, back to that file.
+func (b *Bundle) Cycles() [][]string {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	stack := []string{}
+	seen := map[string]bool{}
+	cycles := [][]string{}
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, imp := range b.Files[name].Imports {
+			switch state[imp] {
+			case visiting:
+				j := len(stack) - 1
+				for stack[j] != imp {
+					j--
+				}
+				cycle := rotate(stack[j:])
+				key := strings.Join(cycle, "\x00")
+				if !seen[key] {
+					seen[key] = true
+					cycles = append(cycles, append(cycle, cycle[0]))
+				}
+			case 0:
+				if _, ok := b.Files[imp]; ok {
+					visit(imp)
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+	}
+	for _, name := range b.Files.Keys() {
+		if state[name] == 0 {
+			visit(name)
+		}
+	}
+	return cycles
+}
+
+// rotate returns a copy of the cycle starting with its first name in order.
+func rotate(cycle []string) []string {
+	first := 0
+	for i, name := range cycle {
+		if name < cycle[first] {
+			first = i
+		}
+	}
+	return append(append([]string{}, cycle[first:]...), cycle[:first]...)
+}
+
+// Affected returns the entrypoints and async modules which reach any of the
+// given files. Files outside the bundle may have been added since it was
+// found, they affect the files with unresolved imports.
+func (b *Bundle) Affected(files []string) []string {
+	set := map[string]bool{}
+	for _, name := range files {
+		name = filepath.Clean(name)
+		reached := []string{name}
+		if _, ok := b.Files[name]; !ok {
+			reached = b.Unresolved()
+		}
+		for _, file := range reached {
+			for _, entrypoint := range b.Files[file].Entrypoints {
+				set[entrypoint] = true
+			}
+		}
+	}
+	affected := []string{}
+	for _, entrypoint := range b.Roots() {
+		if set[entrypoint] {
+			affected = append(affected, entrypoint)
+		}
+	}
+	return affected
+}
+
+// Unresolved returns the files of the bundle with imports which could not be
+// resolved.
+func (b *Bundle) Unresolved() []string {
+	files := []string{}
+	for _, name := range b.Files.Keys() {
+		if len(b.Files[name].Unresolved) > 0 {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// Refind traverses the given entrypoints or async modules again, dropping
+// files they no longer reach and reloading the objects of the files they do.
+// Modules newly loaded with import() are traversed as well.
+func (b *Bundle) Refind(entrypoints []string) error {
+	if b.Files == nil {
+		b.Files = Files{}
+	}
+	if b.Dynamic == nil {
+		b.Dynamic = map[string][]string{}
+	}
+	refind := map[string]bool{}
+	for _, entrypoint := range entrypoints {
+		refind[entrypoint] = true
+	}
+	for name, file := range b.Files {
+		kept := []string{}
+		for _, entrypoint := range file.Entrypoints {
+			if !refind[entrypoint] {
+				kept = append(kept, entrypoint)
+			}
+		}
+		if len(kept) == 0 {
+			delete(b.Files, name)
+			continue
+		}
+		file.Entrypoints = kept
+		b.Files[name] = file
+	}
 
-		if err := parse(b.Files, entrypoint, entrypoint); err != nil {
+	queue := append([]string{}, entrypoints...)
+	for len(queue) > 0 {
+		entrypoint := queue[0]
+		queue = queue[1:]
+
+		delete(b.Dynamic, entrypoint)
+		b.Files.Add(entrypoint, entrypoint)
+		if err := b.parse(entrypoint, entrypoint); err != nil {
 			return err
 		}
+
+		for _, module := range b.Dynamic[entrypoint] {
+			if !b.isRoot(module) {
+				b.Async = append(b.Async, module)
+				queue = append(queue, module)
+			}
+		}
 	}
+	b.prune()
 	return nil
 }
 
-// Loads files into the files map and traverses child dependencies.
-func parse(files Files, file, entrypoint string) error {
-	o, err := compiler.ReadObjectFile(file)
+// prune drops async modules which are no longer loaded with import().
+func (b *Bundle) prune() {
+	reachable := map[string]bool{}
+	queue := append([]string{}, b.Entrypoints...)
+	for len(queue) > 0 {
+		root := queue[0]
+		queue = queue[1:]
+		if reachable[root] {
+			continue
+		}
+		reachable[root] = true
+		queue = append(queue, b.Dynamic[root]...)
+	}
+
+	async := []string{}
+	for _, module := range b.Async {
+		if reachable[module] {
+			async = append(async, module)
+		} else {
+			delete(b.Dynamic, module)
+		}
+	}
+	if len(async) == len(b.Async) {
+		return
+	}
+	b.Async = async
+
+	for name, file := range b.Files {
+		kept := []string{}
+		for _, entrypoint := range file.Entrypoints {
+			if reachable[entrypoint] {
+				kept = append(kept, entrypoint)
+			}
+		}
+		if len(kept) == 0 {
+			delete(b.Files, name)
+			continue
+		}
+		file.Entrypoints = kept
+		b.Files[name] = file
+	}
+}
+
+// Loads files into the files map and traverses child dependencies, recording
+// the modules loaded with import() for the entrypoint.
+func (b *Bundle) parse(file, entrypoint string) error {
+	files := b.Files
+	o, err := compiler.ReadObjectFile(filepath.Join(b.Root, file))
 	if err != nil {
 		return err
 	}
 	files.SetObject(file, o)
 
+	for _, module := range o.DynamicImports {
+		if !contains(b.Dynamic[entrypoint], module) {
+			b.Dynamic[entrypoint] = append(b.Dynamic[entrypoint], module)
+		}
+	}
+
 	for _, require := range o.Imports {
-		if _, ok := files[require]; ok {
+		if files.Has(require, entrypoint) {
 			continue
 		}
 
@@ -120,10 +470,19 @@ func parse(files Files, file, entrypoint string) error {
 		}
 
 		files.Add(require, entrypoint)
-		err = parse(files, require, entrypoint)
+		err = b.parse(require, entrypoint)
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
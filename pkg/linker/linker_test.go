@@ -1,9 +1,18 @@
 package linker
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/coldog/jsbld/pkg/compiler"
+	"github.com/coldog/jsbld/pkg/sourcemap"
 )
 
 func TestExample(t *testing.T) {
@@ -28,3 +37,547 @@ func TestExample(t *testing.T) {
 		t.Fatalf("failed: %v", err)
 	}
 }
+
+// writeObjects writes compiled files and their objects into a temporary
+// directory. The graph maps each file to its imports.
+func writeObjects(t *testing.T, graph map[string][]string) string {
+	return writeDynamicObjects(t, graph, nil)
+}
+
+// writeDynamicObjects writes objects with static imports from graph and
+// dynamic imports from dynamic.
+func writeDynamicObjects(t *testing.T, graph, dynamic map[string][]string) string {
+	root, err := ioutil.TempDir("", "linker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, imports := range graph {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte("// "+name+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		o := compiler.Object{Filename: path, Hash: name, Imports: imports, DynamicImports: dynamic[name]}
+		if err := compiler.WriteObjectFile(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestRefind(t *testing.T) {
+	root := writeObjects(t, map[string][]string{
+		"src/a.js":      {"src/shared.js"},
+		"src/b.js":      {"src/shared.js", "src/only-b.js"},
+		"src/shared.js": {},
+		"src/only-b.js": {},
+	})
+	defer os.RemoveAll(root)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/a.js", "src/b.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if e := b.Files["src/shared.js"].Entrypoints; len(e) != 2 {
+		t.Fatalf("shared file entrypoints: %v", e)
+	}
+
+	affected := b.Affected([]string{"src/only-b.js"})
+	if !reflect.DeepEqual(affected, []string{"src/b.js"}) {
+		t.Fatalf("affected: %v", affected)
+	}
+
+	// Drop the import of only-b.js and refind the affected entrypoint.
+	o := compiler.Object{Filename: filepath.Join(root, "src/b.js"), Hash: "b2", Imports: []string{"src/shared.js"}}
+	if err := compiler.WriteObjectFile(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Refind(affected); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if _, ok := b.Files["src/only-b.js"]; ok {
+		t.Fatalf("unreachable file kept: %+v", b.Files)
+	}
+	if b.Files["src/b.js"].Hash != "b2" {
+		t.Fatalf("object not reloaded: %+v", b.Files["src/b.js"])
+	}
+	if e := b.Files["src/shared.js"].Entrypoints; len(e) != 2 {
+		t.Fatalf("shared file entrypoints: %v", e)
+	}
+}
+
+func TestHotUpdate(t *testing.T) {
+	root := writeObjects(t, map[string][]string{
+		"src/a.js": {"src/b.js"},
+		"src/b.js": {},
+	})
+	defer os.RemoveAll(root)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/a.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	updates, ok, err := b.HotUpdate([]string{"./src/b.js"})
+	if err != nil || !ok {
+		t.Fatalf("failed: %v %v", ok, err)
+	}
+	if updates["src/b.js"] != "// src/b.js\n" {
+		t.Fatalf("unexpected updates: %+v", updates)
+	}
+
+	_, ok, err = b.HotUpdate([]string{"src/b.js", "index.html"})
+	if err != nil || ok {
+		t.Fatalf("expected reload for non module file: %v %v", ok, err)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	root := writeObjects(t, map[string][]string{
+		"src/index.js": {"src/a.js"},
+		"src/a.js":     {"src/b.js"},
+		"src/b.js":     {"src/c.js", "src/a.js"},
+		"src/c.js":     {"src/b.js"},
+	})
+	defer os.RemoveAll(root)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/index.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	expected := []string{
+		"circular dependency: src/b.js -> src/c.js -> src/b.js",
+		"circular dependency: src/a.js -> src/b.js -> src/a.js",
+	}
+	if warnings := b.Warnings(); !reflect.DeepEqual(warnings, expected) {
+		t.Fatalf("wrong warnings: %q", warnings)
+	}
+}
+
+func TestCyclesRun(t *testing.T) {
+	// Modules in a cycle see the exports of each other so far, as in node.
+	sources := map[string]string{
+		"src/index.js": "const a = require('./a');\nconst b = require('./b');\nwindow.result = [a.done, a.fromB, b.fromA, esm()];\n",
+		"src/a.js":     "exports.done = false;\nconst b = require('./b');\nexports.fromB = b.done;\nexports.done = true;\n",
+		"src/b.js":     "exports.done = false;\nconst a = require('./a');\nexports.fromA = a.done;\nexports.done = true;\n",
+	}
+	esm := map[string]string{
+		"src/esm.js":  "import { even } from './even';\nexport default function() { return [even(4), even(3)]; }\n",
+		"src/even.js": "import { odd } from './odd';\nexport function even(n) { return n === 0 || odd(n - 1); }\n",
+		"src/odd.js":  "import { even } from './even';\nexport function odd(n) { return n !== 0 && even(n - 1); }\n",
+	}
+	for name, src := range esm {
+		sources[name] = src
+	}
+	sources["src/index.js"] = "import esm from './esm';\n" + sources["src/index.js"]
+
+	for _, hoist := range []bool{false, true} {
+		b := compileSources(t, sources)
+		defer os.RemoveAll(filepath.Dir(b.Root))
+		b.Hoist = hoist
+		out := writeBundle(t, b)
+		if result := evalResult(t, out); result != `[true,true,false,[true,false]]` {
+			t.Fatalf("wrong result %s with hoisting %v:\n%s", result, hoist, out)
+		}
+	}
+}
+
+func TestDynamicImports(t *testing.T) {
+	root := writeDynamicObjects(t, map[string][]string{
+		"src/a.js":      {"src/shared.js"},
+		"src/page.js":   {"src/shared.js", "src/lazy.js"},
+		"src/shared.js": {},
+		"src/lazy.js":   {},
+	}, map[string][]string{
+		"src/a.js": {"src/page.js"},
+	})
+	defer os.RemoveAll(root)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/a.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if !reflect.DeepEqual(b.Async, []string{"src/page.js"}) {
+		t.Fatalf("async: %v", b.Async)
+	}
+	if err := StandardBundler(b); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if len(b.Chunks) != 2 {
+		t.Fatalf("chunks: %d", len(b.Chunks))
+	}
+	entry, async := b.Chunks[0], b.Chunks[1]
+	if async.Dynamic != "src/page.js" {
+		t.Fatalf("async chunk: %+v", async)
+	}
+	if !reflect.DeepEqual(async.Files.Keys(), []string{"src/lazy.js", "src/page.js"}) {
+		t.Fatalf("async chunk files: %v", async.Files.Keys())
+	}
+	if entry.Async["src/page.js"] != async.Output() {
+		t.Fatalf("async table: %v", entry.Async)
+	}
+	if err := b.Write(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	// Dropping the import() prunes the async chunk.
+	o, err := compiler.ReadObjectFile(filepath.Join(root, "src/a.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.DynamicImports = nil
+	if err := compiler.WriteObjectFile(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Refind(b.Affected([]string{"src/a.js"})); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if len(b.Async) != 0 || b.Files.Has("src/lazy.js", "src/page.js") {
+		t.Fatalf("async not pruned: %v %v", b.Async, b.Files["src/lazy.js"])
+	}
+}
+
+func TestManifest(t *testing.T) {
+	root := writeDynamicObjects(t, map[string][]string{
+		"src/a.js":      {"src/shared.js"},
+		"src/b.js":      {"src/shared.js"},
+		"src/page.js":   {},
+		"src/shared.js": {},
+	}, map[string][]string{
+		"src/a.js": {"src/page.js"},
+	})
+	defer os.RemoveAll(root)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/a.js", "src/b.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := SharedBundler(b); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := b.Write(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(root, ManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		t.Fatalf("invalid manifest: %v", err)
+	}
+	a := m.Entrypoints["src/a.js"]
+	if a == nil || len(m.Entrypoints) != 2 {
+		t.Fatalf("entrypoints: %s", data)
+	}
+	shared, entry, async := b.Chunks[0], b.Chunks[1], b.Chunks[3]
+	if a.File != entry.Output() || len(a.Loads) != 1 || a.Loads[0].File != shared.Output() || a.Async["src/page.js"].File != async.Output() {
+		t.Fatalf("wrong files: %s", data)
+	}
+	integrity, err := Integrity(filepath.Join(root, entry.Output()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Integrity != integrity || !strings.HasPrefix(integrity, "sha384-") {
+		t.Fatalf("wrong integrity: %s", a.Integrity)
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	root := writeDynamicObjects(t, map[string][]string{
+		"src/a.js":      {"src/shared.js"},
+		"src/b.js":      {"src/shared.js"},
+		"src/page.js":   {},
+		"src/shared.js": {},
+	}, map[string][]string{
+		"src/a.js": {"src/page.js"},
+	})
+	defer os.RemoveAll(root)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/a.js", "src/b.js"}, Nonce: "abc"}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := SharedBundler(b); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := b.Write(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	shared, entry, async := b.Chunks[0], b.Chunks[1], b.Chunks[3]
+	out, err := ioutil.ReadFile(filepath.Join(root, entry.Output()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	integrity, err := Integrity(filepath.Join(root, async.Output()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `"`+async.Output()+`":"`+integrity+`"`) {
+		t.Fatalf("missing integrity of %s:\n%s", async.Output(), out)
+	}
+
+	// The shared chunk is injected by the runtime with its integrity.
+	script := "var scripts = [];\n" +
+		"global.window = global;\n" +
+		"global.document = {currentScript: {src: 'http://localhost/a.js'}, " +
+		"createElement: function() { return {}; }, " +
+		"getElementsByTagName: function() { return [{appendChild: function(s) { scripts.push(s); }}]; }};\n" +
+		string(out) + "\nconsole.log(JSON.stringify(scripts));\n"
+	result, err := exec.Command(node, "-e", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("node failed: %v\n%s", err, result)
+	}
+	scripts := []map[string]string{}
+	if err := json.Unmarshal(result, &scripts); err != nil {
+		t.Fatalf("invalid output: %v\n%s", err, result)
+	}
+	integrity, err = Integrity(filepath.Join(root, shared.Output()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]string{{
+		"src":         "http://localhost/" + shared.Output(),
+		"type":        "text/javascript",
+		"integrity":   integrity,
+		"crossOrigin": "anonymous",
+		"nonce":       "abc",
+	}}
+	if !reflect.DeepEqual(scripts, expected) {
+		t.Fatalf("wrong scripts: %s", result)
+	}
+}
+
+func TestWriteFailure(t *testing.T) {
+	root := writeObjects(t, map[string][]string{
+		"src/a.js":      {"src/shared.js"},
+		"src/b.js":      {"src/shared.js"},
+		"src/c.js":      {},
+		"src/shared.js": {},
+	})
+	defer os.RemoveAll(root)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/a.js", "src/b.js", "src/c.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := SharedBundler(b); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	os.Remove(filepath.Join(root, "src/shared.js"))
+
+	// The chunks loading the shared chunk and the manifest are skipped.
+	shared := b.Chunks[0]
+	err := b.Write()
+	if err == nil || !strings.HasPrefix(err.Error(), shared.Output()+": ") {
+		t.Fatalf("wrong error: %v", err)
+	}
+	for _, chunk := range b.Chunks {
+		_, err := os.Stat(filepath.Join(root, chunk.Output()))
+		if written := err == nil; written != (chunk.Entrypoint == "src/c.js") {
+			t.Fatalf("%s written: %v", chunk.Output(), written)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, ManifestFile)); !os.IsNotExist(err) {
+		t.Fatalf("manifest written: %v", err)
+	}
+}
+
+func TestInjectHTML(t *testing.T) {
+	m := &Manifest{Entrypoints: map[string]*ManifestEntry{
+		"src/a.js": {ManifestChunk: ManifestChunk{File: "a-1.js"}, Loads: []ManifestChunk{{File: "shared-2.js"}}},
+		"src/b.js": {ManifestChunk: ManifestChunk{File: "b-3.js"}, Loads: []ManifestChunk{{File: "shared-2.js"}}},
+	}}
+	out := injectHTML([]byte("<html><HEAD></HEAD><body>\n</body></html>"), []string{"src/a.js", "src/b.js"}, m, "")
+	expected := `<html><HEAD><link rel="preload" href="shared-2.js" as="script">
+<link rel="preload" href="a-1.js" as="script">
+<link rel="preload" href="b-3.js" as="script">
+</HEAD><body>
+<script defer src="shared-2.js"></script>
+<script defer src="a-1.js"></script>
+<script defer src="b-3.js"></script>
+</body></html>`
+	if string(out) != expected {
+		t.Fatalf("wrong html:\n%s", out)
+	}
+
+	out = injectHTML([]byte("<div></div>\n"), []string{"src/a.js"}, m, "")
+	if !strings.HasSuffix(string(out), `<script defer src="a-1.js"></script>`+"\n") {
+		t.Fatalf("tags not appended:\n%s", out)
+	}
+}
+
+func TestInjectHTMLIntegrity(t *testing.T) {
+	m := &Manifest{Entrypoints: map[string]*ManifestEntry{
+		"src/a.js": {ManifestChunk: ManifestChunk{File: "a-1.js", Integrity: "sha384-x"}},
+	}}
+	out := injectHTML([]byte("<head></head><body></body>"), []string{"src/a.js"}, m, "<%= nonce %>")
+	expected := `<head><link rel="preload" href="a-1.js" as="script" integrity="sha384-x" crossorigin="anonymous" nonce="<%= nonce %>">
+</head><body><script defer src="a-1.js" integrity="sha384-x" crossorigin="anonymous" nonce="<%= nonce %>"></script>
+</body>`
+	if string(out) != expected {
+		t.Fatalf("wrong html:\n%s", out)
+	}
+}
+
+func TestHTMLRun(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	b := compileSources(t, map[string]string{
+		"src/index.js":  "var common = require('./common');\n(window.result = window.result || []).push('index ' + common);\n",
+		"src/b.js":      "var common = require('./common');\n(window.result = window.result || []).push('b ' + common);\n",
+		"src/common.js": "module.exports = 'common';\n",
+	})
+	root := filepath.Dir(b.Root)
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "index.html"), []byte("<html><head></head><body></body></html>"), 0666)
+
+	b.Entrypoints = []string{"src/index.js", "src/b.js"}
+	b.HTML = filepath.Join(root, "index.html")
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := SharedBundler(b); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := b.Write(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	page, err := ioutil.ReadFile(filepath.Join(b.Root, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run the scripts of the page in order, as deferred scripts are.
+	scripts := []string{}
+	for _, match := range regexp.MustCompile(`<script defer src="([^"]+)"`).FindAllStringSubmatch(string(page), -1) {
+		code, err := ioutil.ReadFile(filepath.Join(b.Root, match[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scripts = append(scripts, string(code))
+	}
+	if len(scripts) != 3 {
+		t.Fatalf("expected a shared chunk and two entrypoints:\n%s", page)
+	}
+	data, err := json.Marshal(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := "global.window = global;\n" +
+		"global.document = {currentScript: {src: 'http://localhost/index.js'}};\n" +
+		string(data) + ".forEach(function(code) { require('vm').runInThisContext(code); });\n" +
+		"console.log(JSON.stringify(window.result));\n"
+	result, err := exec.Command(node, "-e", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("node failed: %v\n%s", err, result)
+	}
+	if out := strings.TrimSpace(string(result)); out != `["index common","b common"]` {
+		t.Fatalf("wrong result %s", out)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	root := writeObjects(t, map[string][]string{
+		"src/a.js": {"src/b.js"},
+		"src/b.js": {},
+	})
+	defer os.RemoveAll(root)
+	m := &sourcemap.Map{Version: 3, Sources: []string{"../../src/b.js"}, Mappings: "AAAA"}
+	data, _ := json.Marshal(m)
+	ioutil.WriteFile(filepath.Join(root, "src/b.js.map"), data, 0666)
+
+	b := &Bundle{Root: root, Entrypoints: []string{"src/a.js"}}
+	if err := b.Find(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := StandardBundler(b); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := b.Write(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	output := b.Chunks[0].Output()
+	out, _ := ioutil.ReadFile(filepath.Join(root, output))
+	if !strings.HasSuffix(string(out), "//# sourceMappingURL="+output+".map\n") {
+		t.Fatalf("missing sourceMappingURL:\n%s", out)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, output+".map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := &sourcemap.Index{}
+	if err := json.Unmarshal(data, index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Sections) != 1 || !reflect.DeepEqual(index.Sections[0].Map.Sources, []string{"../src/b.js"}) {
+		t.Fatalf("wrong index map: %s", data)
+	}
+	line := strings.Split(string(out), "\n")[index.Sections[0].Offset.Line]
+	if line != "// src/b.js" {
+		t.Fatalf("section starts at %q", line)
+	}
+}
+
+func TestMinifyBundle(t *testing.T) {
+	b := compileSources(t, map[string]string{
+		"src/index.js": `import { add, name } from './math';
+import * as util from './util';
+const value = 1;
+const o = { value };
+window.result = [add(value, 2), name, util.twice(3), o.value];
+`,
+		"src/math.js": `const value = 10;
+export function add(first, second) { return first + second + value * (2 - 1); }
+export { value as name };
+`,
+		"src/util.js": "export const twice = (input) => input * 2;\n",
+	})
+	defer os.RemoveAll(filepath.Dir(b.Root))
+	m := &sourcemap.Map{Version: 3, Sources: []string{"../../src/util.js"}, Mappings: "AAAA"}
+	data, _ := json.Marshal(m)
+	ioutil.WriteFile(filepath.Join(b.Root, "src/util.js.map"), data, 0666)
+
+	b.Hoist = true
+	b.Minify = true
+	out := writeBundle(t, b)
+	for _, want := range []string{"function(){var ", "*(1)", "const o={value:"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q:\n%s", want, out)
+		}
+	}
+	if result := evalResult(t, out); result != `[13,10,6,1]` {
+		t.Fatalf("wrong result %s:\n%s", result, out)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(b.Root, b.Chunks[0].Output()+".map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = &sourcemap.Map{}
+	if err := json.Unmarshal(data, m); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := m.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Sources, []string{"../src/util.js"}) {
+		t.Fatalf("wrong sources: %s", data)
+	}
+	for i, segments := range lines {
+		for _, seg := range segments {
+			if line := strings.Split(out, "\n")[i]; !strings.HasPrefix(line[seg.Column:], "const ") {
+				t.Fatalf("segment at %q", line[seg.Column:])
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package linker
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ManifestFile is the name of the manifest written to the output directory.
+const ManifestFile = "manifest.json"
+
+// Manifest maps every entrypoint to the chunks written for it, so that
+// servers can reference the hashed output files.
+type Manifest struct {
+	Entrypoints map[string]*ManifestEntry `json:"entrypoints"`
+}
+
+// ManifestEntry is the chunk of an entrypoint along with the shared chunks it
+// loads before starting and the async chunks it may load with import().
+type ManifestEntry struct {
+	ManifestChunk
+	Loads []ManifestChunk          `json:"loads"`
+	Async map[string]ManifestChunk `json:"async"`
+}
+
+// ManifestChunk is an output file, relative to the output directory, and its
+// subresource integrity hash.
+type ManifestChunk struct {
+	File      string `json:"file"`
+	Integrity string `json:"integrity"`
+}
+
+// Manifest returns the manifest of the written chunks.
+func (b *Bundle) Manifest() (*Manifest, error) {
+	m := &Manifest{Entrypoints: map[string]*ManifestEntry{}}
+	for _, chunk := range b.Chunks {
+		if chunk.Entrypoint == "" {
+			continue
+		}
+		main, err := b.manifestChunk(chunk.Output())
+		if err != nil {
+			return nil, err
+		}
+		entry := &ManifestEntry{
+			ManifestChunk: main,
+			Loads:         []ManifestChunk{},
+			Async:         map[string]ManifestChunk{},
+		}
+		for _, load := range chunk.Loads {
+			c, err := b.manifestChunk(load)
+			if err != nil {
+				return nil, err
+			}
+			entry.Loads = append(entry.Loads, c)
+		}
+		for module, output := range chunk.Async {
+			c, err := b.manifestChunk(output)
+			if err != nil {
+				return nil, err
+			}
+			entry.Async[module] = c
+		}
+		m.Entrypoints[chunk.Entrypoint] = entry
+	}
+	return m, nil
+}
+
+// WriteManifest writes the manifest of the written chunks to the output
+// directory.
+func (b *Bundle) WriteManifest() error {
+	m, err := b.Manifest()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(b.Root, ManifestFile), append(data, '\n'), 0666)
+}
+
+func (b *Bundle) manifestChunk(output string) (ManifestChunk, error) {
+	integrity, err := Integrity(filepath.Join(b.Root, output))
+	return ManifestChunk{File: output, Integrity: integrity}, err
+}
+
+// Integrity returns the subresource integrity hash of a file.
+func Integrity(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha512.New384()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
@@ -2,42 +2,363 @@ package linker
 
 const runtime = `
 var cache = {};
-var modules = {};
+var modules = window.__modules__ || {};
+var parents = {};
+var hot = null;
+var loadedChunks = window.__chunks__ = window.__chunks__ || {};
+var asyncChunks = {};
+var pendingChunks = {};
+var integrity = {};
+var maxRetries = 3;
+var retryDelay = 500;
+
+// Scripts are injected into the document unless the page provides its own
+// loader, taking the same arguments as injectScript.
+var loadScript = window.__loadScript__ || injectScript;
+
+// Chunks are loaded relative to the script which contains the runtime.
+var publicPath = (function() {
+  var script = document.currentScript;
+  if (!script || !script.src) {
+    return '';
+  }
+  return script.src.slice(0, script.src.lastIndexOf('/') + 1);
+})();
+
+// Injected scripts carry the nonce of window.__nonce__ or of the script which
+// contains the runtime, so that a Content-Security-Policy allows them.
+var nonce = (function() {
+  var script = document.currentScript;
+  return window.__nonce__ || (script && script.nonce) || '';
+})();
 
 window.__modules__ = modules;
 
-function require(name) {
+function load(name, parent) {
+  if (parent) {
+    parents[name] = parents[name] || {};
+    parents[name][parent] = true;
+  }
   if (cache[name]) {
     return cache[name].exports;
   }
+  if (!modules[name]) {
+    throw new Error('Cannot find module \'' + name + '\'');
+  }
   var module = {
     name: name,
-    exports: {}
+    exports: {},
+    loaded: false
+  };
+  if (hot) {
+    module.hot = hot(module);
+  }
+  var req = function(dep) {
+    return load(dep, name);
   };
-  modules[name](module, module.exports, require);
+  req.esm = esm;
+  req.interop = interop;
+  req.star = star;
+  req.dynamic = function(dep) {
+    return dynamic(dep, name);
+  };
+  // Modules are cached before running so that a cycle back to them returns
+  // their exports so far, like node does. Modules which throw are dropped.
   cache[name] = module;
+  try {
+    modules[name](module, module.exports, req);
+  } catch (err) {
+    delete cache[name];
+    throw err;
+  }
+  module.loaded = true;
   return module.exports;
 }
 
-function chunk(path, cb) {
+// Defines live bindings for the exports of an ES module.
+function esm(exports, getters) {
+  Object.defineProperty(exports, '__esModule', { value: true });
+  Object.keys(getters).forEach(function(key) {
+    Object.defineProperty(exports, key, { enumerable: true, get: getters[key] });
+  });
+}
+
+// Returns ES modules as is and wraps CommonJS modules so that the default
+// import is module.exports.
+function interop(mod) {
+  if (mod && mod.__esModule) {
+    return mod;
+  }
+  var ns = {};
+  if (mod !== null && typeof mod === 'object') {
+    Object.keys(mod).forEach(function(key) {
+      ns[key] = mod[key];
+    });
+  }
+  ns['default'] = mod;
+  return ns;
+}
+
+// Re-exports every named export of mod, implementing export * from.
+function star(exports, mod) {
+  Object.keys(mod).forEach(function(key) {
+    if (key === 'default' || key === '__esModule' || Object.prototype.hasOwnProperty.call(exports, key)) {
+      return;
+    }
+    Object.defineProperty(exports, key, { enumerable: true, get: function() { return mod[key]; } });
+  });
+}
+
+function require(name) {
+  return load(name, null);
+}
+
+// Implements import(), loading the async chunk containing name if it has not
+// been loaded yet.
+function dynamic(name, parent) {
+  return new Promise(function(resolve, reject) {
+    var done = function(err) {
+      if (err) {
+        reject(err);
+        return;
+      }
+      try {
+        resolve(interop(load(name, parent)));
+      } catch (e) {
+        reject(e);
+      }
+    };
+    if (modules[name]) {
+      done(null);
+      return;
+    }
+    var path = asyncChunks[name];
+    if (!path) {
+      reject(new Error('Cannot find module \'' + name + '\''));
+      return;
+    }
+    loadChunk(path, done);
+  });
+}
+
+// Loads the chunk at path, calling cb with null once it has run or with a
+// ChunkLoadError once every attempt failed. Concurrent loads of a chunk share
+// its script, and a chunk which failed is attempted again by later loads.
+// Failed attempts are retried after retryDelay milliseconds, doubled for
+// every attempt.
+function loadChunk(path, cb) {
+  if (loadedChunks[path]) {
+    cb(null);
+    return;
+  }
+  if (pendingChunks[path]) {
+    pendingChunks[path].push(cb);
+    return;
+  }
+  pendingChunks[path] = [cb];
+
+  var src = publicPath + path;
+  var finish = function(err) {
+    var callbacks = pendingChunks[path];
+    delete pendingChunks[path];
+    callbacks.forEach(function(cb) { cb(err); });
+  };
+  var attempt = function(n) {
+    loadScript(src, integrity[path], nonce, function(err) {
+      if (!err && !loadedChunks[path]) {
+        finish(chunkError(path, src, n, 'the script did not register the chunk'));
+        return;
+      }
+      if (!err) {
+        finish(null);
+        return;
+      }
+      if (n > maxRetries) {
+        finish(chunkError(path, src, n, err.message));
+        return;
+      }
+      setTimeout(function() { attempt(n + 1); }, retryDelay * Math.pow(2, n - 1));
+    });
+  };
+  attempt(1);
+}
+
+function chunkError(path, src, attempts, reason) {
+  var err = new Error('Loading chunk ' + path + ' from ' + src + ' failed after ' +
+    attempts + (attempts === 1 ? ' attempt: ' : ' attempts: ') + reason);
+  err.name = 'ChunkLoadError';
+  err.chunk = path;
+  err.request = src;
+  return err;
+}
+
+// Injects a script tag, calling cb with an error if it fails to load because
+// of a network error or an integrity mismatch.
+function injectScript(src, hash, nonce, cb) {
   var script = document.createElement('script');
-  script.src = path;
+  script.src = src;
   script.type = 'text/javascript';
-  script.onload = function() { cb() };
+  if (hash) {
+    script.integrity = hash;
+    script.crossOrigin = 'anonymous';
+  }
+  if (nonce) {
+    script.nonce = nonce;
+  }
+  script.onload = function() { cb(null); };
+  script.onerror = function() {
+    if (script.parentNode) {
+      script.parentNode.removeChild(script);
+    }
+    cb(new Error('network error or integrity mismatch'));
+  };
   document.getElementsByTagName('head')[0].appendChild(script);
 }
 
-function start(chunks, main) {
-  if (!chunks || chunks.length === 0) {
+// Starts the entrypoint main once the chunks it loads have run. The async
+// table maps the modules loaded with import() to their chunks, and hashes
+// maps chunks to the integrity they are loaded with. The nonce is used when
+// the page sets none. Failing to load a chunk is thrown asynchronously, to
+// reach the error handlers of the page.
+function start(chunks, main, async, hashes, defaultNonce) {
+  Object.keys(async || {}).forEach(function(name) {
+    asyncChunks[name] = async[name];
+  });
+  Object.keys(hashes || {}).forEach(function(path) {
+    integrity[path] = hashes[path];
+  });
+  nonce = nonce || defaultNonce || '';
+  chunks = chunks || [];
+  if (chunks.length === 0) {
     require(main);
+    return;
   }
+  var remaining = chunks.length;
+  var failed = false;
   chunks.forEach(function(path) {
-    chunk(path, function() {
-      loaded++;
-      if (loaded === chunks.length) {
+    loadChunk(path, function(err) {
+      if (failed) {
+        return;
+      }
+      if (err) {
+        failed = true;
+        setTimeout(function() { throw err; }, 0);
+        return;
+      }
+      remaining--;
+      if (remaining === 0) {
         require(main);
       }
     });
   });
 }
 `
+
+// devClient connects to the development server, reloading the page or applying
+// hot updates after a rebuild. It expects a devServer variable holding the
+// event stream URL.
+const devClient = `
+var hotData = {};
+var hotHandlers = {};
+
+hot = function(module) {
+  var handlers = { accepted: false, accept: [], dispose: [] };
+  hotHandlers[module.name] = handlers;
+  return {
+    data: hotData[module.name],
+    accept: function(cb) {
+      handlers.accepted = true;
+      if (cb) {
+        handlers.accept.push(cb);
+      }
+    },
+    dispose: function(cb) {
+      handlers.dispose.push(cb);
+    }
+  };
+};
+
+// Applies new module factories. Every module between an updated module and
+// the nearest accepting module is disposed and removed from the cache, then
+// the accepting modules are executed again. Returns false if an update
+// reaches a module with no importers that does not accept it.
+function hotApply(updates) {
+  var invalid = {};
+  var accepting = {};
+
+  function invalidate(name) {
+    if (invalid[name]) {
+      return true;
+    }
+    invalid[name] = true;
+    if (!cache[name]) {
+      return true;
+    }
+    var handlers = hotHandlers[name];
+    if (handlers && handlers.accepted) {
+      accepting[name] = handlers;
+      return true;
+    }
+    var importers = Object.keys(parents[name] || {});
+    if (importers.length === 0) {
+      return false;
+    }
+    for (var i = 0; i < importers.length; i++) {
+      if (!invalidate(importers[i])) {
+        return false;
+      }
+    }
+    return true;
+  }
+
+  var names = Object.keys(updates);
+  for (var i = 0; i < names.length; i++) {
+    if (!invalidate(names[i])) {
+      return false;
+    }
+  }
+
+  names.forEach(function(name) {
+    modules[name] = new Function('module', 'exports', 'require', updates[name]);
+  });
+  Object.keys(invalid).forEach(function(name) {
+    var handlers = hotHandlers[name];
+    var data = {};
+    if (handlers) {
+      handlers.dispose.forEach(function(cb) { cb(data); });
+    }
+    hotData[name] = data;
+    delete hotHandlers[name];
+    delete cache[name];
+  });
+  Object.keys(accepting).forEach(function(name) {
+    require(name);
+    accepting[name].accept.forEach(function(cb) { cb(); });
+  });
+  return true;
+}
+
+(function() {
+  if (typeof EventSource === 'undefined') {
+    return;
+  }
+  var source = new EventSource(devServer);
+  source.addEventListener('reload', function() {
+    window.location.reload();
+  });
+  source.addEventListener('update', function(e) {
+    var applied = false;
+    try {
+      applied = hotApply(JSON.parse(e.data));
+    } catch (err) {
+      console.error('jsbld: hot update failed', err);
+    }
+    if (!applied) {
+      window.location.reload();
+    }
+  });
+  source.addEventListener('failed', function(e) {
+    console.error('jsbld: rebuild failed\n' + e.data);
+  });
+})();
+`
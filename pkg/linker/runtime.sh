@@ -1,6 +1,7 @@
 #!/bin/bash
 
 runtime=$(cat ./runtime.js)
+devclient=$(cat ./devclient.js)
 
 echo "
 ${runtime}
@@ -13,4 +14,11 @@ package linker
 const runtime = \`
 ${runtime}
 \`
+
+// devClient connects to the development server, reloading the page or applying
+// hot updates after a rebuild. It expects a devServer variable holding the
+// event stream URL.
+const devClient = \`
+${devclient}
+\`
 EOF
@@ -0,0 +1,55 @@
+package linker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+)
+
+// TestRuntime runs the tests of the chunk loader in runtime_test.js with node.
+func TestRuntime(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	tests, err := ioutil.ReadFile("runtime_test.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := json.Marshal(runtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := "var runtimeSource = " + string(source) + ";\n" + string(tests)
+	out, err := exec.Command(node, "-e", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, out)
+	}
+	t.Logf("%s", out)
+}
+
+// TestDevClient runs the tests of hot updates in devclient_test.js with node.
+func TestDevClient(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	tests, err := ioutil.ReadFile("devclient_test.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := ""
+	for name, source := range map[string]string{"runtimeSource": runtime, "devClientSource": devClient} {
+		data, err := json.Marshal(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script += "var " + name + " = " + string(data) + ";\n"
+	}
+	out, err := exec.Command(node, "-e", script+string(tests)).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, out)
+	}
+	t.Logf("%s", out)
+}
@@ -0,0 +1,288 @@
+// Tests of the chunk loader of runtime.js, run with node by TestRuntime which
+// defines runtimeSource. Every test instantiates the runtime with a fake
+// document, whose scripts load or fail as scripted, and fake timers.
+
+var publicPath = 'https://cdn.test/js/';
+
+// newPage returns a page running the runtime. Chunks maps chunk paths to the
+// outcome of every attempt to load them, 'error', 'load' or 'empty' for a
+// script which runs without registering the chunk, and the modules the chunk
+// defines. Init prepares the window before the runtime runs. Pages define an
+// entrypoint src/main.js.
+function newPage(chunks, init) {
+  var page = { window: {}, scripts: [], delays: [], uncaught: [], tasks: [] };
+  var head = {
+    appendChild: function(script) {
+      script.parentNode = head;
+      page.scripts.push(script);
+      page.tasks.push(function() { respond(script); });
+    },
+    removeChild: function(script) {
+      script.parentNode = null;
+    }
+  };
+  var document = {
+    currentScript: { src: publicPath + 'main.js', nonce: 'n0' },
+    createElement: function(tag) { return { tagName: tag }; },
+    getElementsByTagName: function() { return [head]; }
+  };
+  var respond = function(script) {
+    var path = script.src.slice(publicPath.length);
+    var chunk = chunks[path] || { attempts: [] };
+    var outcome = chunk.attempts.shift() || 'error';
+    if (outcome === 'error') {
+      script.onerror();
+      return;
+    }
+    if (outcome === 'load') {
+      page.window.__chunks__[path] = true;
+      Object.keys(chunk.modules || {}).forEach(function(name) {
+        page.window.__modules__[name] = chunk.modules[name];
+      });
+    }
+    script.onload();
+  };
+  var setTimeout = function(fn, delay) {
+    page.delays.push(delay);
+    page.tasks.push(fn);
+  };
+  if (init) {
+    init(page.window);
+  }
+  var runtime = new Function('window', 'document', 'setTimeout',
+    runtimeSource + '\nreturn { start: start, require: require, dynamic: dynamic };');
+  page.runtime = runtime(page.window, document, setTimeout);
+  page.window.__modules__['src/main.js'] = exporting('main');
+
+  // settle runs the scheduled tasks, and the promise callbacks they
+  // trigger, until none remain.
+  page.settle = function() {
+    return new Promise(function(resolve) {
+      var next = function() {
+        var task = page.tasks.shift();
+        if (!task) {
+          resolve();
+          return;
+        }
+        try {
+          task();
+        } catch (err) {
+          page.uncaught.push(err);
+        }
+        setImmediate(next);
+      };
+      setImmediate(next);
+    });
+  };
+  return page;
+}
+
+// exporting returns a module factory exporting the value.
+function exporting(value) {
+  return function(module) {
+    module.exports = value;
+  };
+}
+
+function assertEqual(actual, expected, what) {
+  var a = JSON.stringify(actual);
+  var e = JSON.stringify(expected);
+  if (a !== e) {
+    throw new Error(what + ': got ' + a + ', want ' + e);
+  }
+}
+
+var tests = {
+  'start runs main after its chunks': function() {
+    var page = newPage({
+      'shared.js': { attempts: ['load'], modules: { 'src/shared.js': exporting('shared') } },
+      'vendor.js': { attempts: ['load'], modules: { 'lib.js': exporting('lib') } }
+    });
+    page.window.__modules__['src/main.js'] = function(module, exports, require) {
+      page.window.result = [require('src/shared.js'), require('lib.js')];
+    };
+    page.runtime.start(['shared.js', 'vendor.js'], 'src/main.js', {}, { 'shared.js': 'sha384-a' });
+    assertEqual(page.window.result, undefined, 'result before load');
+    return page.settle().then(function() {
+      assertEqual(page.window.result, ['shared', 'lib'], 'result');
+      assertEqual(page.scripts.map(function(s) { return [s.src, s.integrity, s.crossOrigin, s.nonce]; }), [
+        [publicPath + 'shared.js', 'sha384-a', 'anonymous', 'n0'],
+        [publicPath + 'vendor.js', undefined, undefined, 'n0']
+      ], 'scripts');
+    });
+  },
+
+  'start skips registered chunks': function() {
+    var page = newPage({});
+    page.window.__chunks__['shared.js'] = true;
+    page.window.__modules__['src/main.js'] = exporting('main');
+    page.runtime.start(['shared.js'], 'src/main.js', {});
+    assertEqual(page.runtime.require('src/main.js'), 'main', 'main');
+    assertEqual(page.scripts.length, 0, 'scripts');
+  },
+
+  'start throws when a chunk fails': function() {
+    var page = newPage({ 'shared.js': { attempts: ['error', 'error', 'error', 'error'] } });
+    page.window.__modules__['src/main.js'] = function() {
+      throw new Error('main ran');
+    };
+    page.runtime.start(['shared.js'], 'src/main.js', {});
+    return page.settle().then(function() {
+      assertEqual(page.uncaught.map(function(err) { return err.name; }), ['ChunkLoadError'], 'uncaught');
+    });
+  },
+
+  'concurrent imports share one script': function() {
+    var page = newPage({
+      'page.js': { attempts: ['load'], modules: { 'src/page.js': exporting('page'), 'src/lazy.js': exporting('lazy') } }
+    });
+    page.runtime.start([], 'src/main.js', { 'src/page.js': 'page.js', 'src/lazy.js': 'page.js' });
+    var imports = Promise.all([
+      page.runtime.dynamic('src/page.js', 'src/main.js'),
+      page.runtime.dynamic('src/lazy.js', 'src/main.js'),
+      page.runtime.dynamic('src/page.js', 'src/main.js')
+    ]);
+    return page.settle().then(function() {
+      return imports;
+    }).then(function(namespaces) {
+      assertEqual(namespaces.map(function(ns) { return ns['default']; }), ['page', 'lazy', 'page'], 'imports');
+      assertEqual(page.scripts.length, 1, 'scripts');
+    });
+  },
+
+  'failed loads are retried with backoff': function() {
+    var page = newPage({
+      'page.js': { attempts: ['error', 'error', 'load'], modules: { 'src/page.js': exporting('page') } }
+    });
+    page.runtime.start([], 'src/main.js', { 'src/page.js': 'page.js' });
+    var imported = page.runtime.dynamic('src/page.js', 'src/main.js');
+    return page.settle().then(function() {
+      return imported;
+    }).then(function(ns) {
+      assertEqual(ns['default'], 'page', 'import');
+      assertEqual(page.scripts.length, 3, 'scripts');
+      assertEqual(page.delays, [500, 1000], 'delays');
+      assertEqual(page.scripts.map(function(s) { return s.parentNode === null; }), [true, true, false], 'removed');
+    });
+  },
+
+  'imports reject after every retry failed': function() {
+    var page = newPage({
+      'page.js': { attempts: ['error', 'error', 'error', 'error', 'load'], modules: { 'src/page.js': exporting('page') } }
+    });
+    page.runtime.start([], 'src/main.js', { 'src/page.js': 'page.js' });
+    var failed = page.runtime.dynamic('src/page.js', 'src/main.js').then(function() {
+      throw new Error('import resolved');
+    }, function(err) {
+      return err;
+    });
+    return page.settle().then(function() {
+      return failed;
+    }).then(function(err) {
+      assertEqual(err.name, 'ChunkLoadError', 'name');
+      assertEqual(err.chunk, 'page.js', 'chunk');
+      assertEqual(err.request, publicPath + 'page.js', 'request');
+      assertEqual(err.message, 'Loading chunk page.js from ' + publicPath + 'page.js failed after 4 attempts: network error or integrity mismatch', 'message');
+      assertEqual(page.delays, [500, 1000, 2000], 'delays');
+
+      // A later import loads the chunk again.
+      var imported = page.runtime.dynamic('src/page.js', 'src/main.js');
+      return page.settle().then(function() {
+        return imported;
+      });
+    }).then(function(ns) {
+      assertEqual(ns['default'], 'page', 'import');
+    });
+  },
+
+  'chunks which do not register are rejected': function() {
+    var page = newPage({ 'page.js': { attempts: ['empty'] } });
+    page.runtime.start([], 'src/main.js', { 'src/page.js': 'page.js' });
+    var failed = page.runtime.dynamic('src/page.js', 'src/main.js').catch(function(err) {
+      return err;
+    });
+    return page.settle().then(function() {
+      return failed;
+    }).then(function(err) {
+      assertEqual(err.message, 'Loading chunk page.js from ' + publicPath + 'page.js failed after 1 attempt: the script did not register the chunk', 'message');
+      assertEqual(page.scripts.length, 1, 'scripts');
+    });
+  },
+
+  'unknown imports reject': function() {
+    var page = newPage({});
+    page.runtime.start([], 'src/main.js', {});
+    return page.runtime.dynamic('src/missing.js', 'src/main.js').then(function() {
+      throw new Error('import resolved');
+    }, function(err) {
+      assertEqual(err.message, 'Cannot find module \'src/missing.js\'', 'message');
+    });
+  },
+
+  'cycles return the exports so far': function() {
+    var page = newPage({});
+    page.window.__modules__['a.js'] = function(module, exports, require) {
+      exports.early = 1;
+      exports.seen = require('b.js').seen;
+      exports.late = 2;
+    };
+    page.window.__modules__['b.js'] = function(module, exports, require) {
+      var a = require('a.js');
+      exports.seen = Object.keys(a);
+    };
+    assertEqual(page.runtime.require('a.js'), { early: 1, seen: ['early'], late: 2 }, 'exports');
+  },
+
+  'modules which throw are not cached': function() {
+    var page = newPage({});
+    var runs = 0;
+    page.window.__modules__['a.js'] = function(module) {
+      runs++;
+      if (runs === 1) {
+        throw new Error('first run');
+      }
+      module.exports = runs;
+    };
+    try {
+      page.runtime.require('a.js');
+      throw new Error('require returned');
+    } catch (err) {
+      assertEqual(err.message, 'first run', 'error');
+    }
+    assertEqual(page.runtime.require('a.js'), 2, 'exports');
+    assertEqual(page.runtime.require('a.js'), 2, 'cached exports');
+  },
+
+  'pages may provide the script loader': function() {
+    var loaded = [];
+    var page = newPage({}, function(window) {
+      window.__loadScript__ = function(src, hash, nonce, cb) {
+        loaded.push([src, hash, nonce]);
+        window.__chunks__['page.js'] = true;
+        window.__modules__['src/page.js'] = exporting('page');
+        cb(null);
+      };
+    });
+    page.runtime.start([], 'src/main.js', { 'src/page.js': 'page.js' }, { 'page.js': 'sha384-p' });
+    return page.runtime.dynamic('src/page.js', 'src/main.js').then(function(ns) {
+      assertEqual(ns['default'], 'page', 'import');
+      assertEqual(loaded, [[publicPath + 'page.js', 'sha384-p', 'n0']], 'loaded');
+      assertEqual(page.scripts.length, 0, 'scripts');
+    });
+  }
+};
+
+var names = Object.keys(tests);
+var failures = 0;
+names.reduce(function(prev, name) {
+  return prev.then(function() {
+    return tests[name]();
+  }).then(function() {
+    console.log('ok   ' + name);
+  }, function(err) {
+    failures++;
+    console.log('FAIL ' + name + ': ' + (err && err.stack || err));
+  });
+}, Promise.resolve()).then(function() {
+  process.exit(failures > 0 ? 1 : 0);
+});
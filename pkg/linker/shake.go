@@ -0,0 +1,670 @@
+package linker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/coldog/jsbld/pkg/compiler"
+	"github.com/coldog/jsbld/pkg/js"
+	"github.com/coldog/jsbld/pkg/sourcemap"
+)
+
+// Tree shaking removes the exports of ES modules which no module of the bundle
+// uses, and the modules without side effects which aren't used at all.
+//
+// Entrypoints and async modules keep all their exports. From there, every
+// included ES module marks the names it references on the modules it imports,
+// and the used exports it re-exports on their source. CommonJS modules and
+// modules loaded with require() keep all their exports.
+//
+// A module is free of side effects when the package.json of its package sets
+// "sideEffects" to false, or to a list of patterns it does not match. Unused
+// modules free of side effects are dropped along with their requires.
+//
+// Unused exports lose their getter, and top level declarations which nothing
+// references anymore are removed when their initializer has no side effects.
+
+// shaken is a module after tree shaking. The source map is kept encoded as
+// writers modify the maps they read.
+type shaken struct {
+	code      []byte
+	sourceMap []byte
+}
+
+func (s *shaken) read() ([]byte, *sourcemap.Map, error) {
+	if s.sourceMap == nil {
+		return s.code, nil, nil
+	}
+	m := &sourcemap.Map{}
+	return s.code, m, json.Unmarshal(s.sourceMap, m)
+}
+
+// Shake removes unused exports and modules from the chunks and returns the
+// number of bytes eliminated. It runs after the bundler, before the chunks
+// are written, and updates the chunks entrypoint chunks load as their
+// outputs change.
+func (b *Bundle) Shake() (int64, error) {
+	used := b.usedExports()
+	b.shaken = map[string]*shaken{}
+	outputs := map[*Chunk]string{}
+	for _, chunk := range b.Chunks {
+		outputs[chunk] = chunk.Output()
+	}
+	var eliminated int64
+	for _, chunk := range b.Chunks {
+		for _, name := range chunk.Files.Keys() {
+			file := chunk.Files[name]
+			if used[name] == nil {
+				if st, err := os.Stat(filepath.Join(b.Root, name)); err == nil {
+					eliminated += st.Size()
+				}
+				delete(chunk.Files, name)
+				continue
+			}
+			if file.Module == nil {
+				continue
+			}
+			code, sourceMap, err := readModule(b.Root, name)
+			if err != nil {
+				return 0, err
+			}
+			out, edits := parseModule(name, code, file.Module).shake(used)
+			if len(edits) == 0 {
+				continue
+			}
+			s := &shaken{code: out}
+			if sourceMap != nil {
+				if err := sourceMap.Shift(code, out, edits); err != nil {
+					return 0, err
+				}
+				if s.sourceMap, err = json.Marshal(sourceMap); err != nil {
+					return 0, err
+				}
+			}
+			b.shaken[name] = s
+			eliminated += int64(len(code) - len(out))
+
+			// The output of the chunk depends on the shaken code.
+			sum := sha256.Sum256(out)
+			file.Hash = hex.EncodeToString(sum[:])
+			chunk.Files[name] = file
+		}
+	}
+	b.relink(outputs)
+	return eliminated, nil
+}
+
+// relink replaces the outputs the entrypoint chunks load, given the outputs
+// of the chunks before shaking, with the current ones.
+func (b *Bundle) relink(outputs map[*Chunk]string) {
+	renamed := map[string]string{}
+	for _, chunk := range b.Chunks {
+		if chunk.Entrypoint == "" {
+			renamed[outputs[chunk]] = chunk.Output()
+		}
+	}
+	for _, chunk := range b.Chunks {
+		if chunk.Entrypoint == "" {
+			continue
+		}
+		for i, load := range chunk.Loads {
+			if output, ok := renamed[load]; ok {
+				chunk.Loads[i] = output
+			}
+		}
+		for module, load := range chunk.Async {
+			if output, ok := renamed[load]; ok {
+				chunk.Async[module] = output
+			}
+		}
+	}
+}
+
+// usedExports returns the used exports of every module included in the
+// bundle, "*" when all of them are.
+func (b *Bundle) usedExports() map[string]map[string]bool {
+	used := map[string]map[string]bool{}
+	changed := false
+	mark := func(name, export string) {
+		if used[name] == nil {
+			used[name] = map[string]bool{}
+			changed = true
+		}
+		if export != "" && !used[name][export] {
+			used[name][export] = true
+			changed = true
+		}
+	}
+	for _, root := range b.Roots() {
+		mark(root, "*")
+	}
+
+	packages := map[string]sideEffects{}
+	for changed {
+		changed = false
+		for _, name := range b.Files.Keys() {
+			if used[name] == nil {
+				continue
+			}
+			file := b.Files[name]
+			m := file.Module
+			if m == nil || (m.Uses == nil && len(m.Imports) > 0) {
+				// CommonJS modules may use anything, as may ES modules compiled
+				// before uses were recorded.
+				for _, imp := range file.Imports {
+					mark(imp, "*")
+				}
+				continue
+			}
+			for _, u := range m.Uses {
+				mark(u.Source, u.Name)
+			}
+			for _, imp := range file.Imports {
+				if !b.sideEffectFree(imp, packages) {
+					mark(imp, "")
+				}
+			}
+			exports := []string{}
+			for export := range used[name] {
+				exports = append(exports, export)
+			}
+			sort.Strings(exports)
+			for _, export := range exports {
+				reexport(m, export, mark)
+			}
+		}
+	}
+	return used
+}
+
+// reexport marks the bindings a used export of the module is re-exported
+// from.
+func reexport(m *compiler.Module, export string, mark func(name, export string)) {
+	found := false
+	for _, e := range m.Exports {
+		if e.Name != export && export != "*" {
+			continue
+		}
+		found = true
+		source, local := e.Source, e.Local
+		if source == "" {
+			// Imported bindings exported again are re-exports.
+			for _, imp := range m.Imports {
+				if imp.Local == e.Local && imp.Source != "" {
+					source, local = imp.Source, imp.Name
+				}
+			}
+		}
+		if source != "" {
+			mark(source, local)
+		}
+	}
+	if (!found && export != "default") || export == "*" {
+		for _, source := range m.StarExports {
+			mark(source, export)
+		}
+	}
+}
+
+// sideEffects lists the patterns of the files of a package with side
+// effects, nil if all of them have.
+type sideEffects []string
+
+// sideEffectFree returns whether the package.json of the package containing
+// the file declares it free of side effects. Packages are cached by
+// directory.
+func (b *Bundle) sideEffectFree(name string, packages map[string]sideEffects) bool {
+	pkg := packageName(name)
+	if pkg == "" {
+		return false
+	}
+	i := strings.LastIndex("/"+name, "/node_modules/")
+	dir := name[:i] + "node_modules/" + pkg
+
+	patterns, ok := packages[dir]
+	if !ok {
+		patterns = readSideEffects(filepath.Join(b.Root, dir, "package.json"))
+		packages[dir] = patterns
+	}
+	if patterns == nil {
+		return false
+	}
+	rel := strings.TrimPrefix(name, dir+"/")
+	for _, pattern := range patterns {
+		if matchPattern(pattern, rel) {
+			return false
+		}
+	}
+	return true
+}
+
+func readSideEffects(path string) sideEffects {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	pkg := struct {
+		SideEffects interface{} `json:"sideEffects"`
+	}{}
+	if json.Unmarshal(data, &pkg) != nil {
+		return nil
+	}
+	switch v := pkg.SideEffects.(type) {
+	case bool:
+		if !v {
+			return sideEffects{}
+		}
+	case []interface{}:
+		patterns := sideEffects{}
+		for _, pattern := range v {
+			if s, ok := pattern.(string); ok {
+				patterns = append(patterns, s)
+			}
+		}
+		return patterns
+	}
+	return nil
+}
+
+// matchPattern matches a sideEffects pattern against a path relative to the
+// package. Patterns without a slash match the file name at any depth.
+func matchPattern(pattern, rel string) bool {
+	pattern = strings.TrimPrefix(pattern, "./")
+	if strings.HasPrefix(pattern, "**/") || !strings.Contains(pattern, "/") {
+		pattern = strings.TrimPrefix(pattern, "**/")
+		parts := strings.Split(rel, "/")
+		for i := range parts {
+			if ok, _ := path.Match(pattern, strings.Join(parts[i:], "/")); ok {
+				return true
+			}
+		}
+		return false
+	}
+	ok, _ := path.Match(pattern, rel)
+	return ok
+}
+
+// getter is an export getter of the require.esm() statement.
+type getter struct {
+	name       string
+	first, end int
+}
+
+// decl is a top level declaration free of side effects, spanning the tokens
+// from first to last.
+type decl struct {
+	names       []string
+	first, last int
+	// inside counts the references to the names within the declaration.
+	inside  map[string]int
+	removed bool
+}
+
+// shake returns the code of the module without the getters of its unused
+// exports, the declarations nothing references anymore and the requires of
+// dropped modules, and the edits applied.
+func (m *module) shake(used map[string]map[string]bool) ([]byte, []js.Edit) {
+	exports := used[m.name]
+	dead := make([]bool, len(m.tokens))
+	kill := func(start, end int) {
+		for i, tok := range m.tokens {
+			if tok.Start >= start && tok.Start < end {
+				dead[i] = true
+			}
+		}
+	}
+
+	edits := []js.Edit{}
+	vars := map[string]string{}
+	for _, s := range m.specs {
+		vars[s.name] = s.source
+		if used[s.source] == nil {
+			edits = append(edits, js.Edit{Start: s.start, End: s.end})
+			kill(s.start, s.end)
+		}
+	}
+	for _, s := range m.stars {
+		if used[vars[s.name]] == nil {
+			edits = append(edits, js.Edit{Start: s.start, End: s.end})
+			kill(s.start, s.end)
+		}
+	}
+	if exports["*"] || m.esm == nil {
+		return js.Apply(m.src, edits)
+	}
+
+	getters := m.getters()
+	kept := []string{}
+	for _, g := range getters {
+		if exports[g.name] {
+			kept = append(kept, string(m.src[m.tokens[g.first].Start:m.tokens[g.end-1].End]))
+		} else {
+			for i := g.first; i < g.end; i++ {
+				dead[i] = true
+			}
+		}
+	}
+	if len(kept) < len(getters) {
+		edits = append(edits, js.Edit{
+			Start: m.esm.Start,
+			End:   m.esm.End,
+			Text:  "require.esm(exports, {" + strings.Join(kept, ", ") + "});",
+		})
+	}
+
+	decls := m.decls()
+	for removed := true; removed; {
+		removed = false
+		refs := map[string]int{}
+		for i, tok := range m.tokens {
+			if !dead[i] && tok.Kind == js.Ident && !m.isMember(i) {
+				refs[m.text(i)]++
+			}
+		}
+		for _, d := range decls {
+			if d.removed {
+				continue
+			}
+			referenced := false
+			for _, name := range d.names {
+				if refs[name] > d.inside[name] {
+					referenced = true
+				}
+			}
+			if referenced {
+				continue
+			}
+			d.removed, removed = true, true
+			for i := d.first; i <= d.last; i++ {
+				dead[i] = true
+			}
+			edits = append(edits, js.Edit{Start: m.tokens[d.first].Start, End: m.tokens[d.last].End})
+		}
+	}
+	return js.Apply(m.src, edits)
+}
+
+// getters returns the getters of the require.esm() statement of the header:
+//
+//	require.esm(exports, {"a": function() { return a; }, ...});
+func (m *module) getters() []getter {
+	i := 0
+	for i < len(m.tokens) && m.tokens[i].Start < m.esm.Start {
+		i++
+	}
+	getters := []getter{}
+	if !m.is(i, "require", ".", "esm", "(", "exports", ",", "{") {
+		return getters
+	}
+	for k := i + 7; m.kind(k) == js.String && m.is(k+1, ":", "function", "(", ")", "{"); {
+		name := m.text(k)
+		end := m.close(k+5) + 1
+		getters = append(getters, getter{name: name[1 : len(name)-1], first: k, end: end})
+		k = end
+		if m.text(k) == "," {
+			k++
+		}
+	}
+	return getters
+}
+
+// decls returns the top level declarations of the body which can be removed
+// without side effects.
+func (m *module) decls() []*decl {
+	decls := []*decl{}
+	depth := 0
+	for i := m.body; i < len(m.tokens); i++ {
+		text := m.text(i)
+		prev := m.text(i - 1)
+		start := depth == 0 && (i == m.body || prev == ";" || prev == "}" ||
+			m.newlineBefore(i) && (m.kind(i-1) != js.Punct || prev == ")" || prev == "]"))
+		switch {
+		case text == "{" || text == "(" || text == "[":
+			depth++
+		case text == "}" || text == ")" || text == "]":
+			depth--
+		case m.kind(i) == js.TemplatePart:
+			if text[0] == '}' {
+				depth--
+			}
+			if text[len(text)-1] == '{' {
+				depth++
+			}
+		case text == "eval" || text == "with":
+			return nil
+		}
+		if !start || m.kind(i) != js.Ident {
+			continue
+		}
+		d := &decl{first: i, last: -1}
+		switch text {
+		case "async", "function":
+			n := i + 1
+			if text == "async" {
+				if m.text(n) != "function" {
+					continue
+				}
+				n++
+			}
+			if m.text(n) == "*" {
+				n++
+			}
+			if m.kind(n) == js.Ident && m.text(n+1) == "(" {
+				d.names = []string{m.text(n)}
+				d.last = m.function(n + 1)
+			}
+		case "class":
+			if m.kind(i+1) == js.Ident && m.text(i+1) != "extends" {
+				d.names = []string{m.text(i + 1)}
+				d.last = m.class(i + 2)
+			}
+		case "var", "let", "const":
+			d.names, d.last = m.declaration(i + 1)
+		}
+		if d.last < 0 {
+			continue
+		}
+		d.inside = map[string]int{}
+		for k := d.first; k <= d.last; k++ {
+			if m.kind(k) == js.Ident && !m.isMember(k) {
+				d.inside[m.text(k)]++
+			}
+		}
+		decls = append(decls, d)
+		// The loop continues within the declaration to track the depth.
+	}
+	return decls
+}
+
+// declaration returns the names and last token of a var, let or const
+// declaration list starting at i, or -1 if an initializer may have side
+// effects.
+func (m *module) declaration(i int) ([]string, int) {
+	names := []string{}
+	for {
+		if m.kind(i) != js.Ident {
+			return nil, -1
+		}
+		names = append(names, m.text(i))
+		i++
+		if m.text(i) == "=" {
+			if i = m.pure(i + 1); i < 0 {
+				return nil, -1
+			}
+		}
+		switch {
+		case m.text(i) == ",":
+			i++
+		case m.text(i) == ";":
+			return names, i
+		case i >= len(m.tokens) || m.newlineBefore(i):
+			return names, i - 1
+		default:
+			return nil, -1
+		}
+	}
+}
+
+// pure returns the token after an expression without side effects starting
+// at i, or -1: literals, functions, classes and arrow functions.
+func (m *module) pure(i int) int {
+	text := m.text(i)
+	switch m.kind(i) {
+	case js.String, js.Number, js.Regex, js.Template:
+		return i + 1
+	}
+	switch text {
+	case "true", "false", "null", "undefined":
+		return i + 1
+	case "-":
+		if m.kind(i+1) == js.Number {
+			return i + 2
+		}
+		return -1
+	case "function":
+		n := i + 1
+		if m.text(n) == "*" {
+			n++
+		}
+		if m.kind(n) == js.Ident {
+			n++
+		}
+		return m.function(n) + 1
+	case "class":
+		n := i + 1
+		if m.kind(n) == js.Ident && m.text(n) != "extends" {
+			n++
+		}
+		if end := m.class(n); end >= 0 {
+			return end + 1
+		}
+		return -1
+	case "async":
+		if m.text(i+1) == "function" {
+			return m.pure(i + 1)
+		}
+		i++
+	}
+
+	// Arrow functions.
+	body := -1
+	switch {
+	case m.kind(i) == js.Ident && m.is(i+1, "=", ">"):
+		body = i + 3
+	case m.text(i) == "(":
+		if end := m.close(i); m.is(end+1, "=", ">") {
+			body = end + 3
+		}
+	}
+	if body < 0 {
+		return -1
+	}
+	if m.text(body) == "{" {
+		return m.close(body) + 1
+	}
+	end := m.skipExpr(body, ",")
+	depth := 0
+	for k := body; k < end; k++ {
+		switch m.text(k) {
+		case "{", "(", "[":
+			depth++
+		case "}", ")", "]":
+			depth--
+		}
+		if depth == 0 && k > body && m.newlineBefore(k) {
+			// The body may end at the newline.
+			return -1
+		}
+	}
+	return end
+}
+
+// function returns the last token of a function with parameters starting at
+// i, or -2.
+func (m *module) function(i int) int {
+	if m.text(i) != "(" {
+		return -2
+	}
+	body := m.close(i) + 1
+	if m.text(body) != "{" {
+		return -2
+	}
+	return m.close(body)
+}
+
+// class returns the last token of a class declaration or expression after its
+// name at i, or -1 if evaluating it may have side effects: static members,
+// computed keys and heritage other than a name.
+func (m *module) class(i int) int {
+	if m.text(i) == "extends" {
+		if m.kind(i+1) != js.Ident {
+			return -1
+		}
+		i += 2
+		for m.text(i) == "." && m.kind(i+1) == js.Ident {
+			i += 2
+		}
+	}
+	if m.text(i) != "{" {
+		return -1
+	}
+	end := m.close(i)
+	depth := 0
+	for k := i + 1; k < end; k++ {
+		switch m.text(k) {
+		case "static":
+			if depth == 0 {
+				return -1
+			}
+		case "[":
+			if depth == 0 {
+				return -1
+			}
+			depth++
+		case "{", "(":
+			depth++
+		case "}", ")", "]":
+			depth--
+		}
+	}
+	return end
+}
+
+// close returns the bracket closing the one at i.
+func (m *module) close(i int) int {
+	depth := 0
+	for ; i < len(m.tokens); i++ {
+		text := m.text(i)
+		switch {
+		case text == "{" || text == "(" || text == "[":
+			depth++
+		case text == "}" || text == ")" || text == "]":
+			depth--
+		case m.kind(i) == js.TemplatePart:
+			if text[0] == '}' {
+				depth--
+			}
+			if text[len(text)-1] == '{' {
+				depth++
+			}
+		}
+		if depth == 0 {
+			return i
+		}
+	}
+	return i
+}
+
+func (m *module) newlineBefore(i int) bool {
+	if i <= 0 || i >= len(m.tokens) {
+		return true
+	}
+	return strings.Contains(string(m.src[m.tokens[i-1].End:m.tokens[i].Start]), "\n")
+}
@@ -0,0 +1,101 @@
+package linker
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShake(t *testing.T) {
+	b := compileSources(t, map[string]string{
+		"src/index.js": `import { add } from './math';
+import { twice } from 'lib';
+import * as ns from './ns';
+import 'pure';
+import './side';
+window.result = [add(1, 2), twice(2), ns.x];
+`,
+		"src/math.js": `function helper(a) { return a; }
+const unused = function() { return helper(1); };
+export function add(a, b) { return a + b; }
+export const sub = (a, b) => a - b;
+export { unused };
+`,
+		"src/ns.js":                      "export const x = 1;\nexport const y = 2;\n",
+		"src/side.js":                    "window.side = true;\nexport const z = 3;\n",
+		"node_modules/lib/package.json":  `{"main": "index.js", "sideEffects": false}`,
+		"node_modules/lib/index.js":      "export { twice } from './twice';\nexport { half } from './half';\n",
+		"node_modules/lib/twice.js":      "export const twice = x => x * 2;\n",
+		"node_modules/lib/half.js":       "export const half = x => x / 2;\n",
+		"node_modules/pure/package.json": `{"main": "index.js", "sideEffects": ["*.css"]}`,
+		"node_modules/pure/index.js":     "export const p = 1;\n",
+	})
+	defer os.RemoveAll(filepath.Dir(b.Root))
+
+	eliminated, err := b.Shake()
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	out := writeBundle(t, b)
+
+	// Unused modules without side effects are dropped.
+	expected := []string{"node_modules/lib/index.js", "node_modules/lib/twice.js", "src/index.js", "src/math.js", "src/ns.js", "src/side.js"}
+	if names := factories(out); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("wrong factories %v:\n%s", names, out)
+	}
+	for _, removed := range []string{"helper", "unused", "sub", "y = 2", "half", "z = 3", "node_modules/pure"} {
+		if strings.Contains(out, removed) {
+			t.Fatalf("%q not removed:\n%s", removed, out)
+		}
+	}
+	for _, kept := range []string{"function add(a, b)", "window.side = true;", "x = 1"} {
+		if !strings.Contains(out, kept) {
+			t.Fatalf("%q removed:\n%s", kept, out)
+		}
+	}
+	if eliminated <= 0 {
+		t.Fatalf("eliminated %d bytes", eliminated)
+	}
+	if result := evalResult(t, out); result != `[3,4,1]` {
+		t.Fatalf("wrong result %s:\n%s", result, out)
+	}
+}
+
+func TestShakeDefault(t *testing.T) {
+	b := compileSources(t, map[string]string{
+		"src/index.js":  "import other from './other';\nwindow.result = other;\n",
+		"src/other.js":  "import { s } from './shared'; export default 'other+' + s;\n",
+		"src/shared.js": "export const s = 's';\nexport const unused = 'unused';\n",
+	})
+	defer os.RemoveAll(filepath.Dir(b.Root))
+
+	if _, err := b.Shake(); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	out := writeBundle(t, b)
+	if strings.Contains(out, "unused") {
+		t.Fatalf("unused export not removed:\n%s", out)
+	}
+	if result := evalResult(t, out); result != `"other+s"` {
+		t.Fatalf("wrong result %s:\n%s", result, out)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, test := range []struct {
+		pattern, rel string
+		match        bool
+	}{
+		{"*.css", "styles/main.css", true},
+		{"./src/polyfill.js", "src/polyfill.js", true},
+		{"./src/*.js", "lib/index.js", false},
+		{"**/side.js", "a/b/side.js", true},
+		{"index.js", "lib/other.js", false},
+	} {
+		if match := matchPattern(test.pattern, test.rel); match != test.match {
+			t.Errorf("%s %s: got %v", test.pattern, test.rel, match)
+		}
+	}
+}
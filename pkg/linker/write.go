@@ -1,88 +1,273 @@
 package linker
 
 import (
-	"bufio"
-	"io"
-	"os"
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/coldog/jsbld/pkg/graph"
+	"github.com/coldog/jsbld/pkg/js"
+	"github.com/coldog/jsbld/pkg/sourcemap"
 )
 
+// tasks are the nodes of a graph of writes, run in dependency order.
+type tasks struct {
+	nodes map[int][]int
+	funcs []func() error
+}
+
+// add adds a task depending on the given tasks and returns its id.
+func (t *tasks) add(f func() error, deps ...int) int {
+	id := len(t.funcs)
+	t.funcs = append(t.funcs, f)
+	t.nodes[id] = deps
+	return id
+}
+
+// run runs the tasks, skipping the tasks depending on a failed one, and
+// returns the first error.
+func (t *tasks) run(concurrency int) error {
+	g := &graph.Graph{
+		Concurrency: concurrency,
+		Nodes:       t.nodes,
+		Process: func(ctx context.Context, id int) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return t.funcs[id]()
+		},
+	}
+	return g.Solve(context.Background())
+}
+
 const header = "\"use strict\";\n(function() {\n"
 const footer = "})();\n"
 
-func bundle(files Files, entry, output string, loads []string) error {
-	f, err := os.OpenFile(output, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0777)
-	if err != nil {
-		return err
+func (b *Bundle) bundle(chunk *Chunk, h *hoister) error {
+	// The chunks loaded by the entrypoint are written first, their hashes
+	// let the runtime load them with subresource integrity.
+	hashes := map[string]string{}
+	paths := append([]string{}, chunk.Loads...)
+	for _, output := range chunk.Async {
+		paths = append(paths, output)
+	}
+	for _, path := range paths {
+		integrity, err := Integrity(filepath.Join(b.Root, path))
+		if err != nil {
+			return err
+		}
+		hashes[path] = integrity
 	}
-	w := bufio.NewWriter(f)
 
-	_, err = w.WriteString(header)
+	return writeChunk(b.Root, chunk.Output(), b.Minify, func(w *chunkWriter) error {
+		_, err := w.WriteString(runtime)
+		if err != nil {
+			return err
+		}
+		if b.DevServer != "" {
+			err = writeDevClient(w, b.DevServer)
+			if err != nil {
+				return err
+			}
+		}
+		err = writeFiles(b.load, chunk.Files, w, h)
+		if err != nil {
+			return err
+		}
+		return writeStart(w, chunk.Entrypoint, chunk.Loads, chunk.Async, hashes, b.Nonce)
+	})
+}
+
+func (b *Bundle) bundleChunk(chunk *Chunk, h *hoister) error {
+	output := chunk.Output()
+	return writeChunk(b.Root, output, b.Minify, func(w *chunkWriter) error {
+		// Register the chunk so that entrypoints don't load it again when it
+		// is included with a script tag. Script tags run chunks before the
+		// entrypoint whose runtime creates the module registry.
+		name, err := json.Marshal(output)
+		if err != nil {
+			return err
+		}
+		_, err = w.WriteString("(window.__chunks__ = window.__chunks__ || {})[" + string(name) + "] = true;\n" +
+			"var modules = window.__modules__ = window.__modules__ || {};\n")
+		if err != nil {
+			return err
+		}
+		return writeFiles(b.load, chunk.Files, w, h)
+	})
+}
+
+// writeChunk writes the output file wrapping the body, and an index source
+// map composed of the source maps of its files. Minified chunks get a single
+// map instead, following the edits of the minifier.
+func writeChunk(root, output string, minify bool, body func(w *chunkWriter) error) error {
+	w := &chunkWriter{w: &bytes.Buffer{}}
+
+	_, err := w.WriteString(header)
 	if err != nil {
 		return err
 	}
-	_, err = w.WriteString(runtime)
+	err = body(w)
 	if err != nil {
 		return err
 	}
-	err = writeFiles(files, w)
+	_, err = w.WriteString(footer)
 	if err != nil {
 		return err
 	}
-	err = writeStart(w, entry, loads)
-	if err != nil {
-		return err
+
+	code := w.w.Bytes()
+	idx := &sourcemap.Index{Version: 3, File: output, Sections: w.sections}
+	var sourceMap interface{} = idx
+	if minify {
+		src := code
+		var edits []js.Edit
+		code, edits = js.Minify(src)
+		code = append(code, '\n')
+		if len(w.sections) > 0 {
+			m, err := idx.Flatten()
+			if err != nil {
+				return fmt.Errorf("%s: %v", output, err)
+			}
+			err = m.Shift(src, code, edits)
+			if err != nil {
+				return fmt.Errorf("%s: %v", output, err)
+			}
+			sourceMap = m
+		}
 	}
-	_, err = w.WriteString(footer)
-	if err != nil {
-		return err
+	if len(w.sections) > 0 {
+		data, err := json.Marshal(sourceMap)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(root, output+".map"), data, 0666)
+		if err != nil {
+			return err
+		}
+		code = append(code, "//# sourceMappingURL="+output+".map\n"...)
 	}
-	return w.Flush()
+	return ioutil.WriteFile(filepath.Join(root, output), code, 0777)
 }
 
-func bundleChunk(files Files, output string) error {
-	f, err := os.OpenFile(output, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0777)
-	if err != nil {
-		return err
-	}
-	w := bufio.NewWriter(f)
+// chunkWriter counts the lines written to place the source maps of files.
+type chunkWriter struct {
+	w        *bytes.Buffer
+	line     int
+	sections []sourcemap.Section
+}
 
-	_, err = w.WriteString(header)
-	if err != nil {
-		return err
-	}
-	err = writeFiles(files, w)
-	if err != nil {
-		return err
-	}
-	_, err = w.WriteString(footer)
-	if err != nil {
-		return err
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.line += bytes.Count(p, []byte("\n"))
+	return w.w.Write(p)
+}
+
+func (w *chunkWriter) WriteString(s string) (int, error) {
+	w.line += strings.Count(s, "\n")
+	return w.w.WriteString(s)
+}
+
+func writeStart(w *chunkWriter, entrypoint string, chunkPaths []string, async, hashes map[string]string, nonce string) error {
+	args := []string{}
+	for _, v := range []interface{}{chunkPaths, entrypoint, async, hashes, nonce} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		args = append(args, string(data))
 	}
-	return w.Flush()
+	_, err := w.WriteString("start(" + strings.Join(args, ", ") + ")\n")
+	return err
 }
 
-func writeStart( w *bufio.Writer, entrypoint string, chunkPaths []string) error {
-	data, err := json.Marshal(chunkPaths)
+func writeDevClient(w *chunkWriter, devServer string) error {
+	data, err := json.Marshal(devServer)
 	if err != nil {
 		return err
 	}
-	_, err = w.WriteString("start("+ string(data) +", \"" + entrypoint + "\")")
+	_, err = w.WriteString("var devServer = " + string(data) + ";\n" + devClient)
 	return err
 }
 
-func writeFiles(files Files, w *bufio.Writer) error {
-	for _, file := range files.Keys() {
-		fm, err := os.Open(file)
+// writeFiles registers a factory for every file, or for every scope of
+// concatenated modules if h is set, in the modules variable of the chunk.
+func writeFiles(load loader, files Files, w *chunkWriter, h *hoister) error {
+	scopes := []*scope{}
+	if h != nil {
+		var err error
+		scopes, err = h.scopes(load, files)
 		if err != nil {
 			return err
 		}
-		w.WriteString("window.__modules__[\"" + file + "\"] = function(module, exports, require) {\n")
-		_, err = io.Copy(w, fm)
+	} else {
+		for _, file := range files.Keys() {
+			code, sourceMap, err := load(file)
+			if err != nil {
+				return err
+			}
+			scopes = append(scopes, &scope{name: file, modules: []hoisted{{file, code, sourceMap}}})
+		}
+	}
+
+	for _, s := range scopes {
+		_, err := w.WriteString("modules[\"" + s.name + "\"] = function(module, exports, require) {\n")
+		if err != nil {
+			return err
+		}
+		for _, m := range s.modules {
+			if m.sourceMap != nil {
+				// Sources are relative to the file, make them relative to the
+				// chunk.
+				for i, source := range m.sourceMap.Sources {
+					if !strings.Contains(source, ":") && !path.IsAbs(source) {
+						m.sourceMap.Sources[i] = path.Join(path.Dir(m.name), source)
+					}
+				}
+				w.sections = append(w.sections, sourcemap.Section{Offset: sourcemap.Offset{Line: w.line}, Map: m.sourceMap})
+			}
+			_, err = w.Write(m.code)
+			if err != nil {
+				return err
+			}
+			_, err = w.WriteString("\n")
+			if err != nil {
+				return err
+			}
+		}
+		_, err = w.WriteString("};\n")
 		if err != nil {
 			return err
 		}
-		w.WriteString("};\n")
 	}
 	return nil
 }
+
+// loader reads the code and source map of a compiled file.
+type loader func(name string) ([]byte, *sourcemap.Map, error)
+
+// load reads a compiled file, or its code after tree shaking.
+func (b *Bundle) load(name string) ([]byte, *sourcemap.Map, error) {
+	if s, ok := b.shaken[name]; ok {
+		return s.read()
+	}
+	return readModule(b.Root, name)
+}
+
+// readModule reads a compiled file and its source map, if any.
+func readModule(root, name string) ([]byte, *sourcemap.Map, error) {
+	code, err := ioutil.ReadFile(filepath.Join(root, name))
+	if err != nil {
+		return nil, nil, err
+	}
+	sourceMap, err := sourcemap.ReadFile(filepath.Join(root, name+".map"))
+	if os.IsNotExist(err) {
+		return code, nil, nil
+	}
+	return code, sourceMap, err
+}
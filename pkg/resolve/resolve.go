@@ -1,28 +1,40 @@
 package resolve
 
 import (
-	"strings"
-	"path/filepath"
-	"os"
-	"fmt"
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 var Extensions = []string{"js", "jsx", "tsx", "ts"}
 
-// Resolve implements a basic node resolution algorithm. It returns a relative
-// path to a file.
-func Resolve(root, name string) (string, error) {
+// Resolver implements a basic node resolution algorithm within a project
+// root. Resolved paths are relative to the root.
+type Resolver struct {
+	Root       string
+	Extensions []string
+}
+
+// Resolve resolves the name required from a file in dir, relative to the
+// root, and returns the path of the file relative to the root.
+func (r *Resolver) Resolve(dir, name string) (string, error) {
+	exts := r.Extensions
+	if exts == nil {
+		exts = Extensions
+	}
+
 	if !(strings.HasPrefix(name, "../") || strings.HasPrefix(name, "./") || strings.HasPrefix(name, "/")) {
 		name = filepath.Join("node_modules", name)
 	} else {
-		name = filepath.Join(root, name)
+		name = filepath.Join(dir, name)
 	}
 
-	st, err := os.Stat(name)
+	st, err := os.Stat(filepath.Join(r.Root, name))
 	if err != nil {
-		for _, ext := range Extensions {
-			st, err = os.Stat(name + "." + ext)
+		for _, ext := range exts {
+			st, err = os.Stat(filepath.Join(r.Root, name+"."+ext))
 			if err == nil {
 				name = name + "." + ext
 				break
@@ -35,14 +47,14 @@ func Resolve(root, name string) (string, error) {
 	}
 
 	if st.IsDir() {
-		_, err := os.Stat(filepath.Join(name, "package.json"))
+		_, err := os.Stat(filepath.Join(r.Root, name, "package.json"))
 		if err != nil && !os.IsNotExist(err) {
 			return "", err
 		}
 
 		main := "index.js"
 		if err == nil {
-			f, err := os.Open(filepath.Join(name, "package.json"))
+			f, err := os.Open(filepath.Join(r.Root, name, "package.json"))
 			if err != nil {
 				return "", err
 			}
@@ -0,0 +1,81 @@
+package sourcemap
+
+import "fmt"
+
+// Flatten merges the sections of the index into a single map, sharing the
+// sources and names of the sections.
+func (idx *Index) Flatten() (*Map, error) {
+	m := &Map{Version: 3, File: idx.File, Sources: []string{}, Names: []string{}}
+	sources := map[string]int{}
+	names := map[string]int{}
+	hasContent := false
+	contents := []*string{}
+	lines := [][]Segment{}
+
+	for _, section := range idx.Sections {
+		sm := section.Map
+		decoded, err := sm.Decode()
+		if err != nil {
+			return nil, err
+		}
+		sourceIndex := make([]int, len(sm.Sources))
+		for i, source := range sm.Sources {
+			if sm.SourceRoot != "" {
+				source = sm.SourceRoot + "/" + source
+			}
+			var content *string
+			if i < len(sm.SourcesContent) {
+				content = sm.SourcesContent[i]
+			}
+			j, ok := sources[source]
+			if !ok {
+				j = len(m.Sources)
+				sources[source] = j
+				m.Sources = append(m.Sources, source)
+				contents = append(contents, content)
+			}
+			if content != nil {
+				hasContent = true
+				contents[j] = content
+			}
+			sourceIndex[i] = j
+		}
+		nameIndex := make([]int, len(sm.Names))
+		for i, name := range sm.Names {
+			j, ok := names[name]
+			if !ok {
+				j = len(m.Names)
+				names[name] = j
+				m.Names = append(m.Names, name)
+			}
+			nameIndex[i] = j
+		}
+
+		for i, segments := range decoded {
+			line := section.Offset.Line + i
+			for len(lines) <= line {
+				lines = append(lines, []Segment{})
+			}
+			for _, seg := range segments {
+				if seg.Source >= len(sourceIndex) || seg.Name >= len(nameIndex) {
+					return nil, fmt.Errorf("mapping out of range in section at line %d", section.Offset.Line)
+				}
+				if i == 0 {
+					seg.Column += section.Offset.Column
+				}
+				if seg.Source >= 0 {
+					seg.Source = sourceIndex[seg.Source]
+				}
+				if seg.Name >= 0 {
+					seg.Name = nameIndex[seg.Name]
+				}
+				lines[line] = append(lines[line], seg)
+			}
+		}
+	}
+	if hasContent {
+		m.SourcesContent = contents
+	}
+	m.Encode(lines)
+	return m, nil
+}
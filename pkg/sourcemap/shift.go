@@ -0,0 +1,103 @@
+package sourcemap
+
+import (
+	"unicode/utf8"
+
+	"github.com/coldog/jsbld/pkg/js"
+)
+
+// Shift moves the generated positions of the map of src to the positions in
+// out, the result of applying the edits to src. Positions inside a replaced
+// range move to the start of its replacement.
+func (m *Map) Shift(src, out []byte, edits []js.Edit) error {
+	lines, err := m.Decode()
+	if err != nil {
+		return err
+	}
+	from := &cursor{text: src}
+	to := &cursor{text: out}
+	shifted := [][]Segment{}
+	i, delta, last := 0, 0, 0
+	for line, segments := range lines {
+		for _, seg := range segments {
+			off := from.offset(line, seg.Column)
+			if off < 0 {
+				continue
+			}
+			if off < last {
+				i, delta = 0, 0
+			}
+			last = off
+			for i < len(edits) && edits[i].End <= off {
+				delta += len(edits[i].Text) - (edits[i].End - edits[i].Start)
+				i++
+			}
+			pos := off + delta
+			if i < len(edits) && off > edits[i].Start {
+				pos = edits[i].Start + delta
+			}
+			l, c := to.position(pos)
+			for len(shifted) <= l {
+				shifted = append(shifted, []Segment{})
+			}
+			seg.Column = c
+			shifted[l] = append(shifted[l], seg)
+		}
+	}
+	m.Encode(shifted)
+	return nil
+}
+
+// cursor converts between byte offsets and zero based lines and UTF-16
+// columns of a text. It is fast when moving forward.
+type cursor struct {
+	text []byte
+	off  int
+	line int
+	col  int
+}
+
+func (c *cursor) reset() {
+	c.off, c.line, c.col = 0, 0, 0
+}
+
+// step moves past the character at the cursor.
+func (c *cursor) step() {
+	r, size := utf8.DecodeRune(c.text[c.off:])
+	c.off += size
+	switch {
+	case r == '\n':
+		c.line++
+		c.col = 0
+	case r >= 0x10000:
+		c.col += 2
+	default:
+		c.col++
+	}
+}
+
+// offset returns the byte offset of a position, or -1 if it is past the end
+// of the text.
+func (c *cursor) offset(line, col int) int {
+	if line < c.line || line == c.line && col < c.col {
+		c.reset()
+	}
+	for c.off < len(c.text) && (c.line < line || c.line == line && c.col < col && c.text[c.off] != '\n') {
+		c.step()
+	}
+	if c.line != line || c.col != col {
+		return -1
+	}
+	return c.off
+}
+
+// position returns the line and column of a byte offset.
+func (c *cursor) position(off int) (int, int) {
+	if off < c.off {
+		c.reset()
+	}
+	for c.off < off && c.off < len(c.text) {
+		c.step()
+	}
+	return c.line, c.col
+}
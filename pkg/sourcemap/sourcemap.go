@@ -0,0 +1,184 @@
+// Package sourcemap reads and writes revision 3 source maps.
+package sourcemap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Map is a source map of a single generated file.
+type Map struct {
+	Version        int       `json:"version"`
+	File           string    `json:"file,omitempty"`
+	SourceRoot     string    `json:"sourceRoot,omitempty"`
+	Sources        []string  `json:"sources"`
+	SourcesContent []*string `json:"sourcesContent,omitempty"`
+	Names          []string  `json:"names"`
+	Mappings       string    `json:"mappings"`
+}
+
+// Index is an index source map, composed of the maps of the sections of a
+// generated file.
+type Index struct {
+	Version  int       `json:"version"`
+	File     string    `json:"file,omitempty"`
+	Sections []Section `json:"sections"`
+}
+
+// Section is a map starting at an offset of the generated file.
+type Section struct {
+	Offset Offset `json:"offset"`
+	Map    *Map   `json:"map"`
+}
+
+// Offset is a zero based line and column of a generated file.
+type Offset struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Segment maps a column of a generated line. Source and Name are -1 for
+// segments without them, positions are zero based and columns are counted
+// in UTF-16 code units.
+type Segment struct {
+	Column       int
+	Source       int
+	SourceLine   int
+	SourceColumn int
+	Name         int
+}
+
+// ReadFile reads a source map file.
+func ReadFile(path string) (*Map, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Map{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if m.Version != 3 {
+		return nil, fmt.Errorf("%s: unsupported source map version %d", path, m.Version)
+	}
+	return m, nil
+}
+
+// Decode returns the segments of every generated line.
+func (m *Map) Decode() ([][]Segment, error) {
+	lines := [][]Segment{}
+	var source, sourceLine, sourceColumn, name int
+	for _, line := range strings.Split(m.Mappings, ";") {
+		segments := []Segment{}
+		column := 0
+		for _, field := range strings.Split(line, ",") {
+			if field == "" {
+				continue
+			}
+			values, err := decodeVLQ(field)
+			if err != nil {
+				return nil, err
+			}
+			seg := Segment{Source: -1, Name: -1}
+			switch len(values) {
+			case 5:
+				name += values[4]
+				seg.Name = name
+				fallthrough
+			case 4:
+				source += values[1]
+				sourceLine += values[2]
+				sourceColumn += values[3]
+				seg.Source, seg.SourceLine, seg.SourceColumn = source, sourceLine, sourceColumn
+				fallthrough
+			case 1:
+				column += values[0]
+				seg.Column = column
+			default:
+				return nil, fmt.Errorf("invalid mapping segment %q", field)
+			}
+			segments = append(segments, seg)
+		}
+		lines = append(lines, segments)
+	}
+	return lines, nil
+}
+
+// Encode sets the mappings from the segments of every generated line.
+func (m *Map) Encode(lines [][]Segment) {
+	var b strings.Builder
+	var source, sourceLine, sourceColumn, name int
+	for i, segments := range lines {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		column := 0
+		for j, seg := range segments {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			encodeVLQ(&b, seg.Column-column)
+			column = seg.Column
+			if seg.Source < 0 {
+				continue
+			}
+			encodeVLQ(&b, seg.Source-source)
+			encodeVLQ(&b, seg.SourceLine-sourceLine)
+			encodeVLQ(&b, seg.SourceColumn-sourceColumn)
+			source, sourceLine, sourceColumn = seg.Source, seg.SourceLine, seg.SourceColumn
+			if seg.Name >= 0 {
+				encodeVLQ(&b, seg.Name-name)
+				name = seg.Name
+			}
+		}
+	}
+	m.Mappings = b.String()
+}
+
+const base64 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+func decodeVLQ(field string) ([]int, error) {
+	values := []int{}
+	value, shift := 0, uint(0)
+	for i := 0; i < len(field); i++ {
+		digit := strings.IndexByte(base64, field[i])
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid mapping character %q", field[i])
+		}
+		value += (digit & 31) << shift
+		if digit&32 != 0 {
+			shift += 5
+			continue
+		}
+		if value&1 != 0 {
+			values = append(values, -(value >> 1))
+		} else {
+			values = append(values, value>>1)
+		}
+		value, shift = 0, 0
+	}
+	if shift != 0 {
+		return nil, fmt.Errorf("truncated mapping segment %q", field)
+	}
+	return values, nil
+}
+
+func encodeVLQ(b *strings.Builder, value int) {
+	v := value << 1
+	if value < 0 {
+		v = (-value << 1) | 1
+	}
+	for {
+		digit := v & 31
+		v >>= 5
+		if v > 0 {
+			digit |= 32
+		}
+		b.WriteByte(base64[digit])
+		if v == 0 {
+			return
+		}
+	}
+}
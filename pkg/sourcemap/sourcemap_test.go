@@ -0,0 +1,73 @@
+package sourcemap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	m := &Map{Version: 3, Mappings: "AAAA,IAAIA;;ACCA,EAAE,gBAAgB"}
+	lines, err := m.Decode()
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	expected := [][]Segment{
+		{{0, 0, 0, 0, -1}, {4, 0, 0, 4, 0}},
+		{},
+		{{0, 1, 1, 4, -1}, {2, 1, 1, 6, -1}, {18, 1, 1, 22, -1}},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("wrong segments: %v", lines)
+	}
+
+	m.Encode(lines)
+	if m.Mappings != "AAAA,IAAIA;;ACCA,EAAE,gBAAgB" {
+		t.Fatalf("wrong mappings: %s", m.Mappings)
+	}
+}
+
+func TestVLQ(t *testing.T) {
+	for _, n := range []int{0, 1, -1, 15, 16, -16, 1000, -123456} {
+		m := &Map{}
+		m.Encode([][]Segment{{{Column: n + 123456, Source: 0, SourceLine: n, SourceColumn: -n, Name: -1}}})
+		lines, err := m.Decode()
+		if err != nil {
+			t.Fatalf("failed: %v", err)
+		}
+		seg := lines[0][0]
+		if seg.Column != n+123456 || seg.SourceLine != n || seg.SourceColumn != -n {
+			t.Fatalf("%d round tripped as %+v", n, seg)
+		}
+	}
+	if _, err := (&Map{Mappings: "AAAg"}).Decode(); err == nil {
+		t.Fatal("expected error for truncated segment")
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	content := "b"
+	a := &Map{Version: 3, Sources: []string{"a.js"}, Names: []string{"x"}, Mappings: "AAAAA"}
+	b := &Map{Version: 3, SourceRoot: "lib", Sources: []string{"b.js", "../a.js"}, SourcesContent: []*string{&content}, Mappings: "AAAA;ACAA"}
+	m, err := (&Index{Version: 3, File: "out.js", Sections: []Section{
+		{Offset: Offset{Line: 0}, Map: a},
+		{Offset: Offset{Line: 1, Column: 4}, Map: b},
+	}}).Flatten()
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if !reflect.DeepEqual(m.Sources, []string{"a.js", "lib/b.js", "lib/../a.js"}) || m.SourcesContent[1] != &content || m.File != "out.js" {
+		t.Fatalf("wrong sources: %+v", m)
+	}
+	lines, err := m.Decode()
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	expected := [][]Segment{
+		{{0, 0, 0, 0, 0}},
+		{{4, 1, 0, 0, -1}},
+		{{0, 2, 0, 0, -1}},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("wrong segments: %v", lines)
+	}
+}
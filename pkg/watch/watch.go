@@ -0,0 +1,104 @@
+// Package watch polls source directories for file changes. Polling keeps the
+// implementation portable and free of dependencies at the cost of a small
+// delay between a write and the rebuild it triggers.
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type stat struct {
+	mod  time.Time
+	size int64
+}
+
+// Watcher reports files under Dirs which were created, modified or removed
+// between scans. Dirs are relative to Root.
+type Watcher struct {
+	Root     string
+	Dirs     []string
+	Interval time.Duration
+
+	stats map[string]stat
+}
+
+// Scan walks the directories and returns the changed files relative to the
+// root. The first scan only records the initial state and reports nothing.
+func (w *Watcher) Scan() ([]string, error) {
+	stats := map[string]stat{}
+	for _, dir := range w.Dirs {
+		err := filepath.Walk(filepath.Join(w.Root, dir), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(w.Root, path)
+			if err != nil {
+				return err
+			}
+			stats[rel] = stat{mod: info.ModTime(), size: info.Size()}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prev := w.stats
+	w.stats = stats
+	if prev == nil {
+		return nil, nil
+	}
+
+	changed := []string{}
+	for path, st := range stats {
+		if p, ok := prev[path]; !ok || p != st {
+			changed = append(changed, path)
+		}
+	}
+	for path := range prev {
+		if _, ok := stats[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// Watch scans every interval and calls fn with the changed files until the
+// context is cancelled.
+func (w *Watcher) Watch(ctx context.Context, fn func(changed []string)) error {
+	interval := w.Interval
+	if interval == 0 {
+		interval = 500 * time.Millisecond
+	}
+	if _, err := w.Scan(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			changed, err := w.Scan()
+			if err != nil {
+				return err
+			}
+			if len(changed) > 0 {
+				fn(changed)
+			}
+		}
+	}
+}
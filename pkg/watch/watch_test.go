@@ -0,0 +1,56 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScan(t *testing.T) {
+	root, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	write := func(name, data string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0777)
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("src/a.js", "a")
+	write("src/b.js", "b")
+	write("other/c.js", "c")
+
+	w := &Watcher{Root: root, Dirs: []string{"src", "missing"}}
+	changed, err := w.Scan()
+	if err != nil || len(changed) != 0 {
+		t.Fatalf("initial scan: %v %v", changed, err)
+	}
+
+	write("src/a.js", "aa")
+	write("src/d.js", "d")
+	write("other/c.js", "cc")
+	os.Remove(filepath.Join(root, "src/b.js"))
+	// Ensure modification times differ on filesystems with coarse mtimes.
+	future := time.Now().Add(time.Second)
+	os.Chtimes(filepath.Join(root, "src/a.js"), future, future)
+
+	changed, err = w.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"src/a.js", "src/b.js", "src/d.js"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Fatalf("changed: %v, expected %v", changed, expected)
+	}
+
+	changed, err = w.Scan()
+	if err != nil || len(changed) != 0 {
+		t.Fatalf("unchanged scan: %v %v", changed, err)
+	}
+}